@@ -1,25 +1,56 @@
 package cli
 
 import (
+	"io"
+
 	"github.com/NethermindEth/docker-volumes-snapshotter/internal/backup"
-	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
 	"github.com/spf13/cobra"
 )
 
 func BackupCmd() *cobra.Command {
-	return &cobra.Command{
+	var (
+		output, base string
+		dryRun       bool
+		appendBackup bool
+		format       string
+	)
+	cmd := &cobra.Command{
 		Use: "backup",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			conf, err := config.LoadConfig()
+			conf, err := loadConfig(cmd)
 			if err != nil {
 				return err
 			}
-			err = backup.Backup(conf)
-			if err != nil {
-				return err
+			opts := backup.BackupOptions{Base: base, Append: appendBackup}
+			if dryRun {
+				if output != "" {
+					// The output is not created, nothing is written
+					opts.Output = io.Discard
+				}
+				plan, err := backup.PlanBackup(conf, archivePath(cmd), opts)
+				if err != nil {
+					return err
+				}
+				return printPlan(plan, format)
 			}
-
-			return nil
+			closeOutput := func() error { return nil }
+			if output != "" {
+				opts.Output, closeOutput, err = openOutput(output)
+				if err != nil {
+					return err
+				}
+			}
+			err = backup.Backup(conf, archivePath(cmd), opts)
+			if closeErr := closeOutput(); err == nil {
+				err = closeErr
+			}
+			return err
 		},
 	}
+	cmd.Flags().StringVar(&output, "output", "", "write the backup to a new archive at this path, or to the standard output with -, instead of appending it to the archive")
+	cmd.Flags().StringVar(&base, "base", "", "make an incremental backup storing only the changes since the backup of this prefix in the archive")
+	cmd.Flags().BoolVar(&appendBackup, "append", false, "keep the previous backup of the prefix in the archive instead of replacing it")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the plan of the backup, with the files and bytes of every volume, without writing it")
+	cmd.Flags().StringVar(&format, "format", "text", "format of the --dry-run plan, text or json")
+	return cmd
 }
@@ -1,16 +1,79 @@
 package cli
 
 import (
+	"errors"
+	"os"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
 	"github.com/spf13/cobra"
 )
 
+// Environment variables setting the paths of the configuration file and of the
+// archive, when their flags are not given.
+const (
+	ConfigEnv  = "SNAPSHOTTER_CONFIG"
+	ArchiveEnv = "SNAPSHOTTER_ARCHIVE"
+)
+
 func RootCmd() *cobra.Command {
 	cmd := cobra.Command{
 		Use: "snapshotter",
 	}
+	cmd.PersistentFlags().String("config", envOr(ConfigEnv, config.ConfigFilePath), "path to the configuration file, also set with "+ConfigEnv)
+	cmd.PersistentFlags().String("archive", envOr(ArchiveEnv, backuptar.Path), "path to the backup archive, also set with "+ArchiveEnv)
+	cmd.PersistentFlags().StringArray("set", nil, "override a key of the configuration file, given as key=value such as prefix=node-1 or compression.algorithm=zstd, can be repeated")
 
 	cmd.AddCommand(BackupCmd())
 	cmd.AddCommand(RestoreCmd())
+	cmd.AddCommand(VerifyCmd())
+	cmd.AddCommand(ListCmd())
+	cmd.AddCommand(PruneCmd())
 
 	return &cmd
 }
+
+// envOr returns the value of the environment variable env, or def if it is
+// not set.
+func envOr(env, def string) string {
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	return def
+}
+
+// loadConfig loads the configuration file of the --config flag, with the keys
+// of the --set flags overridden.
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	path, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := cmd.Flags().GetStringArray("set")
+	if err != nil {
+		return nil, err
+	}
+	return config.LoadConfig(path, overrides...)
+}
+
+// loadOptionalConfig loads the configuration like loadConfig, or returns nil
+// if there is no configuration file.
+func loadOptionalConfig(cmd *cobra.Command) (*config.Config, error) {
+	path, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return loadConfig(cmd)
+}
+
+// archivePath returns the path of the archive of the --archive flag.
+func archivePath(cmd *cobra.Command) string {
+	path, _ := cmd.Flags().GetString("archive")
+	return path
+}
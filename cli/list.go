@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/internal/backup"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+func ListCmd() *cobra.Command {
+	var (
+		opts   backup.ListOptions
+		output string
+	)
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the backups of the archive with their volumes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// The configuration is only needed to decrypt encrypted backups
+			conf, err := loadOptionalConfig(cmd)
+			if err != nil {
+				return err
+			}
+			backups, err := backup.List(conf, archivePath(cmd), opts)
+			if err != nil {
+				return err
+			}
+			return printBackups(os.Stdout, backups, output)
+		},
+	}
+	cmd.Flags().StringVar(&opts.Prefix, "prefix", "", "only list the backups whose prefix matches this glob pattern")
+	cmd.Flags().StringVar(&output, "output", "table", "output format, table, json or yaml")
+	return cmd
+}
+
+// printBackups writes the backups to w in the given format.
+func printBackups(w io.Writer, backups []backup.BackupInfo, format string) error {
+	switch format {
+	case "table":
+		return printBackupsTable(w, backups)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(backups)
+	case "yaml":
+		data, err := yaml.Marshal(backups)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %q, expected table, json or yaml", format)
+	}
+}
+
+// printBackupsTable writes a row for every volume of the backups, with
+// shortened ids.
+func printBackupsTable(w io.Writer, backups []backup.BackupInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tTIME\tID\tTYPE\tTARGET\tFILES\tSIZE\tBASE")
+	for _, b := range backups {
+		for _, v := range b.Volumes {
+			files, size := "-", "-"
+			if b.Manifest {
+				files, size = fmt.Sprint(v.Files), fmt.Sprint(v.Size)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%.12s\t%s\t%s\t%s\t%s\t%s\n", b.Prefix, b.Time.Format("2006-01-02 15:04:05"), v.Id, v.Type, v.Target, files, size, v.Base)
+		}
+	}
+	return tw.Flush()
+}
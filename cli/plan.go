@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// textPlan is a dry-run plan which can be written in a human-readable form.
+type textPlan interface {
+	WriteText(w io.Writer) error
+}
+
+// printPlan writes the plan of a dry run to the standard output, in the text
+// or json format.
+func printPlan(plan textPlan, format string) error {
+	switch format {
+	case "text":
+		return plan.WriteText(os.Stdout)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	default:
+		return fmt.Errorf("unknown plan format %q, expected text or json", format)
+	}
+}
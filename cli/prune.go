@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"errors"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/internal/backup"
+	"github.com/spf13/cobra"
+)
+
+func PruneCmd() *cobra.Command {
+	var prefix string
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the backup of a prefix from the archive",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if prefix == "" {
+				return errors.New("the prefix of the backup to remove is required")
+			}
+			// The configuration is only needed to decrypt encrypted backups
+			conf, err := loadOptionalConfig(cmd)
+			if err != nil {
+				return err
+			}
+			return backup.Prune(conf, archivePath(cmd), prefix)
+		},
+	}
+	cmd.Flags().StringVar(&prefix, "prefix", "", "prefix of the backup to remove from the archive")
+	return cmd
+}
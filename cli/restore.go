@@ -1,20 +1,48 @@
 package cli
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/NethermindEth/docker-volumes-snapshotter/internal/backup"
-	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
 	"github.com/spf13/cobra"
 )
 
 func RestoreCmd() *cobra.Command {
-	return &cobra.Command{
+	var (
+		opts   backup.RestoreOptions
+		input  string
+		remap  []string
+		dryRun bool
+		format string
+	)
+	cmd := &cobra.Command{
 		Use: "restore",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			conf, err := config.LoadConfig()
+			conf, err := loadConfig(cmd)
 			if err != nil {
 				return err
 			}
-			err = backup.Restore(conf)
+			opts.Remap, err = parseRemap(remap)
+			if err != nil {
+				return err
+			}
+			if input != "" {
+				r, closeInput, err := openInput(input)
+				if err != nil {
+					return err
+				}
+				defer closeInput()
+				opts.Input = r
+			}
+			if dryRun {
+				plan, err := backup.PlanRestore(conf, archivePath(cmd), opts)
+				if err != nil {
+					return err
+				}
+				return printPlan(plan, format)
+			}
+			err = backup.Restore(conf, archivePath(cmd), opts)
 			if err != nil {
 				return err
 			}
@@ -22,4 +50,29 @@ func RestoreCmd() *cobra.Command {
 			return nil
 		},
 	}
+	cmd.Flags().BoolVar(&opts.NoSameOwner, "no-same-owner", false, "restore files owned by the user running the restore instead of the owner stored in the backup")
+	cmd.Flags().StringArrayVar(&opts.Volumes, "volume", nil, "only restore the volume with this target, or id, can be repeated")
+	cmd.Flags().StringArrayVar(&opts.Paths, "path", nil, "only restore the files of the directory volumes matching this glob pattern, relative to the volume target, without clearing the volumes, can be repeated")
+	cmd.Flags().StringArrayVar(&remap, "map", nil, "restore the volumes with a target at or under /old/path under /new/path instead, given as /old/path=/new/path, can be repeated")
+	cmd.Flags().StringVar(&opts.To, "to", "", "restore every volume under this directory, at the path of its target, instead of the volume targets")
+	cmd.Flags().StringVar(&input, "input", "", "read the backup sequentially from the archive at this path, or from the standard input with -, instead of the archive")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the plan of the restore, with the targets replaced and the files and bytes of every volume, without writing anything")
+	cmd.Flags().StringVar(&format, "format", "text", "format of the --dry-run plan, text or json")
+	return cmd
+}
+
+// parseRemap parses the old=new path pairs of the --map flags.
+func parseRemap(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	remap := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		old, new, ok := strings.Cut(pair, "=")
+		if !ok || old == "" || new == "" {
+			return nil, fmt.Errorf("invalid --map %q, expected /old/path=/new/path", pair)
+		}
+		remap[old] = new
+	}
+	return remap, nil
 }
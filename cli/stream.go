@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"io"
+	"os"
+)
+
+// openOutput returns the writer of the output path, the standard output for
+// "-", and a function closing it.
+func openOutput(path string) (io.Writer, func() error, error) {
+	if path == "-" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// openInput returns the reader of the input path, the standard input for
+// "-", and a function closing it.
+func openInput(path string) (io.Reader, func() error, error) {
+	if path == "-" {
+		return os.Stdin, func() error { return nil }, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"github.com/NethermindEth/docker-volumes-snapshotter/internal/backup"
+	"github.com/spf13/cobra"
+)
+
+func VerifyCmd() *cobra.Command {
+	var opts backup.VerifyOptions
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check the files of the backup against its manifest",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conf, err := loadConfig(cmd)
+			if err != nil {
+				return err
+			}
+			return backup.Verify(conf, archivePath(cmd), opts)
+		},
+	}
+	cmd.Flags().BoolVar(&opts.Live, "live", false, "also compare the files of the volumes with the manifest, to check a restore")
+	return cmd
+}
@@ -3,8 +3,11 @@ module github.com/NethermindEth/docker-volumes-snapshotter
 go 1.21
 
 require (
+	filippo.io/age v1.1.1
+	github.com/klauspost/compress v1.17.4
 	github.com/spf13/cobra v1.7.0
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/sys v0.15.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -13,5 +16,6 @@ require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/crypto v0.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,8 +1,12 @@
 package backup
 
 import (
+	"archive/tar"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -17,57 +21,367 @@ func volumeId(target string) string {
 	return hex.EncodeToString(hash[:])
 }
 
-func Backup(c *config.Config) error {
+// BackupOptions configures the backup process.
+type BackupOptions struct {
+	// Output receives the backup as a new archive, such as the standard
+	// output, instead of appending it to the archive.
+	Output io.Writer
+	// Base is the prefix of a previous backup in the archive to make an
+	// incremental backup from: only the files
+	// whose size or modification time changed since it are stored, and the
+	// deleted ones are recorded as whiteouts.
+	Base string
+	// Append keeps the previous backup of the prefix in the archive. By
+	// default it is replaced by the new backup, once the new backup is
+	// written.
+	Append bool
+}
+
+// Backup backs up the volumes of the configuration c, appending the backup to
+// the archive at tarPath unless the configuration or opts.Output store it
+// elsewhere. The backup hooks of the configuration run around it, and the ones
+// of the volumes around their snapshot, or their copy if snapshots are not
+// enabled.
+func Backup(c *config.Config, tarPath string, opts BackupOptions) error {
+	pre, post := backupHooks(c.Hooks)
+	return withHooks(hookScope{operation: "backup", prefix: c.Prefix}, pre, post, func() error {
+		return runBackup(c, tarPath, opts)
+	})
+}
+
+// runBackup makes the backup of Backup, between its hooks.
+func runBackup(c *config.Config, tarPath string, opts BackupOptions) error {
 	slog.Info("Starting backup")
-	backupWriter, err := backuptar.NewBackupWriter(backuptar.Path)
+	if c.ChunkStore != nil {
+		return backupChunkStore(c, opts)
+	}
+	var writerOpts []backuptar.WriterOption
+	if c.Compression != nil {
+		compression, err := backuptar.ParseCompression(c.Compression.Algorithm)
+		if err != nil {
+			return err
+		}
+		writerOpts = append(writerOpts, backuptar.WithCompression(compression, c.Compression.Level))
+	}
+	recipients, err := encryptionRecipients(c)
+	if err != nil {
+		return err
+	}
+	if len(recipients) > 0 {
+		slog.Info("Encrypting backup")
+		writerOpts = append(writerOpts, backuptar.WithEncryption(recipients...))
+	}
+	if c.Storage != nil {
+		return backupToStorage(c, opts, writerOpts)
+	}
+
+	base, err := openIncrementalBase(c, tarPath, opts)
 	if err != nil {
 		return err
 	}
-	defer backupWriter.Close()
 
+	volumesData, err := newVolumesData(c, base)
+	if err != nil {
+		return err
+	}
+
+	var (
+		backupWriter *backuptar.BackupWriter
+		replace      func() error
+	)
+	if opts.Output != nil {
+		backupWriter, err = backuptar.NewStreamWriter(opts.Output, writerOpts...)
+	} else {
+		if !opts.Append {
+			replace, err = replacePrevious(c, tarPath)
+			if err != nil {
+				return err
+			}
+		}
+		backupWriter, err = backuptar.NewBackupWriter(tarPath, writerOpts...)
+	}
+	if err != nil {
+		return err
+	}
+	err = writeBackup(c, backupWriter, volumesData, base, false)
+	if err != nil {
+		// The archive is left as it was before the backup
+		return errors.Join(err, backupWriter.Abort())
+	}
+	err = backupWriter.Close()
+	if err != nil || replace == nil {
+		return err
+	}
+	return replace()
+}
+
+// openIncrementalBase loads the base backup of an incremental backup in the
+// archive at tarPath, or returns nil if opts.Base is not set.
+func openIncrementalBase(c *config.Config, tarPath string, opts BackupOptions) (*incrementalBase, error) {
+	if opts.Base == "" {
+		return nil, nil
+	}
+	if opts.Output != nil {
+		return nil, errors.New("incremental backups must be appended to the archive of their base backup")
+	}
+	if opts.Base == c.Prefix {
+		return nil, fmt.Errorf("incremental backup can't be based on its own prefix %q", c.Prefix)
+	}
+	identities, err := encryptionIdentities(c)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Starting incremental backup", "base", opts.Base)
+	return loadIncrementalBase(tarPath, opts.Base, backuptar.WithIdentities(identities...))
+}
+
+// newVolumesData returns the data of the volumes of the configuration. The
+// volumes of base are marked as based on it, unless they are files which
+// changed since.
+func newVolumesData(c *config.Config, base *incrementalBase) ([]VolumeData, error) {
 	var volumesData []VolumeData
 	for _, v := range c.Volumes {
-		targetInfo, err := os.Stat(v)
+		targetInfo, err := os.Stat(v.Path)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		volumeData := VolumeData{
-			Id:     volumeId(v),
-			Target: v,
+			Id:      volumeId(v.Path),
+			Type:    "file",
+			Target:  v.Path,
+			Options: volumeOptions(v),
 		}
 		if targetInfo.IsDir() {
 			volumeData.Type = "dir"
-			slog.Info("Adding dir to backup", "src", v, "dest", filepath.Join(c.Prefix, volumeData.Id))
-			err := backupWriter.AddDir(v, filepath.Join(c.Prefix, volumeData.Id))
-			if err != nil {
+		}
+		if base != nil {
+			if _, ok := base.volume(volumeData); ok {
+				// Directories are stored as changes to the base backup,
+				// and files only if they changed
+				_, unchanged := base.unchanged(volumeData.Id, ".", targetInfo)
+				if volumeData.Type == "dir" || unchanged {
+					volumeData.Base = base.prefix
+				}
+			}
+		}
+		volumesData = append(volumesData, volumeData)
+	}
+	return volumesData, nil
+}
+
+// entryWriter stores the files of a backup, in the tar archive or in the
+// chunk store.
+type entryWriter interface {
+	AddDir(src, dest string, opts ...backuptar.AddOption) error
+	AddFile(src, dest string, opts ...backuptar.AddOption) error
+	AddWhiteout(name string) error
+	Checksums() []backuptar.FileChecksum
+}
+
+// writeBackup writes the metadata, the volumes and their manifest with
+// backupWriter. The metadata comes first, so that a restore reading the
+// backup as a stream knows its volumes before their files. The volumes with a
+// base backup only get their changes since base written. Unless dryRun is
+// set, the volumes are snapshotted if enabled, and their backup hooks are run.
+func writeBackup(c *config.Config, backupWriter entryWriter, volumesData []VolumeData, base *incrementalBase, dryRun bool) (err error) {
+	// Invalid patterns are found before anything is written
+	filters := make([]*backuptar.Filter, len(c.Volumes))
+	for i, v := range c.Volumes {
+		filters[i], err = volumeFilter(v, volumesData[i])
+		if err != nil {
+			return err
+		}
+	}
+	// The volumes are snapshotted and their files counted before the
+	// metadata is written, as it records the snapshot strategies and the
+	// stats of the files backed up
+	srcs := make([]string, len(c.Volumes))
+	for i, v := range c.Volumes {
+		srcs[i] = v.Path
+	}
+	snapshotted := !dryRun && c.Snapshot != ""
+	if snapshotted {
+		var remove func() error
+		srcs, remove, err = snapshotVolumes(c, volumesData)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, remove())
+		}()
+	} else if !dryRun {
+		// The snapshots of an interrupted backup are not left in the
+		// volumes once snapshots are disabled
+		for _, v := range c.Volumes {
+			if err := backuptar.RemoveStaleSnapshot(v.Path); err != nil {
 				return err
 			}
-		} else {
-			volumeData.Type = "file"
-			slog.Info("Adding file to backup", "src", v, "dest", filepath.Join(c.Prefix, volumeData.Id))
-			err := backupWriter.AddFile(v, filepath.Join(c.Prefix, volumeData.Id))
-			if err != nil {
+		}
+	}
+	for i := range volumesData {
+		volumesData[i].Stats, err = volumeStats(srcs[i], volumesData[i].Type, filters[i])
+		if err != nil {
+			return err
+		}
+	}
+	err = addYAML(backupWriter, newMetadata(c, volumesData), VolumesDataPath(c))
+	if err != nil {
+		return err
+	}
+	// Checksums of the volumes data are not part of the manifest
+	skip := len(backupWriter.Checksums())
+	// Manifest entries of the files unchanged since the base backup
+	var unchanged []ManifestEntry
+
+	for i, v := range c.Volumes {
+		volumeData := volumesData[i]
+		src := srcs[i]
+		var addOpts []backuptar.AddOption
+		if v.Xattrs {
+			addOpts = append(addOpts, backuptar.WithXattrs())
+		}
+		filter := filters[i]
+		if filter != nil {
+			addOpts = append(addOpts, backuptar.WithFilter(filter))
+		}
+		dest := filepath.Join(c.Prefix, volumeData.Id)
+		if volumeData.Base != "" {
+			addOpts = append(addOpts, backuptar.WithUnchanged(func(relPath string, fi os.FileInfo) bool {
+				entry, ok := base.unchanged(volumeData.Id, relPath, fi)
+				if ok {
+					unchanged = append(unchanged, carriedOver(entry, filepath.Join(dest, relPath)))
+				}
+				return ok
+			}))
+		}
+		addVolume := func() error {
+			switch {
+			case volumeData.Type == "dir":
+				slog.Info("Adding dir to backup", "src", src, "dest", dest)
+				err := backupWriter.AddDir(src, dest, addOpts...)
+				if err == nil && volumeData.Base != "" {
+					err = addWhiteouts(backupWriter, base, volumeData.Id, src, dest, filter)
+				}
 				return err
+			case volumeData.Base != "":
+				slog.Info("File unchanged since base backup", "src", v.Path, "base", volumeData.Base)
+				unchanged = append(unchanged, carriedOver(base.files[volumeData.Id], dest))
+				return nil
+			default:
+				slog.Info("Adding file to backup", "src", src, "dest", dest)
+				return backupWriter.AddFile(src, dest, addOpts...)
 			}
 		}
-		volumesData = append(volumesData, volumeData)
+		if !dryRun && !snapshotted {
+			pre, post := backupHooks(v.Hooks)
+			scope := hookScope{operation: "backup", prefix: c.Prefix, volumeId: volumeData.Id, target: v.Path}
+			err = withHooks(scope, pre, post, addVolume)
+		} else {
+			err = addVolume()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The manifest covers the files of the volumes
+	manifest := append(manifestEntries(backupWriter.Checksums()[skip:]), unchanged...)
+	return addYAML(backupWriter, manifest, ManifestPath(c))
+}
+
+// volumeFilter returns the filter of the include and exclude patterns of the
+// volume v, or nil if it is a file. The snapshot of a directory volume, inside
+// it, is always excluded, as an interrupted backup may have left it even with
+// snapshots disabled.
+func volumeFilter(v config.Volume, volumeData VolumeData) (*backuptar.Filter, error) {
+	if volumeData.Type != "dir" {
+		if len(v.Include) != 0 || len(v.Exclude) != 0 {
+			return nil, fmt.Errorf("volume %s is not a directory, it can't have include or exclude patterns", v.Path)
+		}
+		return nil, nil
 	}
+	exclude := append(v.Exclude[:len(v.Exclude):len(v.Exclude)], "/"+backuptar.SnapshotName+"/")
+	filter, err := backuptar.NewFilter(v.Include, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("volume %s: %w", v.Path, err)
+	}
+	return filter, nil
+}
 
-	dataTemp, err := os.CreateTemp("/", "volumes-data-*.yml")
+// volumeStats counts the files of the volume of the given type at src, which
+// are selected by filter if it is not nil.
+func volumeStats(src, volumeType string, filter *backuptar.Filter) (*VolumeStats, error) {
+	stats := &VolumeStats{}
+	if volumeType != "dir" {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		stats.Files, stats.Size = 1, fi.Size()
+		return stats, nil
+	}
+	var opts []backuptar.AddOption
+	if filter != nil {
+		opts = append(opts, backuptar.WithFilter(filter))
+	}
+	err := backuptar.FileHeaders(src, "", func(header *tar.Header, file string, fi os.FileInfo) error {
+		if header.Typeflag == tar.TypeReg {
+			stats.Files++
+			stats.Size += header.Size
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// addWhiteouts records the files and directories of the volume of the given
+// id deleted from src since the base backup, as whiteouts under dest. The
+// files not selected by filter, which may be nil, count as deleted.
+func addWhiteouts(backupWriter entryWriter, base *incrementalBase, id, src, dest string, filter *backuptar.Filter) error {
+	deleted, err := base.deleted(id, src, filter)
 	if err != nil {
 		return err
 	}
-	data, err := yaml.Marshal(&volumesData)
+	for _, relPath := range deleted {
+		err := backupWriter.AddWhiteout(filepath.Join(dest, relPath))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataAdder is implemented by the entry writers which store content from
+// memory, without the temporary file addYAML otherwise writes.
+type dataAdder interface {
+	AddData(data []byte, dest string) error
+}
+
+// addYAML adds v encoded in YAML to the backup as the file dest.
+func addYAML(backupWriter entryWriter, v interface{}, dest string) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if adder, ok := backupWriter.(dataAdder); ok {
+		return adder.AddData(data, dest)
+	}
+	dataTemp, err := os.CreateTemp("/", "snapshotter-*.yml")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(dataTemp.Name())
 	_, err = dataTemp.Write(data)
 	if err != nil {
+		dataTemp.Close()
 		return err
 	}
 	err = dataTemp.Close()
 	if err != nil {
 		return err
 	}
-	return backupWriter.AddFile(dataTemp.Name(), VolumesDataPath(c))
+	return backupWriter.AddFile(dataTemp.Name(), dest)
 }
@@ -0,0 +1,266 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup_Filter(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	for _, file := range []string{"LOCK", "chaindata/000001.ldb", "chaindata/geth.log", "ancient/tmp/scratch", "ancient/data"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(volume, filepath.Dir(file)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(volume, file), []byte(file), 0o644))
+	}
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	c := &config.Config{
+		Prefix:  "full",
+		Volumes: []config.Volume{{Path: volume, Exclude: []string{"LOCK", "*.log", "ancient/tmp"}}},
+	}
+	require.NoError(t, Backup(c, tarPath, BackupOptions{}))
+	volumePath := filepath.Join("full", volumeId(volume))
+	names, err := backuptar.EntryNames(tarPath, volumePath)
+	require.NoError(t, err)
+	var relPaths []string
+	for _, name := range names {
+		relPath, err := filepath.Rel(volumePath, name)
+		require.NoError(t, err)
+		relPaths = append(relPaths, relPath)
+	}
+	assert.Equal(t, []string{".", "ancient", "ancient/data", "chaindata", "chaindata/000001.ldb"}, relPaths)
+
+	// Files excluded since the base backup are deleted from the incremental
+	// one
+	c = &config.Config{
+		Prefix:  "incremental",
+		Volumes: []config.Volume{{Path: volume, Exclude: []string{"LOCK", "*.log", "ancient/"}}},
+	}
+	require.NoError(t, Backup(c, tarPath, BackupOptions{Base: "full"}))
+	names, err = backuptar.EntryNames(tarPath, filepath.Join("incremental", volumeId(volume)))
+	require.NoError(t, err)
+	assert.Contains(t, names, filepath.Join("incremental", volumeId(volume), ".wh.ancient"))
+	assert.NotContains(t, names, filepath.Join("incremental", volumeId(volume), ".wh.LOCK"))
+
+	// Invalid patterns fail the backup before anything is written
+	before, err := backuptar.EntryNames(tarPath, "")
+	require.NoError(t, err)
+	c = &config.Config{Prefix: "invalid", Volumes: []config.Volume{{Path: filepath.Join(volume, "LOCK"), Exclude: []string{"*.log"}}}}
+	assert.ErrorContains(t, Backup(c, tarPath, BackupOptions{}), "is not a directory")
+	c.Volumes = []config.Volume{{Path: volume, Include: []string{"[a"}}}
+	assert.ErrorContains(t, Backup(c, tarPath, BackupOptions{}), "invalid pattern")
+	after, err := backuptar.EntryNames(tarPath, "")
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestBackup_Snapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(filepath.Join(volume, "chaindata"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "chaindata", "000001.ldb"), []byte("ldb"), 0o644))
+	// The snapshot of an interrupted backup is not backed up
+	require.NoError(t, os.MkdirAll(filepath.Join(volume, backuptar.SnapshotName), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, backuptar.SnapshotName, "stale"), []byte("stale"), 0o644))
+	file := filepath.Join(tmpDir, "file")
+	require.NoError(t, os.WriteFile(file, []byte("file"), 0o644))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	c := &config.Config{
+		Prefix:   "node",
+		Volumes:  []config.Volume{{Path: volume}, {Path: file}},
+		Snapshot: config.SnapshotAuto,
+	}
+	require.NoError(t, Backup(c, tarPath, BackupOptions{}))
+	volumesData, err := GetVolumesData(tarPath, VolumesDataPath(c))
+	require.NoError(t, err)
+	require.Len(t, volumesData, 2)
+	// The filesystem of the test may not support snapshots, the volumes are
+	// then backed up from their live files
+	assert.Contains(t, []string{backuptar.SnapshotBtrfs, backuptar.SnapshotReflink, SnapshotLive}, volumesData[0].Snapshot)
+	assert.Contains(t, []string{backuptar.SnapshotReflink, SnapshotLive}, volumesData[1].Snapshot)
+
+	volumePath := filepath.Join("node", volumeId(volume))
+	names, err := backuptar.EntryNames(tarPath, volumePath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		volumePath,
+		filepath.Join(volumePath, "chaindata"),
+		filepath.Join(volumePath, "chaindata", "000001.ldb"),
+	}, names)
+	data, err := backuptar.ReadFile(tarPath, filepath.Join("node", volumeId(file)))
+	require.NoError(t, err)
+	assert.Equal(t, "file", string(data))
+
+	// The snapshots are removed
+	_, err = os.Lstat(filepath.Join(volume, backuptar.SnapshotName))
+	assert.True(t, os.IsNotExist(err))
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestBackup_SnapshotDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(volume, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("data"), 0o644))
+	file := filepath.Join(tmpDir, "file")
+	require.NoError(t, os.WriteFile(file, []byte("file"), 0o644))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	// The snapshots are made in the staging directory, the volumes and
+	// their parent directory are left as they are
+	c := &config.Config{
+		Prefix:      "node",
+		Volumes:     []config.Volume{{Path: volume}, {Path: file}},
+		Snapshot:    config.SnapshotReflink,
+		SnapshotDir: filepath.Join(tmpDir, "snapshots"),
+	}
+	require.NoError(t, Backup(c, tarPath, BackupOptions{}))
+	volumesData, err := GetVolumesData(tarPath, VolumesDataPath(c))
+	require.NoError(t, err)
+	require.Len(t, volumesData, 2)
+	for _, v := range volumesData {
+		assert.Contains(t, []string{backuptar.SnapshotReflink, SnapshotLive}, v.Snapshot)
+	}
+	data, err := backuptar.ReadFile(tarPath, filepath.Join("node", volumeId(file)))
+	require.NoError(t, err)
+	assert.Equal(t, "file", string(data))
+
+	entries, err := os.ReadDir(c.SnapshotDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = os.ReadDir(volume)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+	// The backup, its index, the volumes and the staging directory
+	entries, err = os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 5)
+}
+
+func TestBackup_StaleSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(filepath.Join(volume, backuptar.SnapshotName), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, backuptar.SnapshotName, "stale"), []byte("stale"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("data"), 0o644))
+	file := filepath.Join(tmpDir, "file")
+	require.NoError(t, os.WriteFile(file, []byte("file"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, backuptar.SnapshotName+"-file"), []byte("stale"), 0o644))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	// The snapshots of a backup interrupted before snapshots were disabled
+	// are neither backed up nor left in the volumes
+	c := &config.Config{Prefix: "node", Volumes: []config.Volume{{Path: volume}, {Path: file}}}
+	require.NoError(t, Backup(c, tarPath, BackupOptions{}))
+	volumePath := filepath.Join("node", volumeId(volume))
+	names, err := backuptar.EntryNames(tarPath, volumePath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{volumePath, filepath.Join(volumePath, "data")}, names)
+	_, err = os.Lstat(filepath.Join(volume, backuptar.SnapshotName))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(tmpDir, backuptar.SnapshotName+"-file"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBackup_Failure(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume1 := filepath.Join(tmpDir, "volume1")
+	require.NoError(t, os.MkdirAll(volume1, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "data"), []byte("data"), 0o644))
+	volume2 := filepath.Join(tmpDir, "volume2")
+	require.NoError(t, os.MkdirAll(volume2, 0o755))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	c := &config.Config{
+		Prefix:  "node",
+		Volumes: []config.Volume{{Path: volume1}, {Path: volume2}},
+	}
+	require.NoError(t, Backup(c, tarPath, BackupOptions{}))
+	before, err := os.ReadFile(tarPath)
+	require.NoError(t, err)
+
+	// The backup fails once the first volume is written
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "data"), []byte("changed"), 0o644))
+	c.Volumes[1].Hooks = &config.Hooks{Pre: []config.Hook{{Command: []string{"false"}}}}
+	require.Error(t, Backup(c, tarPath, BackupOptions{}))
+	after, err := os.ReadFile(tarPath)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	to := t.TempDir()
+	require.NoError(t, Restore(c, tarPath, RestoreOptions{To: to}))
+	got, err := os.ReadFile(filepath.Join(to, volume1, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), got)
+
+	// The metadata of the backups appended to a file precedes the volumes,
+	// they can be restored from a stream
+	f, err := os.Open(tarPath)
+	require.NoError(t, err)
+	defer f.Close()
+	to = t.TempDir()
+	require.NoError(t, Restore(c, tarPath, RestoreOptions{Input: f, To: to}))
+	got, err = os.ReadFile(filepath.Join(to, volume1, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), got)
+}
+
+func TestBackup_ChunkStore(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(volume, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("first"), 0o644))
+	c := &config.Config{
+		Prefix:     "node",
+		Volumes:    []config.Volume{{Path: volume}},
+		ChunkStore: &config.ChunkStore{Path: filepath.Join(tmpDir, "repo")},
+	}
+
+	// Backing up the prefix again replaces its snapshot
+	require.NoError(t, Backup(c, backuptar.Path, BackupOptions{}))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("second"), 0o644))
+	require.NoError(t, Backup(c, backuptar.Path, BackupOptions{}))
+	assert.ErrorContains(t, Backup(c, backuptar.Path, BackupOptions{Append: true}), "can't be appended")
+
+	to := t.TempDir()
+	require.NoError(t, Restore(c, backuptar.Path, RestoreOptions{To: to}))
+	got, err := os.ReadFile(filepath.Join(to, volume, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), got)
+	require.NoError(t, Verify(c, backuptar.Path, VerifyOptions{}))
+
+	// Pruning removes the chunks of the replaced snapshot with the ones of
+	// the pruned backup
+	chunkPath := func(data string) string {
+		hash := sha256.Sum256([]byte(data))
+		id := hex.EncodeToString(hash[:])
+		return filepath.Join(c.ChunkStore.Path, "chunks", id[:2], id)
+	}
+	assert.FileExists(t, chunkPath("first"))
+	other := *c
+	other.Prefix = "other"
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("third"), 0o644))
+	require.NoError(t, Backup(&other, backuptar.Path, BackupOptions{}))
+	require.NoError(t, Prune(&other, backuptar.Path, "other"))
+	assert.ErrorContains(t, Prune(&other, backuptar.Path, "other"), "no backup found")
+	assert.NoFileExists(t, chunkPath("first"))
+	assert.NoFileExists(t, chunkPath("third"))
+	assert.FileExists(t, chunkPath("second"))
+	require.NoError(t, Verify(c, backuptar.Path, VerifyOptions{}))
+}
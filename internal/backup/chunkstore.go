@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/chunkstore"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// backupChunkStore backs up the volumes as the snapshot named after the
+// prefix in the chunk store repository of the configuration. The chunk store
+// deduplicates the content of all its snapshots, so there are no incremental
+// backups.
+func backupChunkStore(c *config.Config, opts BackupOptions) error {
+	if opts.Output != nil {
+		return errors.New("backups to the chunk store can't be streamed")
+	}
+	if opts.Base != "" {
+		return errors.New("backups to the chunk store can't be incremental, their content is already deduplicated")
+	}
+	if opts.Append {
+		return errors.New("backups to the chunk store replace the snapshot of their prefix, they can't be appended")
+	}
+	volumesData, err := newVolumesData(c, nil)
+	if err != nil {
+		return err
+	}
+	repo, err := chunkstore.Open(c.ChunkStore.Path)
+	if err != nil {
+		return err
+	}
+	writer, err := repo.NewSnapshotWriter(c.Prefix)
+	if err != nil {
+		return err
+	}
+	// The snapshot is only written if the whole backup succeeds
+	err = writeBackup(c, writer, volumesData, nil, false)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	stats := writer.Stats()
+	slog.Info("Backup stored in chunk store", "chunks", stats.Chunks, "bytes", stats.Bytes, "newChunks", stats.NewChunks, "newBytes", stats.NewBytes)
+	return nil
+}
+
+// restoreChunkStore restores the volumes from the snapshot named after the
+// prefix in the chunk store repository of the configuration.
+func restoreChunkStore(c *config.Config, opts RestoreOptions) error {
+	if opts.Input != nil {
+		return errors.New("backups of the chunk store can't be restored from a stream")
+	}
+	repo, err := chunkstore.Open(c.ChunkStore.Path)
+	if err != nil {
+		return err
+	}
+	volumesData, err := readVolumesData(&snapshotSource{repo: repo, snapshot: c.Prefix}, VolumesDataPath(c))
+	if err != nil {
+		return err
+	}
+	volumesData, err = opts.selectVolumes(volumesData)
+	if err != nil || len(volumesData) == 0 {
+		return err
+	}
+	prefixes := make([]string, len(volumesData))
+	for i := range volumesData {
+		prefixes[i] = c.Prefix
+	}
+	extractOpts := opts.extractOptions()
+	r, err := prepareTargets(volumesData, prefixes, opts, extractOpts)
+	if err != nil {
+		return err
+	}
+	return r.finish(repo.ExtractAll(c.Prefix, r.targets, extractOpts...))
+}
+
+// pruneChunkStore removes the snapshot of prefix from the chunk store
+// repository of the configuration, and the chunks no remaining snapshot
+// references, including the ones of the snapshots replaced by later backups.
+func pruneChunkStore(c *config.Config, prefix string) error {
+	repo, err := chunkstore.Open(c.ChunkStore.Path)
+	if err != nil {
+		return err
+	}
+	if err := repo.RemoveSnapshot(prefix); err != nil {
+		if errors.Is(err, backuptar.ErrFileNotFound) {
+			return fmt.Errorf("no backup found for prefix %q", prefix)
+		}
+		return err
+	}
+	stats, err := repo.CollectGarbage()
+	if err != nil {
+		return fmt.Errorf("failed to remove the unused chunks: %w", err)
+	}
+	slog.Info("Backup pruned", "prefix", prefix, "removedChunks", stats.Chunks, "removedBytes", stats.Bytes)
+	return nil
+}
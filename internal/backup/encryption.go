@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// Environment variables holding the encryption key material, used in addition
+// to the files of the encryption configuration.
+const (
+	// AgeRecipientsEnv holds age public keys, separated by commas or new lines.
+	AgeRecipientsEnv = "SNAPSHOTTER_AGE_RECIPIENTS"
+	// AgeIdentityEnv holds the content of an age identity file.
+	AgeIdentityEnv = "SNAPSHOTTER_AGE_IDENTITY"
+	// PassphraseEnv holds the passphrase of the backup.
+	PassphraseEnv = "SNAPSHOTTER_PASSPHRASE"
+)
+
+// encryptionRecipients returns the recipients the backup is encrypted to,
+// from the configuration and the environment. No recipients means that the
+// backup is not encrypted.
+func encryptionRecipients(c *config.Config) ([]age.Recipient, error) {
+	e := c.Encryption
+	if e == nil {
+		e = &config.Encryption{}
+	}
+	keys := append([]string{}, e.Recipients...)
+	if e.RecipientsFile != "" {
+		data, err := os.ReadFile(e.RecipientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recipients file: %w", err)
+		}
+		keys = append(keys, keyLines(string(data))...)
+	}
+	keys = append(keys, keyLines(strings.ReplaceAll(os.Getenv(AgeRecipientsEnv), ",", "\n"))...)
+
+	var recipients []age.Recipient
+	for _, key := range keys {
+		r, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %w", key, err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	passphrase, err := encryptionPassphrase(e)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		// age refuses to mix passphrases with other recipients
+		if len(recipients) > 0 {
+			return nil, errors.New("a backup can't be encrypted with both a passphrase and age recipients")
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// encryptionIdentities returns the identities used to decrypt the backup,
+// from the configuration and the environment.
+func encryptionIdentities(c *config.Config) ([]age.Identity, error) {
+	e := c.Encryption
+	if e == nil {
+		e = &config.Encryption{}
+	}
+	var identities []age.Identity
+	if e.IdentityFile != "" {
+		data, err := os.ReadFile(e.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity file: %w", err)
+		}
+		ids, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %w", e.IdentityFile, err)
+		}
+		identities = append(identities, ids...)
+	}
+	if env := os.Getenv(AgeIdentityEnv); env != "" {
+		ids, err := age.ParseIdentities(strings.NewReader(env))
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity in %s: %w", AgeIdentityEnv, err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	passphrase, err := encryptionPassphrase(e)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	return identities, nil
+}
+
+// encryptionPassphrase returns the passphrase of the backup, from the
+// environment or else from the passphrase file.
+func encryptionPassphrase(e *config.Encryption) (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	if e.PassphraseFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(e.PassphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// keyLines returns the keys in data, one per line, skipping empty lines and
+// comments.
+func keyLines(data string) []string {
+	var keys []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// Environment variables describing the backup or the restore to the hooks, in
+// addition to the environment of the snapshotter.
+const (
+	// HookOperationEnv is backup or restore.
+	HookOperationEnv = "SNAPSHOTTER_OPERATION"
+	// HookPhaseEnv is pre or post.
+	HookPhaseEnv = "SNAPSHOTTER_PHASE"
+	// HookStatusEnv is success or failure, for the post hooks.
+	HookStatusEnv = "SNAPSHOTTER_STATUS"
+	// HookPrefixEnv is the prefix of the backup.
+	HookPrefixEnv = "SNAPSHOTTER_PREFIX"
+	// HookVolumeIdEnv and HookVolumeTargetEnv describe the volume of the
+	// hooks of a volume. The target is the path the volume is restored to.
+	HookVolumeIdEnv     = "SNAPSHOTTER_VOLUME_ID"
+	HookVolumeTargetEnv = "SNAPSHOTTER_VOLUME_TARGET"
+)
+
+// hookWaitDelay bounds the wait for the output of a killed hook, which its
+// child processes may keep open.
+const hookWaitDelay = 5 * time.Second
+
+// hookScope describes what a set of hooks runs around: the backup or the
+// restore of the prefix, or of one of its volumes.
+type hookScope struct {
+	operation string
+	prefix    string
+	// volumeId and target are set for the hooks of a volume
+	volumeId string
+	target   string
+}
+
+// withHooks runs fn between the pre and the post hooks of scope. fn is not
+// run if an aborting pre hook fails, and the post hooks only run after a
+// success, except the ones set to always run.
+func withHooks(scope hookScope, pre, post []config.Hook, fn func() error) error {
+	err := runHooks(scope, "pre", pre, nil)
+	if err == nil {
+		err = fn()
+	}
+	if postErr := runHooks(scope, "post", post, err); postErr != nil {
+		return errors.Join(err, postErr)
+	}
+	return err
+}
+
+// runHooks runs the hooks of the phase in order, and returns the error of the
+// first aborting one that fails. The post hooks are given the error of the
+// operation. After a failure of the operation or of an aborting hook, only the
+// hooks set to always run are run.
+func runHooks(scope hookScope, phase string, hooks []config.Hook, opErr error) error {
+	var hookErr error
+	for _, hook := range hooks {
+		if (opErr != nil || hookErr != nil) && !hook.Always {
+			continue
+		}
+		err := runHook(scope, phase, hook, opErr)
+		if err == nil {
+			continue
+		}
+		if hook.OnFailure == config.HookContinue {
+			slog.Warn("Hook failed, continuing", "operation", scope.operation, "phase", phase, "command", hook.Command, "error", err)
+			continue
+		}
+		if hookErr == nil {
+			hookErr = fmt.Errorf("%s %s hook %q failed: %w", phase, scope.operation, strings.Join(hook.Command, " "), err)
+		}
+	}
+	return hookErr
+}
+
+// runHook runs the hook with the environment of the scope, logging its output.
+func runHook(scope hookScope, phase string, hook config.Hook, opErr error) error {
+	ctx := context.Background()
+	if hook.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(hook.Timeout))
+		defer cancel()
+	}
+	attrs := []any{"operation", scope.operation, "phase", phase, "command", hook.Command}
+	if scope.target != "" {
+		attrs = append(attrs, "volume", scope.target)
+	}
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		HookOperationEnv+"="+scope.operation,
+		HookPhaseEnv+"="+phase,
+		HookPrefixEnv+"="+scope.prefix,
+	)
+	if phase == "post" {
+		status := "success"
+		if opErr != nil {
+			status = "failure"
+		}
+		cmd.Env = append(cmd.Env, HookStatusEnv+"="+status)
+	}
+	if scope.volumeId != "" {
+		cmd.Env = append(cmd.Env, HookVolumeIdEnv+"="+scope.volumeId, HookVolumeTargetEnv+"="+scope.target)
+	}
+	// The loggers get attributes of their own
+	attrs = attrs[:len(attrs):len(attrs)]
+	stdout := &hookLogger{attrs: append(attrs, "stream", "stdout")}
+	stderr := &hookLogger{attrs: append(attrs, "stream", "stderr")}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = hookWaitDelay
+
+	slog.Info("Running hook", attrs...)
+	err := cmd.Run()
+	stdout.flush()
+	stderr.flush()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", time.Duration(hook.Timeout))
+	}
+	return err
+}
+
+// backupHooks returns the pre and post backup hooks of h, which may be nil.
+func backupHooks(h *config.Hooks) ([]config.Hook, []config.Hook) {
+	if h == nil {
+		return nil, nil
+	}
+	return h.Pre, h.Post
+}
+
+// restoreHooks returns the pre and post restore hooks of h, which may be nil.
+func restoreHooks(h *config.Hooks) ([]config.Hook, []config.Hook) {
+	if h == nil {
+		return nil, nil
+	}
+	return h.PreRestore, h.PostRestore
+}
+
+// hookLogger logs the lines of the output of a hook.
+type hookLogger struct {
+	attrs []any
+	// line holds the start of the line being written
+	line []byte
+}
+
+func (l *hookLogger) Write(p []byte) (int, error) {
+	l.line = append(l.line, p...)
+	for {
+		i := bytes.IndexByte(l.line, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		l.log(l.line[:i])
+		l.line = l.line[i+1:]
+	}
+}
+
+// flush logs the last line of the output, if it does not end with a new line.
+func (l *hookLogger) flush() {
+	if len(l.line) > 0 {
+		l.log(l.line)
+		l.line = nil
+	}
+}
+
+func (l *hookLogger) log(line []byte) {
+	slog.Info("Hook output", append(l.attrs, "line", string(bytes.TrimSuffix(line, []byte("\r"))))...)
+}
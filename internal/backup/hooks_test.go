@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logHook returns a hook appending the words of the line, expanded by the
+// shell, to the file at logPath.
+func logHook(logPath, line string) config.Hook {
+	return config.Hook{Command: []string{"sh", "-c", "echo " + line + " >> " + logPath}}
+}
+
+func readHookLog(t *testing.T, logPath string) []string {
+	data, err := os.ReadFile(logPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestBackup_Hooks(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(volume, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("data"), 0o644))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+	logPath := filepath.Join(tmpDir, "hooks.log")
+
+	line := "$SNAPSHOTTER_OPERATION $SNAPSHOTTER_PHASE $SNAPSHOTTER_STATUS $SNAPSHOTTER_PREFIX $SNAPSHOTTER_VOLUME_ID $SNAPSHOTTER_VOLUME_TARGET"
+	hooks := &config.Hooks{
+		Pre:         []config.Hook{logHook(logPath, line)},
+		Post:        []config.Hook{logHook(logPath, line)},
+		PreRestore:  []config.Hook{logHook(logPath, line)},
+		PostRestore: []config.Hook{logHook(logPath, line)},
+	}
+	c := &config.Config{
+		Prefix:  "node",
+		Hooks:   hooks,
+		Volumes: []config.Volume{{Path: volume, Hooks: hooks}},
+	}
+	id := volumeId(volume)
+	require.NoError(t, Backup(c, tarPath, BackupOptions{}))
+	assert.Equal(t, []string{
+		"backup pre node",
+		"backup pre node " + id + " " + volume,
+		"backup post success node " + id + " " + volume,
+		"backup post success node",
+	}, readHookLog(t, logPath))
+
+	// The volume hooks are given the target the volume is restored to
+	require.NoError(t, os.Remove(logPath))
+	to := filepath.Join(tmpDir, "to")
+	require.NoError(t, Restore(c, tarPath, RestoreOptions{To: to}))
+	target := filepath.Join(to, volume)
+	assert.Equal(t, []string{
+		"restore pre node",
+		"restore pre node " + id + " " + target,
+		"restore post success node " + id + " " + target,
+		"restore post success node",
+	}, readHookLog(t, logPath))
+	data, err := os.ReadFile(filepath.Join(target, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// No hooks run in a dry run, nor for the volumes not restored
+	require.NoError(t, os.Remove(logPath))
+	_, err = PlanRestore(c, tarPath, RestoreOptions{To: to})
+	require.NoError(t, err)
+	assert.Nil(t, readHookLog(t, logPath))
+	other := filepath.Join(tmpDir, "other")
+	c.Volumes = append(c.Volumes, config.Volume{Path: other, Hooks: hooks})
+	require.NoError(t, Restore(c, tarPath, RestoreOptions{To: to, Volumes: []string{id}}))
+	assert.Len(t, readHookLog(t, logPath), 4)
+
+	// A failed pre hook aborts the backup before anything is written
+	before, err := backuptar.EntryNames(tarPath, "")
+	require.NoError(t, err)
+	c.Hooks = &config.Hooks{Pre: []config.Hook{{Command: []string{"false"}}}}
+	assert.ErrorContains(t, Backup(c, tarPath, BackupOptions{}), "pre backup hook \"false\" failed")
+	after, err := backuptar.EntryNames(tarPath, "")
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestWithHooks(t *testing.T) {
+	failing := config.Hook{Command: []string{"false"}}
+	errFn := errors.New("operation failed")
+	tc := []struct {
+		name   string
+		pre    []config.Hook
+		post   []config.Hook
+		fnErr  error
+		ran    bool
+		want   []string
+		errMsg string
+	}{
+		{
+			name: "success",
+			pre:  []config.Hook{{Command: []string{"pre"}}},
+			post: []config.Hook{{Command: []string{"post"}}},
+			ran:  true,
+			want: []string{"pre success", "post success"},
+		},
+		{
+			name:   "pre abort",
+			pre:    []config.Hook{failing, {Command: []string{"pre"}}},
+			post:   []config.Hook{{Command: []string{"post"}}, {Command: []string{"always"}, Always: true}},
+			want:   []string{"always failure"},
+			errMsg: "pre backup hook",
+		},
+		{
+			name: "pre continue",
+			pre:  []config.Hook{{Command: []string{"false"}, OnFailure: config.HookContinue}, {Command: []string{"pre"}}},
+			ran:  true,
+			want: []string{"pre success"},
+		},
+		{
+			name:   "operation failure",
+			post:   []config.Hook{{Command: []string{"post"}}, {Command: []string{"always"}, Always: true}},
+			fnErr:  errFn,
+			ran:    true,
+			want:   []string{"always failure"},
+			errMsg: "operation failed",
+		},
+		{
+			name:   "post failure",
+			post:   []config.Hook{failing, {Command: []string{"post"}}, {Command: []string{"always"}, Always: true}},
+			ran:    true,
+			want:   []string{"always success"},
+			errMsg: "post backup hook",
+		},
+		{
+			name:   "timeout",
+			pre:    []config.Hook{{Command: []string{"sleep", "10"}, Timeout: config.Duration(100 * time.Millisecond)}},
+			errMsg: "timed out after 100ms",
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "hooks.log")
+			// The hooks other than false and sleep log their name and the status
+			hooks := func(hooks []config.Hook) []config.Hook {
+				var logged []config.Hook
+				for _, h := range hooks {
+					if h.Command[0] != "false" && h.Command[0] != "sleep" {
+						h.Command = logHook(logPath, h.Command[0]+" ${SNAPSHOTTER_STATUS:-success}").Command
+					}
+					logged = append(logged, h)
+				}
+				return logged
+			}
+			ran := false
+			err := withHooks(hookScope{operation: "backup", prefix: "node"}, hooks(tt.pre), hooks(tt.post), func() error {
+				ran = true
+				return tt.fnErr
+			})
+			assert.Equal(t, tt.ran, ran)
+			assert.Equal(t, tt.want, readHookLog(t, logPath))
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package backup
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+)
+
+// incrementalBase is the previous backup an incremental backup is based on.
+type incrementalBase struct {
+	prefix string
+	// volumes are the volumes of the base backup, by id
+	volumes map[string]VolumeData
+	// files are the manifest entries of the base backup, by path relative
+	// to its prefix
+	files map[string]ManifestEntry
+	// paths are the paths relative to the prefix of every file and
+	// directory of the base backup, including the files stored in its own
+	// base
+	paths map[string]bool
+}
+
+// loadIncrementalBase reads the backup of the given prefix in the archive at
+// tarPath, for an incremental backup based on it.
+func loadIncrementalBase(tarPath, prefix string, opts ...backuptar.ExtractOption) (*incrementalBase, error) {
+	volumesData, err := GetVolumesData(tarPath, filepath.Join(prefix, VolumesDataFileName), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if volumesData == nil {
+		return nil, fmt.Errorf("no backup found for base prefix %q", prefix)
+	}
+	manifest, err := GetManifest(tarPath, filepath.Join(prefix, ManifestFileName), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("backup of base prefix %q has no manifest", prefix)
+	}
+	names, err := backuptar.EntryNames(tarPath, prefix)
+	if err != nil {
+		return nil, err
+	}
+	whiteoutNames, err := backuptar.Whiteouts(tarPath, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &incrementalBase{
+		prefix:  prefix,
+		volumes: make(map[string]VolumeData, len(volumesData)),
+		files:   make(map[string]ManifestEntry, len(manifest)),
+		paths:   make(map[string]bool, len(names)),
+	}
+	for _, v := range volumesData {
+		base.volumes[v.Id] = v
+	}
+	for _, entry := range manifest {
+		relPath := strings.TrimPrefix(entry.Path, prefix+"/")
+		base.files[relPath] = entry
+		base.paths[relPath] = true
+	}
+	whiteouts := make(map[string]bool, len(whiteoutNames))
+	for _, name := range whiteoutNames {
+		whiteouts[name] = true
+	}
+	for _, name := range names {
+		if !whiteouts[name] {
+			base.paths[strings.TrimPrefix(name, prefix+"/")] = true
+		}
+	}
+	return base, nil
+}
+
+// volume returns the base backup of the volume v, if the base backup has it
+// with the same type.
+func (b *incrementalBase) volume(v VolumeData) (VolumeData, bool) {
+	baseVolume, ok := b.volumes[v.Id]
+	return baseVolume, ok && baseVolume.Type == v.Type
+}
+
+// unchanged returns the manifest entry of the file at relPath in the volume
+// of the given id if it has the same size and modification time as fi in the
+// base backup.
+func (b *incrementalBase) unchanged(id, relPath string, fi os.FileInfo) (ManifestEntry, bool) {
+	entry, ok := b.files[path.Join(id, filepath.ToSlash(relPath))]
+	if !ok || entry.Size != fi.Size() || !entry.ModTime.Equal(fi.ModTime()) {
+		return ManifestEntry{}, false
+	}
+	return entry, true
+}
+
+// carriedOver returns the manifest entry of a file unchanged since the base
+// backup, stored at the tar path dest in the new backup.
+func carriedOver(entry ManifestEntry, dest string) ManifestEntry {
+	if entry.Stored == "" {
+		entry.Stored = entry.Path
+	}
+	entry.Path = dest
+	return entry
+}
+
+// deleted returns the paths relative to src of the files and directories of
+// the volume of the given id in the base backup which are no longer in src,
+// or are not selected by filter, which may be nil. Only the topmost deleted
+// directory is returned, not its content.
+func (b *incrementalBase) deleted(id, src string, filter *backuptar.Filter) ([]string, error) {
+	var opts []backuptar.AddOption
+	if filter != nil {
+		opts = append(opts, backuptar.WithFilter(filter))
+	}
+	present := make(map[string]bool)
+	// The files are walked like the backup stores them
+	err := backuptar.FileHeaders(src, "", func(header *tar.Header, file string, fi os.FileInfo) error {
+		present[filepath.ToSlash(header.Name)] = true
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for p := range b.paths {
+		relPath, ok := strings.CutPrefix(p, id+"/")
+		if !ok || present[relPath] {
+			continue
+		}
+		if parent := path.Dir(relPath); parent == "." || present[parent] {
+			deleted = append(deleted, relPath)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted, nil
+}
+
+// volumeChains returns, for each volume of a backup, the prefixes of the
+// backups to restore it from: the full backup first, followed by the
+// incremental backups based on it up to prefix. Volumes data of the base
+// backups is read from the archive at tarPath.
+func volumeChains(tarPath, prefix string, volumesData []VolumeData, opts ...backuptar.ExtractOption) ([][]string, error) {
+	// Volumes data of the base backups, by prefix
+	bases := make(map[string]map[string]VolumeData)
+	chains := make([][]string, 0, len(volumesData))
+	for _, v := range volumesData {
+		chain := []string{prefix}
+		seen := map[string]bool{prefix: true}
+		for v.Base != "" {
+			if seen[v.Base] {
+				return nil, fmt.Errorf("volume %s has a cycle of base backups at prefix %q", v.Id, v.Base)
+			}
+			seen[v.Base] = true
+			volumes, ok := bases[v.Base]
+			if !ok {
+				data, err := GetVolumesData(tarPath, filepath.Join(v.Base, VolumesDataFileName), opts...)
+				if err != nil {
+					return nil, err
+				}
+				volumes = make(map[string]VolumeData, len(data))
+				for _, baseVolume := range data {
+					volumes[baseVolume.Id] = baseVolume
+				}
+				bases[v.Base] = volumes
+			}
+			baseVolume, ok := volumes[v.Id]
+			if !ok {
+				return nil, fmt.Errorf("volume %s not found in base backup %q", v.Id, v.Base)
+			}
+			if v.Type == "file" {
+				// Unchanged files are only stored in the base backup
+				chain = chain[:0]
+			}
+			chain = append(chain, v.Base)
+			v = baseVolume
+		}
+		// Full backup first
+		for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+			chain[i], chain[j] = chain[j], chain[i]
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
@@ -0,0 +1,236 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// BackupInfo describes the backup of a prefix of an archive, as returned by
+// List.
+type BackupInfo struct {
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// Time is the time the backup was made.
+	Time time.Time `json:"time" yaml:"time"`
+	// Manifest is set if the backup has a manifest, the file counts and
+	// sizes of the volumes of the legacy backups are only known with it.
+	Manifest bool         `json:"manifest" yaml:"manifest"`
+	Volumes  []VolumeInfo `json:"volumes" yaml:"volumes"`
+}
+
+// VolumeInfo describes a volume of a backup.
+type VolumeInfo struct {
+	Id     string `json:"id" yaml:"id"`
+	Type   string `json:"type" yaml:"type"`
+	Target string `json:"target" yaml:"target"`
+	// Base is the prefix of the backup an incremental backup of the volume
+	// is based on.
+	Base string `json:"base,omitempty" yaml:"base,omitempty"`
+	// Files is the number of regular files of the volume, including the
+	// ones stored by its base backup.
+	Files int `json:"files" yaml:"files"`
+	// Size is the total size of the regular files of the volume.
+	Size int64 `json:"size" yaml:"size"`
+}
+
+// ListOptions configures the listing of the backups of an archive.
+type ListOptions struct {
+	// Prefix only lists the backups whose prefix matches this path.Match
+	// pattern, every backup is listed if it is empty.
+	Prefix string
+}
+
+// List returns the backups of the archive at tarPath, sorted by prefix. The
+// encrypted backups are read with the identities of the configuration c,
+// which may be nil. The backups are listed from the storage of c if it has
+// one.
+func List(c *config.Config, tarPath string, opts ListOptions) ([]BackupInfo, error) {
+	extractOpts, err := identityOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	pattern := opts.Prefix
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid prefix pattern %q: %w", pattern, err)
+		}
+	}
+	match := func(prefix string) bool {
+		if pattern == "" {
+			return true
+		}
+		ok, _ := path.Match(pattern, prefix)
+		return ok
+	}
+	if c != nil && c.Storage != nil {
+		return listStorage(c, match, extractOpts)
+	}
+	return listArchive(tarPath, match, extractOpts)
+}
+
+// listArchive returns the backups of the archive at tarPath whose prefix is
+// selected by match, sorted by prefix.
+func listArchive(tarPath string, match func(prefix string) bool, extractOpts []backuptar.ExtractOption) ([]BackupInfo, error) {
+	src := tarSource(tarPath, extractOpts)
+	backups, unsupported, err := archiveBackups(tarPath, src)
+	if err != nil {
+		return nil, err
+	}
+	infos := []BackupInfo{}
+	for _, prefix := range sortedPrefixes(backups) {
+		if slices.Contains(unsupported, prefix) || !match(prefix) {
+			continue
+		}
+		metadata, err := readMetadata(src, path.Join(prefix, VolumesDataFileName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read volumes data of prefix %q: %w", prefix, err)
+		}
+		if metadata.CreatedAt.IsZero() {
+			// The legacy format has no creation time, the volumes data
+			// file was written when the backup was made
+			header, err := backuptar.Stat(tarPath, path.Join(prefix, VolumesDataFileName))
+			if err != nil {
+				return nil, err
+			}
+			metadata.CreatedAt = header.ModTime
+		}
+		manifest, err := readManifest(src, path.Join(prefix, ManifestFileName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest of prefix %q: %w", prefix, err)
+		}
+		infos = append(infos, newBackupInfo(prefix, metadata, manifest))
+	}
+	return infos, nil
+}
+
+// identityOptions returns the options decrypting the backups with the
+// identities of the configuration c, which may be nil.
+func identityOptions(c *config.Config) ([]backuptar.ExtractOption, error) {
+	if c == nil {
+		return nil, nil
+	}
+	identities, err := encryptionIdentities(c)
+	if err != nil {
+		return nil, err
+	}
+	return []backuptar.ExtractOption{backuptar.WithIdentities(identities...)}, nil
+}
+
+// archiveBackups returns the volumes data of the backups of the archive at
+// tarPath by prefix, read from src. The backups whose metadata has a version
+// this snapshotter does not know have no volumes data, their prefixes are
+// returned in unsupported with a warning: they are only refused when restored
+// or verified.
+func archiveBackups(tarPath string, src backupSource) (backups map[string][]VolumeData, unsupported []string, err error) {
+	prefixes, err := archivePrefixes(tarPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Directories of the volumes of the prefixes already read, their files
+	// named like volumes data are not backups
+	var volumeDirs []string
+	backups = make(map[string][]VolumeData)
+	for _, prefix := range prefixes {
+		if isVolumeFileOf(volumeDirs, prefix) {
+			continue
+		}
+		volumesData, err := readVolumesData(src, path.Join(prefix, VolumesDataFileName))
+		if errors.Is(err, ErrUnsupportedMetadata) {
+			slog.Warn("Skipping backup with unsupported metadata", "prefix", prefix, "error", err)
+			backups[prefix] = nil
+			unsupported = append(unsupported, prefix)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read volumes data of prefix %q: %w", prefix, err)
+		}
+		for _, v := range volumesData {
+			volumeDirs = append(volumeDirs, path.Join(prefix, v.Id))
+		}
+		backups[prefix] = volumesData
+	}
+	sort.Strings(unsupported)
+	return backups, unsupported, nil
+}
+
+// sortedPrefixes returns the prefixes of backups in order.
+func sortedPrefixes(backups map[string][]VolumeData) []string {
+	prefixes := make([]string, 0, len(backups))
+	for prefix := range backups {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// archivePrefixes returns the candidate prefixes of the archive at tarPath,
+// the directories of the files named like volumes data, shortest first.
+func archivePrefixes(tarPath string) ([]string, error) {
+	names, err := backuptar.EntryNames(tarPath, "")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, name := range names {
+		if path.Base(name) != VolumesDataFileName {
+			continue
+		}
+		prefix := path.Dir(name)
+		if prefix == "." || seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		prefixes = append(prefixes, prefix)
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) < len(prefixes[j])
+	})
+	return prefixes, nil
+}
+
+// isVolumeFileOf reports whether name is under one of the volume directories.
+func isVolumeFileOf(volumeDirs []string, name string) bool {
+	for _, dir := range volumeDirs {
+		if isVolumeFile(dir, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newBackupInfo describes the backup of prefix with its metadata. The files of
+// the volumes without stats, in the legacy format, are counted from the
+// manifest.
+func newBackupInfo(prefix string, metadata *Metadata, manifest []ManifestEntry) BackupInfo {
+	info := BackupInfo{
+		Prefix:   prefix,
+		Time:     metadata.CreatedAt,
+		Manifest: manifest != nil,
+		Volumes:  make([]VolumeInfo, 0, len(metadata.Volumes)),
+	}
+	for _, v := range metadata.Volumes {
+		volume := VolumeInfo{Id: v.Id, Type: v.Type, Target: v.Target, Base: v.Base}
+		if v.Stats != nil {
+			volume.Files, volume.Size = v.Stats.Files, v.Stats.Size
+			info.Volumes = append(info.Volumes, volume)
+			continue
+		}
+		volumePath := path.Join(prefix, v.Id)
+		for _, entry := range manifest {
+			if isVolumeFile(volumePath, entry.Path) {
+				volume.Files++
+				volume.Size += entry.Size
+			}
+		}
+		info.Volumes = append(info.Volumes, volume)
+	}
+	return info
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume1 := filepath.Join(tmpDir, "volume1")
+	require.NoError(t, os.MkdirAll(filepath.Join(volume1, "dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "dir", "data"), []byte("data"), 0o644))
+	// A file of a volume named like volumes data is not a backup
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, VolumesDataFileName), []byte("[]"), 0o644))
+	volume2 := filepath.Join(tmpDir, "volume2.txt")
+	require.NoError(t, os.WriteFile(volume2, []byte("file"), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+	for _, c := range []*config.Config{
+		{Prefix: "node-2", Volumes: []config.Volume{{Path: volume2}}},
+		{Prefix: "node-1", Volumes: []config.Volume{{Path: volume1}, {Path: volume2}}},
+	} {
+		volumesData, err := newVolumesData(c, nil)
+		require.NoError(t, err)
+		backupWriter, err := backuptar.NewBackupWriter(tarPath)
+		require.NoError(t, err)
+		require.NoError(t, writeBackup(c, backupWriter, volumesData, nil, false))
+		require.NoError(t, backupWriter.Close())
+	}
+
+	backups, err := List(nil, tarPath, ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	assert.Equal(t, "node-1", backups[0].Prefix)
+	assert.True(t, backups[0].Manifest)
+	assert.False(t, backups[0].Time.IsZero())
+	assert.Equal(t, []VolumeInfo{
+		{Id: volumeId(volume1), Type: "dir", Target: volume1, Files: 2, Size: 6},
+		{Id: volumeId(volume2), Type: "file", Target: volume2, Files: 1, Size: 4},
+	}, backups[0].Volumes)
+	assert.Equal(t, "node-2", backups[1].Prefix)
+
+	backups, err = List(nil, tarPath, ListOptions{Prefix: "node-2"})
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "node-2", backups[0].Prefix)
+
+	_, err = List(nil, tarPath, ListOptions{Prefix: "["})
+	assert.ErrorContains(t, err, "invalid prefix pattern")
+}
+
+func TestList_Metadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(volume, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("data"), 0o644))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	// The metadata differs from the manifest and from the time the files
+	// were written
+	createdAt := time.Date(2024, 5, 14, 9, 30, 0, 0, time.UTC)
+	volumeData := VolumeData{Id: volumeId(volume), Type: "dir", Target: volume}
+	withStats := volumeData
+	withStats.Stats = &VolumeStats{Files: 7, Size: 1024}
+	for prefix, volumesData := range map[string]interface{}{
+		"current": &Metadata{APIVersion: MetadataVersion, CreatedAt: createdAt, Prefix: "current", Volumes: []VolumeData{withStats}},
+		"legacy":  []VolumeData{volumeData},
+	} {
+		c := &config.Config{Prefix: prefix, Volumes: []config.Volume{{Path: volume}}}
+		backupWriter, err := backuptar.NewBackupWriter(tarPath)
+		require.NoError(t, err)
+		require.NoError(t, addYAML(backupWriter, volumesData, VolumesDataPath(c)))
+		require.NoError(t, backupWriter.AddDir(volume, filepath.Join(prefix, volumeId(volume))))
+		manifest := manifestEntries(backupWriter.Checksums()[1:])
+		require.NoError(t, addYAML(backupWriter, manifest, ManifestPath(c)))
+		require.NoError(t, backupWriter.Close())
+	}
+
+	backups, err := List(nil, tarPath, ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	assert.Equal(t, "current", backups[0].Prefix)
+	assert.True(t, backups[0].Time.Equal(createdAt))
+	assert.Equal(t, []VolumeInfo{{Id: volumeId(volume), Type: "dir", Target: volume, Files: 7, Size: 1024}}, backups[0].Volumes)
+	// The legacy backups are described by their files
+	assert.Equal(t, "legacy", backups[1].Prefix)
+	assert.WithinDuration(t, time.Now(), backups[1].Time, time.Minute)
+	assert.Equal(t, []VolumeInfo{{Id: volumeId(volume), Type: "dir", Target: volume, Files: 1, Size: 4}}, backups[1].Volumes)
+}
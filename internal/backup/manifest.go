@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ManifestFileName = "manifest.yml"
+)
+
+// ManifestEntry is the size, the modification time and the SHA-256 checksum
+// of a file of the backup.
+type ManifestEntry struct {
+	// Path is the path of the file in the tar archive.
+	Path    string    `yaml:"path"`
+	Size    int64     `yaml:"size"`
+	ModTime time.Time `yaml:"mtime,omitempty"`
+	SHA256  string    `yaml:"sha256"`
+	// Stored is the path the content of the file is stored at in the tar
+	// archive when it differs from Path: incremental backups don't store
+	// the files unchanged since their base backup.
+	Stored string `yaml:"stored,omitempty"`
+}
+
+// ManifestPath returns the path of the manifest file in the tar archive.
+func ManifestPath(c *config.Config) string {
+	return filepath.Join(c.Prefix, ManifestFileName)
+}
+
+func manifestEntries(checksums []backuptar.FileChecksum) []ManifestEntry {
+	manifest := make([]ManifestEntry, 0, len(checksums))
+	for _, c := range checksums {
+		manifest = append(manifest, ManifestEntry{
+			Path:    c.Name,
+			Size:    c.Size,
+			ModTime: c.ModTime,
+			SHA256:  c.SHA256,
+		})
+	}
+	return manifest
+}
+
+// GetManifest returns the manifest from manifestPath in the tar archive at
+// tarPath. Backups made before manifests were introduced have none, nil is
+// returned for them.
+func GetManifest(tarPath string, manifestPath string, opts ...backuptar.ExtractOption) ([]ManifestEntry, error) {
+	return readManifest(tarSource(tarPath, opts), manifestPath)
+}
+
+// readManifest returns the manifest from manifestPath in src, or nil if there
+// is none.
+func readManifest(src backupSource, manifestPath string) ([]ManifestEntry, error) {
+	data, err := src.ReadFile(manifestPath)
+	if err != nil {
+		if errors.Is(err, backuptar.ErrFileNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var manifest []ManifestEntry
+	err = yaml.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
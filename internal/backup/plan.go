@@ -0,0 +1,293 @@
+package backup
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// Actions of the volumes of a plan.
+const (
+	// ActionAdd stores the whole volume in the backup.
+	ActionAdd = "add"
+	// ActionIncremental stores the changes of the volume since the base
+	// backup.
+	ActionIncremental = "incremental"
+	// ActionUnchanged stores nothing, the file volume is unchanged since the
+	// base backup.
+	ActionUnchanged = "unchanged"
+	// ActionReplace replaces the content of the volume target with the
+	// backup.
+	ActionReplace = "replace"
+	// ActionUpdate restores the selected paths of the volume in place,
+	// leaving the other files of the target as they are.
+	ActionUpdate = "update"
+)
+
+// VolumePlan describes what a backup or a restore does with a volume.
+type VolumePlan struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	// Target is the path the volume is backed up from, or restored to.
+	Target string `json:"target"`
+	// Base is the prefix of the backup the volume is based on.
+	Base   string `json:"base,omitempty"`
+	Action string `json:"action"`
+	// Files counts the regular and special files.
+	Files int `json:"files"`
+	Dirs  int `json:"dirs"`
+	// Links counts the symbolic and hard links.
+	Links     int   `json:"links"`
+	Whiteouts int   `json:"whiteouts,omitempty"`
+	Bytes     int64 `json:"bytes"`
+	// Missing is set if the backup has no entry for the volume.
+	Missing bool `json:"missing,omitempty"`
+}
+
+func (v *VolumePlan) addStats(stats *backuptar.EntryStats) {
+	v.Files += stats.Files
+	v.Dirs += stats.Dirs
+	v.Links += stats.Links
+	v.Whiteouts += stats.Whiteouts
+	v.Bytes += stats.Bytes
+	v.Missing = v.Missing || stats.Missing
+}
+
+// BackupPlan describes what a backup would store, as returned by PlanBackup.
+type BackupPlan struct {
+	Prefix string `json:"prefix"`
+	// Destination describes where the backup would be stored.
+	Destination string       `json:"destination"`
+	Volumes     []VolumePlan `json:"volumes"`
+}
+
+// RestorePlan describes what a restore would do, as returned by PlanRestore.
+type RestorePlan struct {
+	Prefix string `json:"prefix"`
+	// Source describes where the backup would be read from.
+	Source  string       `json:"source"`
+	Volumes []VolumePlan `json:"volumes"`
+	// stats counts the entries restored to each target
+	stats map[string]*backuptar.EntryStats
+}
+
+// add records the restore of the volume v, replacing its target if replace
+// is set.
+func (p *RestorePlan) add(v VolumeData, replace bool) {
+	action := ActionReplace
+	if !replace {
+		action = ActionUpdate
+	}
+	p.Volumes = append(p.Volumes, VolumePlan{
+		Id:     v.Id,
+		Type:   v.Type,
+		Target: v.Target,
+		Base:   v.Base,
+		Action: action,
+	})
+}
+
+// PlanBackup returns the plan of the backup Backup would make with the same
+// arguments. The volumes are walked like a backup, and only read.
+func PlanBackup(c *config.Config, tarPath string, opts BackupOptions) (*BackupPlan, error) {
+	plan := &BackupPlan{Prefix: c.Prefix, Volumes: []VolumePlan{}}
+	switch {
+	case c.ChunkStore != nil:
+		plan.Destination = "chunk store " + c.ChunkStore.Path
+	case c.Storage != nil:
+		plan.Destination = fmt.Sprintf("%s storage object %s", c.Storage.Type, objectName(c))
+	case opts.Output != nil:
+		plan.Destination = "output"
+	default:
+		plan.Destination = "archive " + tarPath
+	}
+	if opts.Base != "" && (c.ChunkStore != nil || c.Storage != nil) {
+		return nil, errors.New("incremental backups can only be appended to the archive of their base backup")
+	}
+	base, err := openIncrementalBase(c, tarPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	volumesData, err := newVolumesData(c, base)
+	if err != nil {
+		return nil, err
+	}
+	w := &planWriter{stats: make(map[string]*backuptar.EntryStats)}
+	err = writeBackup(c, w, volumesData, base, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range volumesData {
+		volume := VolumePlan{
+			Id:     v.Id,
+			Type:   v.Type,
+			Target: v.Target,
+			Base:   v.Base,
+			Action: ActionAdd,
+		}
+		switch {
+		case v.Base != "" && v.Type == "dir":
+			volume.Action = ActionIncremental
+		case v.Base != "":
+			volume.Action = ActionUnchanged
+		}
+		if stats, ok := w.stats[filepath.Join(c.Prefix, v.Id)]; ok {
+			volume.addStats(stats)
+		}
+		plan.Volumes = append(plan.Volumes, volume)
+	}
+	return plan, nil
+}
+
+// PlanRestore returns the plan of the restore Restore would make with the
+// same arguments. The backup is read like a restore, and nothing is written.
+func PlanRestore(c *config.Config, tarPath string, opts RestoreOptions) (*RestorePlan, error) {
+	plan := &RestorePlan{
+		Prefix:  c.Prefix,
+		Volumes: []VolumePlan{},
+		stats:   make(map[string]*backuptar.EntryStats),
+	}
+	switch {
+	case c.ChunkStore != nil:
+		plan.Source = "chunk store " + c.ChunkStore.Path
+		if _, err := os.Stat(c.ChunkStore.Path); err != nil {
+			// Opening a missing repository would create it
+			return nil, err
+		}
+	case c.Storage != nil:
+		plan.Source = fmt.Sprintf("%s storage object %s", c.Storage.Type, objectName(c))
+	case opts.Input != nil:
+		plan.Source = "input"
+	default:
+		plan.Source = "archive " + tarPath
+	}
+	opts.plan = plan
+	if err := Restore(c, tarPath, opts); err != nil {
+		return nil, err
+	}
+	for i, v := range plan.Volumes {
+		if stats, ok := plan.stats[v.Target]; ok {
+			plan.Volumes[i].addStats(stats)
+		}
+	}
+	return plan, nil
+}
+
+// WriteText writes the plan in a human-readable form.
+func (p *BackupPlan) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "Backup plan of prefix %q to %s\n", p.Prefix, p.Destination)
+	if err != nil {
+		return err
+	}
+	return writeVolumePlans(w, p.Volumes)
+}
+
+// WriteText writes the plan in a human-readable form.
+func (p *RestorePlan) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "Restore plan of prefix %q from %s\n", p.Prefix, p.Source)
+	if err != nil {
+		return err
+	}
+	return writeVolumePlans(w, p.Volumes)
+}
+
+// writeVolumePlans writes a line for each volume, and their totals.
+func writeVolumePlans(w io.Writer, volumes []VolumePlan) error {
+	var total VolumePlan
+	for _, v := range volumes {
+		line := fmt.Sprintf("  %s %s %s", v.Action, v.Type, v.Target)
+		if v.Base != "" {
+			line += fmt.Sprintf(" (base %q)", v.Base)
+		}
+		switch {
+		case v.Missing:
+			line += ": missing in the backup"
+		case v.Action != ActionUnchanged:
+			line += ": " + v.counts()
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		total.addStats(&backuptar.EntryStats{Files: v.Files, Dirs: v.Dirs, Links: v.Links, Whiteouts: v.Whiteouts, Bytes: v.Bytes})
+	}
+	_, err := fmt.Fprintf(w, "Total: %d volumes, %s\n", len(volumes), total.counts())
+	return err
+}
+
+// counts describes the entries of the volume.
+func (v VolumePlan) counts() string {
+	counts := []string{
+		fmt.Sprintf("%d files", v.Files),
+		fmt.Sprintf("%d dirs", v.Dirs),
+		fmt.Sprintf("%d links", v.Links),
+	}
+	if v.Whiteouts > 0 {
+		counts = append(counts, fmt.Sprintf("%d deleted", v.Whiteouts))
+	}
+	counts = append(counts, fmt.Sprintf("%d bytes", v.Bytes))
+	return strings.Join(counts, ", ")
+}
+
+// planWriter counts the entries a backup would store by volume tar path,
+// without storing them.
+type planWriter struct {
+	stats map[string]*backuptar.EntryStats
+}
+
+func (w *planWriter) volumeStats(dest string) *backuptar.EntryStats {
+	stats, ok := w.stats[dest]
+	if !ok {
+		stats = &backuptar.EntryStats{}
+		w.stats[dest] = stats
+	}
+	return stats
+}
+
+func (w *planWriter) AddDir(src, dest string, opts ...backuptar.AddOption) error {
+	stats := w.volumeStats(dest)
+	return backuptar.FileHeaders(src, dest, func(header *tar.Header, file string, fi os.FileInfo) error {
+		stats.Add(header)
+		return nil
+	}, opts...)
+}
+
+func (w *planWriter) AddFile(src, dest string, opts ...backuptar.AddOption) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.New("source path is a directory")
+	}
+	stats := w.volumeStats(dest)
+	stats.Files++
+	stats.Bytes += fi.Size()
+	return nil
+}
+
+// AddWhiteout counts the whiteout in the volume it is under.
+func (w *planWriter) AddWhiteout(name string) error {
+	for dest, stats := range w.stats {
+		if strings.HasPrefix(name, dest+"/") {
+			stats.Whiteouts++
+			return nil
+		}
+	}
+	return nil
+}
+
+// AddData ignores the metadata files of the backup.
+func (w *planWriter) AddData(data []byte, dest string) error {
+	return nil
+}
+
+func (w *planWriter) Checksums() []backuptar.FileChecksum {
+	return nil
+}
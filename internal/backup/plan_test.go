@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume1 := filepath.Join(tmpDir, "volume1")
+	require.NoError(t, os.MkdirAll(filepath.Join(volume1, "dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "dir", "data"), []byte("data"), 0o644))
+	require.NoError(t, os.Symlink("dir/data", filepath.Join(volume1, "link")))
+	volume2 := filepath.Join(tmpDir, "volume2.txt")
+	require.NoError(t, os.WriteFile(volume2, []byte("file"), 0o644))
+	storage := filepath.Join(tmpDir, "storage")
+	c := &config.Config{
+		Prefix:  "prefix",
+		Volumes: []config.Volume{{Path: volume1}, {Path: volume2}},
+		Storage: &config.Storage{Type: "local", Local: &config.LocalStorage{Path: storage}},
+	}
+	wantVolumes := []VolumePlan{
+		{Id: volumeId(volume1), Type: "dir", Target: volume1, Files: 1, Dirs: 2, Links: 1, Bytes: 4},
+		{Id: volumeId(volume2), Type: "file", Target: volume2, Files: 1, Bytes: 4},
+	}
+
+	t.Run("backup", func(t *testing.T) {
+		plan, err := PlanBackup(c, backuptar.Path, BackupOptions{})
+		require.NoError(t, err)
+		want := &BackupPlan{Prefix: "prefix", Destination: "local storage object prefix.tar"}
+		for _, v := range wantVolumes {
+			v.Action = ActionAdd
+			want.Volumes = append(want.Volumes, v)
+		}
+		assert.Equal(t, want, plan)
+		// Nothing is stored
+		assert.NoDirExists(t, storage)
+
+		var text bytes.Buffer
+		require.NoError(t, plan.WriteText(&text))
+		assert.Equal(t, `Backup plan of prefix "prefix" to local storage object prefix.tar
+  add dir `+volume1+`: 1 files, 2 dirs, 1 links, 4 bytes
+  add file `+volume2+`: 1 files, 0 dirs, 0 links, 4 bytes
+Total: 2 volumes, 2 files, 2 dirs, 1 links, 8 bytes
+`, text.String())
+	})
+
+	require.NoError(t, Backup(c, backuptar.Path, BackupOptions{}))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "new"), nil, 0o644))
+
+	t.Run("restore", func(t *testing.T) {
+		plan, err := PlanRestore(c, backuptar.Path, RestoreOptions{NoSameOwner: true})
+		require.NoError(t, err)
+		want := &RestorePlan{Prefix: "prefix", Source: "local storage object prefix.tar"}
+		for _, v := range wantVolumes {
+			v.Action = ActionReplace
+			want.Volumes = append(want.Volumes, v)
+		}
+		want.stats = plan.stats
+		assert.Equal(t, want, plan)
+		// Nothing is restored
+		assert.FileExists(t, filepath.Join(volume1, "new"))
+		entries, err := os.ReadDir(tmpDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 3)
+	})
+	t.Run("restore paths", func(t *testing.T) {
+		plan, err := PlanRestore(c, backuptar.Path, RestoreOptions{NoSameOwner: true, Paths: []string{"dir"}})
+		require.NoError(t, err)
+		require.Len(t, plan.Volumes, 1)
+		assert.Equal(t, ActionUpdate, plan.Volumes[0].Action)
+		assert.Equal(t, 1, plan.Volumes[0].Files)
+		assert.Equal(t, 1, plan.Volumes[0].Dirs)
+	})
+}
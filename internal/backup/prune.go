@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// Prune removes the backup of prefix from the archive at tarPath, rewriting
+// the archive without its entries. The backups whose prefixes are nested in
+// prefix are kept, and a backup other incremental backups are based on is
+// refused. The encrypted backups are read with the identities of the
+// configuration c, which may be nil. The backup is removed from the storage
+// or the chunk store of c if it has one.
+func Prune(c *config.Config, tarPath, prefix string) error {
+	prefix = path.Clean(prefix)
+	if c != nil && c.ChunkStore != nil {
+		return pruneChunkStore(c, prefix)
+	}
+	if c != nil && c.Storage != nil {
+		return pruneStorage(c, prefix)
+	}
+	extractOpts, err := identityOptions(c)
+	if err != nil {
+		return err
+	}
+	backups, unsupported, err := archiveBackups(tarPath, tarSource(tarPath, extractOpts))
+	if err != nil {
+		return err
+	}
+	if _, ok := backups[prefix]; !ok {
+		return fmt.Errorf("no backup found for prefix %q", prefix)
+	}
+	if err := checkDependents(backups, unsupported, prefix); err != nil {
+		return err
+	}
+	removed, err := removeBackup(tarPath, prefix, backups, -1)
+	if err != nil {
+		return err
+	}
+	slog.Info("Backup pruned", "prefix", prefix, "entries", removed)
+	return nil
+}
+
+// checkDependents returns an error if incremental backups are based on the
+// backup of prefix, they could not be restored without it. The backups with
+// unsupported metadata may be based on it, they are refused too.
+func checkDependents(backups map[string][]VolumeData, unsupported []string, prefix string) error {
+	var dependents []string
+	for _, p := range sortedPrefixes(backups) {
+		for _, v := range backups[p] {
+			if v.Base == prefix {
+				dependents = append(dependents, p)
+				break
+			}
+		}
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("backup of prefix %q is the base of the incremental backups %q, prune them first", prefix, dependents)
+	}
+	var unknown []string
+	for _, p := range unsupported {
+		if p != prefix {
+			unknown = append(unknown, p)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("backup of prefix %q may be the base of the backups %q, whose metadata is unsupported, prune them or upgrade the snapshotter first", prefix, unknown)
+	}
+	return nil
+}
+
+// removeBackup removes the entries of the backup of prefix among the first n
+// entries of the archive at tarPath, or all of them if n is negative, and
+// returns how many were removed. The entries of the backups nested in prefix
+// are kept.
+func removeBackup(tarPath, prefix string, backups map[string][]VolumeData, n int) (int, error) {
+	var nested []string
+	for p := range backups {
+		if strings.HasPrefix(p, prefix+"/") {
+			nested = append(nested, p)
+		}
+	}
+	return backuptar.RemoveEntries(tarPath, func(i int, name string) bool {
+		if n >= 0 && i >= n {
+			return false
+		}
+		return isVolumeFile(prefix, name) && !isVolumeFileOf(nested, name)
+	})
+}
+
+// replacePrevious prepares the replacement of the backup of the prefix of c
+// in the archive at tarPath, by the backup about to be appended to it. The
+// returned function removes the entries of the previous backup once the new
+// one is written, it is nil if the archive has no backup of the prefix.
+func replacePrevious(c *config.Config, tarPath string) (func() error, error) {
+	extractOpts, err := identityOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	backups, unsupported, err := archiveBackups(tarPath, tarSource(tarPath, extractOpts))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the backups of the archive: %w", err)
+	}
+	prefix := path.Clean(c.Prefix)
+	if _, ok := backups[prefix]; !ok {
+		return nil, nil
+	}
+	if err := checkDependents(backups, unsupported, prefix); err != nil {
+		return nil, err
+	}
+	names, err := backuptar.EntryNames(tarPath, "")
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		removed, err := removeBackup(tarPath, prefix, backups, len(names))
+		if err != nil {
+			return fmt.Errorf("failed to remove the previous backup of prefix %q: %w", prefix, err)
+		}
+		slog.Info("Previous backup replaced", "prefix", prefix, "entries", removed)
+		return nil
+	}, nil
+}
@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(volume, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("old"), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+	appendBackup := func(prefix, basePrefix string) {
+		c := &config.Config{Prefix: prefix, Volumes: []config.Volume{{Path: volume}}}
+		var base *incrementalBase
+		if basePrefix != "" {
+			var err error
+			base, err = loadIncrementalBase(tarPath, basePrefix)
+			require.NoError(t, err)
+		}
+		volumesData, err := newVolumesData(c, base)
+		require.NoError(t, err)
+		backupWriter, err := backuptar.NewBackupWriter(tarPath)
+		require.NoError(t, err)
+		require.NoError(t, writeBackup(c, backupWriter, volumesData, base, false))
+		require.NoError(t, backupWriter.Close())
+	}
+	appendBackup("node-1", "")
+	appendBackup("node-1/nested", "")
+	appendBackup("node-2", "")
+	appendBackup("node-3", "node-2")
+	listPrefixes := func() []string {
+		backups, err := List(nil, tarPath, ListOptions{})
+		require.NoError(t, err)
+		var prefixes []string
+		for _, b := range backups {
+			prefixes = append(prefixes, b.Prefix)
+		}
+		return prefixes
+	}
+
+	// The new backup of node-1 replaces the previous one once written
+	c := &config.Config{Prefix: "node-1", Volumes: []config.Volume{{Path: volume}}}
+	replace, err := replacePrevious(c, tarPath)
+	require.NoError(t, err)
+	require.NotNil(t, replace)
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("new"), 0o644))
+	appendBackup("node-1", "")
+	require.NoError(t, replace())
+	dataPath := filepath.Join("node-1", volumeId(volume), "data")
+	names, err := backuptar.EntryNames(tarPath, dataPath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{dataPath}, names)
+	data, err := backuptar.ReadFile(tarPath, dataPath)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	assert.Equal(t, []string{"node-1", "node-1/nested", "node-2", "node-3"}, listPrefixes())
+
+	replace, err = replacePrevious(&config.Config{Prefix: "node-4"}, tarPath)
+	require.NoError(t, err)
+	assert.Nil(t, replace)
+	_, err = replacePrevious(&config.Config{Prefix: "node-2"}, tarPath)
+	assert.ErrorContains(t, err, "is the base of the incremental backups")
+
+	// The backups nested in the pruned prefix are kept
+	require.NoError(t, Prune(nil, tarPath, "node-1"))
+	assert.Equal(t, []string{"node-1/nested", "node-2", "node-3"}, listPrefixes())
+	names, err = backuptar.EntryNames(tarPath, "node-1/nested")
+	require.NoError(t, err)
+	assert.NotEmpty(t, names)
+
+	assert.ErrorContains(t, Prune(nil, tarPath, "node-1"), "no backup found")
+	assert.ErrorContains(t, Prune(nil, tarPath, "node-2"), "is the base of the incremental backups")
+	require.NoError(t, Prune(nil, tarPath, "node-3"))
+	require.NoError(t, Prune(nil, tarPath, "node-2/"))
+	assert.Equal(t, []string{"node-1/nested"}, listPrefixes())
+}
+
+func TestPrune_UnsupportedMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(volume, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("data"), 0o644))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	c := &config.Config{Prefix: "node", Volumes: []config.Volume{{Path: volume}}}
+	require.NoError(t, Backup(c, tarPath, BackupOptions{}))
+	// A backup of a later version of the snapshotter
+	future := &config.Config{Prefix: "future", Volumes: []config.Volume{{Path: volume}}}
+	backupWriter, err := backuptar.NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddDir(volume, filepath.Join("future", volumeId(volume))))
+	require.NoError(t, addYAML(backupWriter, map[string]interface{}{"apiVersion": "v2", "volumes": map[string]string{"id": "changed"}}, VolumesDataPath(future)))
+	require.NoError(t, backupWriter.Close())
+
+	// It is only refused when restored or verified
+	backups, err := List(nil, tarPath, ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "node", backups[0].Prefix)
+	assert.ErrorIs(t, Restore(future, tarPath, RestoreOptions{To: t.TempDir()}), ErrUnsupportedMetadata)
+	assert.ErrorIs(t, Verify(future, tarPath, VerifyOptions{}), ErrUnsupportedMetadata)
+	require.NoError(t, Restore(c, tarPath, RestoreOptions{To: t.TempDir()}))
+
+	// It may be based on the other backups
+	err = Prune(nil, tarPath, "node")
+	assert.ErrorContains(t, err, `may be the base of the backups ["future"]`)
+	require.NoError(t, Prune(nil, tarPath, "future"))
+	require.NoError(t, Prune(nil, tarPath, "node"))
+	names, err := backuptar.EntryNames(tarPath, "")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
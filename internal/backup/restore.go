@@ -1,74 +1,405 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
 	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
 )
 
-func Restore(c *config.Config) error {
+// RestoreOptions configures the restore process.
+type RestoreOptions struct {
+	// NoSameOwner restores files owned by the user running the restore
+	// instead of the owner stored in the backup, for rootless setups.
+	NoSameOwner bool
+	// Input is read sequentially to restore the backup, such as the standard
+	// input, instead of the archive. The volumes data of
+	// the backup must come before the volumes, as written by Backup.
+	Input io.Reader
+	// Volumes restricts the restore to the volumes with these targets, or
+	// ids. Every volume of the backup is restored if it is empty.
+	Volumes []string
+	// Paths restricts the restore to the files of the directory volumes
+	// matching one of these glob patterns, relative to the volume target,
+	// and to the content of the matching directories. The volume targets
+	// are not cleared, other files are left as they are, and file volumes
+	// are not restored.
+	Paths []string
+	// Remap restores the volumes whose target is an old path key, or under
+	// it, to the new path it maps to instead. The longest old path applies.
+	Remap map[string]string
+	// To restores every volume under this directory, at the path of its
+	// target relative to the root, instead of its target. It applies after
+	// Remap.
+	To string
+	// plan records the volumes of a dry run, which restores nothing.
+	plan *RestorePlan
+}
+
+// stage reports whether the volumes are extracted to staging paths replacing
+// their targets once restored, instead of in place.
+func (o RestoreOptions) stage() bool {
+	return len(o.Paths) == 0 && o.plan == nil
+}
+
+func (o RestoreOptions) extractOptions() []backuptar.ExtractOption {
+	var opts []backuptar.ExtractOption
+	if o.NoSameOwner {
+		opts = append(opts, backuptar.WithNoSameOwner())
+	}
+	if len(o.Paths) > 0 {
+		opts = append(opts, backuptar.WithPathFilter(o.matchPaths))
+	}
+	if o.plan != nil {
+		opts = append(opts, backuptar.WithDryRun(o.plan.stats))
+	}
+	return opts
+}
+
+// matchPaths reports whether relPath, or one of its parent directories,
+// matches one of the path patterns.
+func (o RestoreOptions) matchPaths(relPath string) bool {
+	for p := relPath; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range o.Paths {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectVolumes returns the volumes of volumesData to restore, with the paths
+// they are restored to as targets. It is an error to select a volume which is
+// not in the backup.
+func (o RestoreOptions) selectVolumes(volumesData []VolumeData) ([]VolumeData, error) {
+	for _, pattern := range o.Paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+	}
+	// Whether each requested volume was found in the backup
+	selected := make(map[string]bool, len(o.Volumes))
+	for _, volume := range o.Volumes {
+		selected[filepath.Clean(volume)] = false
+	}
+	var volumes []VolumeData
+	for _, v := range volumesData {
+		if len(o.Volumes) > 0 {
+			_, byTarget := selected[v.Target]
+			_, byId := selected[v.Id]
+			if !byTarget && !byId {
+				continue
+			}
+			if byTarget {
+				selected[v.Target] = true
+			}
+			if byId {
+				selected[v.Id] = true
+			}
+		}
+		if len(o.Paths) > 0 && v.Type != "dir" {
+			slog.Info("Skipping file volume, only paths of directory volumes are restored", "target", v.Target)
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+	for _, volume := range o.Volumes {
+		if !selected[filepath.Clean(volume)] {
+			return nil, fmt.Errorf("volume %s is not in the backup", volume)
+		}
+	}
+	for i, v := range volumes {
+		target, err := o.target(v.Target)
+		if err != nil {
+			return nil, err
+		}
+		if target != v.Target {
+			slog.Info("Remapping volume target", "target", v.Target, "to", target)
+			volumes[i].Target = target
+		}
+	}
+	return volumes, nil
+}
+
+// selects reports whether the volume with the given target is restored, if it
+// is in the backup.
+func (o RestoreOptions) selects(target string) bool {
+	if len(o.Volumes) == 0 {
+		return true
+	}
+	for _, volume := range o.Volumes {
+		volume = filepath.Clean(volume)
+		if volume == target || volume == volumeId(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the path the volume with the given target is restored to.
+func (o RestoreOptions) target(target string) (string, error) {
+	var oldPath, newPath string
+	for old, new := range o.Remap {
+		if !filepath.IsAbs(old) || !filepath.IsAbs(new) {
+			return "", fmt.Errorf("remapped paths must be absolute: %s=%s", old, new)
+		}
+		old = filepath.Clean(old)
+		if len(old) > len(oldPath) && isUnder(target, old) {
+			oldPath, newPath = old, new
+		}
+	}
+	if oldPath != "" {
+		relPath, err := filepath.Rel(oldPath, target)
+		if err != nil {
+			return "", err
+		}
+		target = filepath.Join(newPath, relPath)
+	}
+	if o.To != "" {
+		to, err := filepath.Abs(o.To)
+		if err != nil {
+			return "", err
+		}
+		target = filepath.Join(to, target)
+	}
+	return target, nil
+}
+
+// isUnder reports whether path is dir or under it.
+func isUnder(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// Restore restores the backup of the prefix of the configuration c from the
+// archive at tarPath, unless the configuration or opts.Input read it from
+// elsewhere. The restore hooks of the configuration, and of the volumes it
+// restores, run around it, except in a dry run.
+func Restore(c *config.Config, tarPath string, opts RestoreOptions) error {
+	restore := func() error {
+		return runRestore(c, tarPath, opts)
+	}
+	if opts.plan != nil {
+		return restore()
+	}
+	// The volumes are restored together, so their hooks run around the whole
+	// restore, the ones of the first volume outermost
+	for i := len(c.Volumes) - 1; i >= 0; i-- {
+		v := c.Volumes[i]
+		if v.Hooks == nil || !opts.selects(v.Path) {
+			continue
+		}
+		target, err := opts.target(v.Path)
+		if err != nil {
+			return err
+		}
+		pre, post := restoreHooks(v.Hooks)
+		scope := hookScope{operation: "restore", prefix: c.Prefix, volumeId: volumeId(v.Path), target: target}
+		inner := restore
+		restore = func() error {
+			return withHooks(scope, pre, post, inner)
+		}
+	}
+	pre, post := restoreHooks(c.Hooks)
+	return withHooks(hookScope{operation: "restore", prefix: c.Prefix}, pre, post, restore)
+}
+
+// runRestore restores the backup of Restore, between its hooks.
+func runRestore(c *config.Config, tarPath string, opts RestoreOptions) error {
+	if c.ChunkStore != nil {
+		return restoreChunkStore(c, opts)
+	}
+	identities, err := encryptionIdentities(c)
+	if err != nil {
+		return err
+	}
+	extractOpts := append(opts.extractOptions(), backuptar.WithIdentities(identities...))
+	if c.Storage != nil {
+		return restoreFromStorage(c, opts, extractOpts)
+	}
+	if opts.Input != nil {
+		return restoreStream(c, opts.Input, opts, extractOpts)
+	}
 	// Get volumes data
-	volumesData, err := GetVolumesData(backuptar.Path, VolumesDataPath(c))
+	volumesData, err := GetVolumesData(tarPath, VolumesDataPath(c), extractOpts...)
 	if err != nil {
 		return err
 	}
-	for _, v := range volumesData {
+	volumesData, err = opts.selectVolumes(volumesData)
+	if err != nil {
+		return err
+	}
+	chains, err := volumeChains(tarPath, c.Prefix, volumesData, extractOpts...)
+	if err != nil {
+		return err
+	}
+	prefixes := make([]string, len(chains))
+	for i, chain := range chains {
+		prefixes[i] = chain[0]
+	}
+	r, err := prepareTargets(volumesData, prefixes, opts, extractOpts)
+	if err != nil {
+		return err
+	}
+	// Restore all the volumes in a single pass over the archive
+	err = backuptar.ExtractAll(tarPath, r.targets, extractOpts...)
+	if err == nil {
+		err = applyIncrementals(tarPath, volumesData, r.paths, chains, extractOpts)
+	}
+	return r.finish(err)
+}
+
+// applyIncrementals applies the incremental backups of the volumes over their
+// restored base at the path of the same index, in the order of their chains of
+// backups. Every step of the chains is a single pass over the archive.
+func applyIncrementals(tarPath string, volumesData []VolumeData, paths []string, chains [][]string, extractOpts []backuptar.ExtractOption) error {
+	extractOpts = append(extractOpts, backuptar.WithWhiteouts())
+	for step := 1; ; step++ {
+		targets := make(map[string]string)
+		for i, v := range volumesData {
+			if step < len(chains[i]) {
+				src := filepath.Join(chains[i][step], v.Id)
+				slog.Info("Applying incremental backup", "src", src, "dest", v.Target)
+				targets[src] = paths[i]
+			}
+		}
+		if len(targets) == 0 {
+			return nil
+		}
+		err := backuptar.ExtractAll(tarPath, targets, extractOpts...)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// restoreStream restores the backup read sequentially from r.
+func restoreStream(c *config.Config, r io.Reader, opts RestoreOptions, extractOpts []backuptar.ExtractOption) error {
+	stream, err := backuptar.NewStreamReader(r)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	// The volumes data must come before the volumes, which would otherwise be
+	// consumed
+	data, err := stream.ReadFileBefore(VolumesDataPath(c), c.Prefix, extractOpts...)
+	if err != nil {
+		if errors.Is(err, backuptar.ErrFileNotFound) {
+			return nil
+		}
+		return err
+	}
+	metadata, err := parseMetadata(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", VolumesDataPath(c), err)
+	}
+	volumesData := metadata.Volumes
+	volumesData, err = opts.selectVolumes(volumesData)
+	if err != nil {
+		return err
+	}
+	prefixes := make([]string, len(volumesData))
+	for i, v := range volumesData {
+		if v.Base != "" {
+			return fmt.Errorf("incremental backup of prefix %q can't be restored from a stream", c.Prefix)
+		}
+		prefixes[i] = c.Prefix
+	}
+	restoration, err := prepareTargets(volumesData, prefixes, opts, extractOpts)
+	if err != nil {
+		return err
+	}
+	return restoration.finish(stream.ExtractAll(restoration.targets, extractOpts...))
+}
+
+// restoration holds the filesystem paths the volumes are extracted to. Unless
+// only some paths of the volumes are restored, the volumes are extracted to
+// staging paths, and their targets are only replaced once every volume is
+// restored, so that a failed restore leaves them as they were.
+type restoration struct {
+	// targets maps the tar paths of the volumes to their extraction paths.
+	targets map[string]string
+	// paths holds the extraction path of each volume, by index.
+	paths  []string
+	staged []*backuptar.StagedTarget
+}
+
+// prepareTargets returns the restoration of the volumes, each one being
+// restored from the backup of the prefix at the same index. The volumes are
+// staged unless only some of their paths are restored, or in a dry run.
+func prepareTargets(volumesData []VolumeData, prefixes []string, opts RestoreOptions, extractOpts []backuptar.ExtractOption) (*restoration, error) {
+	stage := opts.stage()
+	r := &restoration{
+		targets: make(map[string]string, len(volumesData)),
+		paths:   make([]string, len(volumesData)),
+	}
+	for i, v := range volumesData {
 		// Check target is absolute path
 		if !filepath.IsAbs(v.Target) {
-			return fmt.Errorf("target of volume %s is not absolute path", v.Id)
+			return nil, r.finish(fmt.Errorf("target of volume %s is not absolute path", v.Id))
 		}
+		src := filepath.Join(prefixes[i], v.Id)
+		var staged *backuptar.StagedTarget
+		var err error
 		switch v.Type {
 		case "dir":
-			// Clear directory
-			err := clearDirectory(v.Target)
-			if err != nil {
-				return err
-			}
 			// Replace directory with backup data
-			slog.Info("Restoring dir", "src", filepath.Join(c.Prefix, v.Id), "dest", v.Target)
-			err = backuptar.ExtractDir(backuptar.Path, filepath.Join(c.Prefix, v.Id), v.Target)
-			if err != nil {
-				return err
+			slog.Info("Restoring dir", "src", src, "dest", v.Target)
+			if stage {
+				staged, err = backuptar.StageDir(v.Target, extractOpts...)
 			}
 		case "file":
 			// Replace file with backup data
-			slog.Info("Restoring file", "src", filepath.Join(c.Prefix, v.Id), "dest", v.Target)
-			err := backuptar.ExtractFile(backuptar.Path, filepath.Join(c.Prefix, v.Id), v.Target)
-			if err != nil {
-				return err
+			slog.Info("Restoring file", "src", src, "dest", v.Target)
+			if stage {
+				staged, err = backuptar.StageFile(v.Target, extractOpts...)
 			}
 		default:
-			return fmt.Errorf("unknown volume type %s for volume %s", v.Type, v.Id)
+			err = fmt.Errorf("unknown volume type %s for volume %s", v.Type, v.Id)
+		}
+		if err != nil {
+			return nil, r.finish(err)
+		}
+		r.paths[i] = v.Target
+		if staged != nil {
+			r.staged = append(r.staged, staged)
+			r.paths[i] = staged.Path
+		}
+		r.targets[src] = r.paths[i]
+		if opts.plan != nil {
+			opts.plan.add(v, len(opts.Paths) == 0)
 		}
 	}
-	return nil
+	return r, nil
 }
 
-func clearDirectory(path string) error {
-	s, err := os.Stat(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// Create empty directory
-			return os.MkdirAll(path, 0o755)
+// finish ends the restoration with the error of the extraction. The staged
+// volumes replace their targets if err is nil, and are discarded otherwise. If
+// a target fails to be replaced, the ones already replaced are rolled back.
+func (r *restoration) finish(err error) error {
+	if err == nil {
+		for _, staged := range r.staged {
+			err = staged.Commit()
+			if err != nil {
+				break
+			}
 		}
-		return err
 	}
-	if !s.IsDir() {
-		return fmt.Errorf("path %s exists, but is not a directory", path)
-	}
-	// Remove directory content
-	dirItems, err := os.ReadDir(path)
 	if err != nil {
-		return err
+		errs := []error{err}
+		for i := len(r.staged) - 1; i >= 0; i-- {
+			errs = append(errs, r.staged[i].Rollback())
+		}
+		return errors.Join(errs...)
 	}
-	for _, item := range dirItems {
-		itemPath := filepath.Join(path, item.Name())
-		err := os.RemoveAll(itemPath)
-		if err != nil {
+	for _, staged := range r.staged {
+		if err := staged.Finish(); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,198 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestore_Selective(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume1 := filepath.Join(tmpDir, "volume1")
+	require.NoError(t, os.MkdirAll(filepath.Join(volume1, "keystore"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "keystore", "key1"), []byte("key1"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "keystore", "key2"), []byte("key2"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "db.log"), []byte("db"), 0o644))
+	volume2 := filepath.Join(tmpDir, "volume2")
+	require.NoError(t, os.MkdirAll(volume2, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume2, "data"), []byte("data"), 0o644))
+	volume3 := filepath.Join(tmpDir, "volume3.txt")
+	require.NoError(t, os.WriteFile(volume3, []byte("file"), 0o644))
+
+	c := &config.Config{
+		Prefix:  "prefix",
+		Volumes: []config.Volume{{Path: volume1}, {Path: volume2}, {Path: volume3}},
+		Storage: &config.Storage{Type: "local", Local: &config.LocalStorage{Path: filepath.Join(tmpDir, "storage")}},
+	}
+	require.NoError(t, Backup(c, backuptar.Path, BackupOptions{}))
+
+	// Modify every volume after the backup
+	for _, path := range []string{filepath.Join(volume1, "keystore", "key1"), filepath.Join(volume1, "keystore", "key2"), filepath.Join(volume1, "db.log"), filepath.Join(volume2, "data"), volume3} {
+		require.NoError(t, os.WriteFile(path, []byte("changed"), 0o644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "new"), nil, 0o644))
+	assertContent := func(t *testing.T, path, want string) {
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(got), path)
+	}
+
+	t.Run("volume", func(t *testing.T) {
+		require.NoError(t, Restore(c, backuptar.Path, RestoreOptions{NoSameOwner: true, Volumes: []string{volume2 + "/", volumeId(volume3)}}))
+		assertContent(t, filepath.Join(volume2, "data"), "data")
+		assertContent(t, volume3, "file")
+		// Volumes which are not selected are not cleared
+		assertContent(t, filepath.Join(volume1, "keystore", "key1"), "changed")
+		assert.FileExists(t, filepath.Join(volume1, "new"))
+	})
+	t.Run("path", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(volume3, []byte("changed"), 0o644))
+		require.NoError(t, Restore(c, backuptar.Path, RestoreOptions{NoSameOwner: true, Paths: []string{"keystore/key1", "*.log"}}))
+		assertContent(t, filepath.Join(volume1, "keystore", "key1"), "key1")
+		assertContent(t, filepath.Join(volume1, "db.log"), "db")
+		assertContent(t, filepath.Join(volume1, "keystore", "key2"), "changed")
+		assert.FileExists(t, filepath.Join(volume1, "new"))
+		// File volumes are not restored with paths
+		assertContent(t, volume3, "changed")
+	})
+	t.Run("directory path", func(t *testing.T) {
+		require.NoError(t, Restore(c, backuptar.Path, RestoreOptions{NoSameOwner: true, Volumes: []string{volume1}, Paths: []string{"keystore"}}))
+		assertContent(t, filepath.Join(volume1, "keystore", "key2"), "key2")
+	})
+	t.Run("unknown volume", func(t *testing.T) {
+		err := Restore(c, backuptar.Path, RestoreOptions{Volumes: []string{filepath.Join(tmpDir, "other")}})
+		assert.ErrorContains(t, err, "is not in the backup")
+	})
+	t.Run("invalid pattern", func(t *testing.T) {
+		err := Restore(c, backuptar.Path, RestoreOptions{Paths: []string{"["}})
+		assert.ErrorContains(t, err, "invalid path pattern")
+	})
+}
+
+func TestRestoreOptions_Target(t *testing.T) {
+	tc := []struct {
+		name   string
+		opts   RestoreOptions
+		target string
+		want   string
+	}{
+		{
+			name:   "no remapping",
+			target: "/data/volume",
+			want:   "/data/volume",
+		},
+		{
+			name:   "remapped target",
+			opts:   RestoreOptions{Remap: map[string]string{"/data/volume": "/srv/volume"}},
+			target: "/data/volume",
+			want:   "/srv/volume",
+		},
+		{
+			name:   "remapped parent, longest first",
+			opts:   RestoreOptions{Remap: map[string]string{"/data/": "/srv", "/data/execution": "/mnt/execution"}},
+			target: "/data/execution/db",
+			want:   "/mnt/execution/db",
+		},
+		{
+			name:   "path component boundary",
+			opts:   RestoreOptions{Remap: map[string]string{"/data/vol": "/srv/vol"}},
+			target: "/data/volume",
+			want:   "/data/volume",
+		},
+		{
+			name:   "to directory",
+			opts:   RestoreOptions{To: "/scratch"},
+			target: "/data/volume",
+			want:   "/scratch/data/volume",
+		},
+		{
+			name:   "remapped to directory",
+			opts:   RestoreOptions{Remap: map[string]string{"/data": "/srv"}, To: "/scratch"},
+			target: "/data/volume",
+			want:   "/scratch/srv/volume",
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opts.target(tt.target)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := RestoreOptions{Remap: map[string]string{"/data": "srv"}}.target("/data/volume")
+	assert.Error(t, err)
+}
+
+func TestRestore_To(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(volume, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("data"), 0o644))
+	c := &config.Config{
+		Prefix:  "prefix",
+		Volumes: []config.Volume{{Path: volume}},
+		Storage: &config.Storage{Type: "local", Local: &config.LocalStorage{Path: filepath.Join(tmpDir, "storage")}},
+	}
+	require.NoError(t, Backup(c, backuptar.Path, BackupOptions{}))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("changed"), 0o644))
+
+	scratch := filepath.Join(tmpDir, "scratch")
+	require.NoError(t, Restore(c, backuptar.Path, RestoreOptions{NoSameOwner: true, To: scratch}))
+	got, err := os.ReadFile(filepath.Join(scratch, volume, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), got)
+	// The live volume is untouched
+	got, err = os.ReadFile(filepath.Join(volume, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("changed"), got)
+
+	moved := filepath.Join(tmpDir, "moved")
+	require.NoError(t, Restore(c, backuptar.Path, RestoreOptions{NoSameOwner: true, Remap: map[string]string{volume: moved}}))
+	got, err = os.ReadFile(filepath.Join(moved, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), got)
+}
+
+func TestRestore_Failure(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume1 := filepath.Join(tmpDir, "volume1")
+	require.NoError(t, os.MkdirAll(volume1, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "data"), []byte("data"), 0o644))
+	volume2 := filepath.Join(tmpDir, "volume2")
+	require.NoError(t, os.MkdirAll(volume2, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume2, "large"), bytes.Repeat([]byte("large"), 1<<18), 0o644))
+	storage := filepath.Join(tmpDir, "storage")
+	c := &config.Config{
+		Prefix:  "prefix",
+		Volumes: []config.Volume{{Path: volume1}, {Path: volume2}},
+		Storage: &config.Storage{Type: "local", Local: &config.LocalStorage{Path: storage}},
+	}
+	require.NoError(t, Backup(c, backuptar.Path, BackupOptions{}))
+	require.NoError(t, os.WriteFile(filepath.Join(volume1, "data"), []byte("changed"), 0o644))
+	require.NoError(t, os.Rename(filepath.Join(volume2, "large"), filepath.Join(volume2, "new")))
+
+	// Truncate the archive in the middle of the large file of the last volume
+	object := filepath.Join(storage, "prefix.tar")
+	fi, err := os.Stat(object)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(object, fi.Size()/2))
+
+	err = Restore(c, backuptar.Path, RestoreOptions{NoSameOwner: true})
+	require.Error(t, err)
+	// The volumes are left as they were, without staging leftovers
+	got, err := os.ReadFile(filepath.Join(volume1, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("changed"), got)
+	assert.FileExists(t, filepath.Join(volume2, "new"))
+	assert.NoFileExists(t, filepath.Join(volume2, "large"))
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
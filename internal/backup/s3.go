@@ -0,0 +1,474 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// Environment variables holding the credentials of the S3 storage, when they
+// are not in the configuration.
+const (
+	AWSAccessKeyIDEnv     = "AWS_ACCESS_KEY_ID"
+	AWSSecretAccessKeyEnv = "AWS_SECRET_ACCESS_KEY"
+)
+
+// defaultPartSize is the size of the parts of the multipart uploads.
+const defaultPartSize = 64 << 20
+
+// Uploads of objects and parts failing with a server error are retried up to
+// maxRetries times, waiting defaultRetryDelay before the first retry and
+// twice as long before each next one.
+const (
+	maxRetries        = 4
+	defaultRetryDelay = time.Second
+)
+
+// S3Storage stores the objects in a bucket of an S3-compatible object store,
+// such as AWS S3 or MinIO. Requests are signed with AWS Signature Version 4,
+// and buckets are addressed by path.
+type S3Storage struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	// prefix is prepended to the names of the objects to get their keys
+	prefix    string
+	accessKey string
+	secretKey string
+	partSize  int
+	client    *http.Client
+	// retryDelay is the time waited before the first retry of an upload
+	retryDelay time.Duration
+	// now returns the time the requests are signed at
+	now func() time.Time
+}
+
+// S3Options configures an S3Storage.
+type S3Options struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PartSize is the size of the parts of the multipart uploads, objects
+	// smaller than a part are uploaded with a single request.
+	PartSize int
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// NewS3Storage returns a storage of the objects in the bucket of opts.
+func NewS3Storage(opts S3Options) (*S3Storage, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q: the scheme must be http or https", opts.Endpoint)
+	}
+	s := &S3Storage{
+		endpoint:   endpoint,
+		region:     opts.Region,
+		bucket:     opts.Bucket,
+		prefix:     opts.Prefix,
+		accessKey:  opts.AccessKeyID,
+		secretKey:  opts.SecretAccessKey,
+		partSize:   opts.PartSize,
+		client:     opts.Client,
+		retryDelay: defaultRetryDelay,
+		now:        time.Now,
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.partSize == 0 {
+		s.partSize = defaultPartSize
+	}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+	return s, nil
+}
+
+func newS3StorageFromConfig(c *config.S3Storage) (*S3Storage, error) {
+	opts := S3Options{
+		Endpoint:        c.Endpoint,
+		Region:          c.Region,
+		Bucket:          c.Bucket,
+		Prefix:          c.Prefix,
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: os.Getenv(AWSSecretAccessKeyEnv),
+		PartSize:        int(c.PartSizeMiB << 20),
+	}
+	if opts.AccessKeyID == "" {
+		opts.AccessKeyID = os.Getenv(AWSAccessKeyIDEnv)
+	}
+	if c.SecretAccessKeyFile != "" {
+		data, err := os.ReadFile(c.SecretAccessKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read s3 secret access key file: %w", err)
+		}
+		opts.SecretAccessKey = strings.TrimSpace(string(data))
+	}
+	if opts.AccessKeyID == "" || opts.SecretAccessKey == "" {
+		return nil, errors.New("missing s3 credentials")
+	}
+	return NewS3Storage(opts)
+}
+
+// S3Error is an error response of the object store.
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3 request failed with status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Put uploads the object with a single request if it is smaller than a part,
+// and with a multipart upload otherwise, buffering one part at a time.
+func (s *S3Storage) Put(name string, r io.Reader) error {
+	part := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.upload(name, nil, part[:n])
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.createMultipartUpload(name)
+	if err != nil {
+		return err
+	}
+	err = s.uploadParts(name, uploadID, part, r)
+	if err != nil {
+		// Release the parts uploaded so far
+		if resp, abortErr := s.do(http.MethodDelete, name, url.Values{"uploadId": {uploadID}}, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// uploadParts uploads the full part, followed by the rest of r, in the
+// multipart upload uploadID, and completes it.
+func (s *S3Storage) uploadParts(name, uploadID string, part []byte, r io.Reader) error {
+	var complete completeMultipartUpload
+	for number := 1; ; number++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := s.upload(name, query, part)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{
+			PartNumber: number,
+			ETag:       resp.Header.Get("ETag"),
+		})
+
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		part = part[:n]
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPost, name, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The completion may fail after the status is sent, with an error in
+	// the body
+	var result struct {
+		XMLName xml.Name
+		S3Error
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid s3 response: %w", err)
+	}
+	if result.XMLName.Local == "Error" {
+		result.StatusCode = resp.StatusCode
+		return &result.S3Error
+	}
+	return nil
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3Storage) createMultipartUpload(name string) (string, error) {
+	resp, err := s.do(http.MethodPost, name, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid s3 response: %w", err)
+	}
+	return result.UploadID, nil
+}
+
+func (s *S3Storage) Get(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) List(prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s.prefix + prefix},
+	}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 response: %w", err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, s.prefix))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete removes the object. Object stores don't report missing objects on
+// deletion, so ErrObjectNotFound is only returned if a HEAD request doesn't
+// find it first.
+func (s *S3Storage) Delete(name string) error {
+	resp, err := s.do(http.MethodHead, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	resp, err = s.do(http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// objectURL returns the URL of the object name, or of the bucket if name is
+// empty.
+func (s *S3Storage) objectURL(name string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.bucket + "/"
+	if name != "" {
+		u.Path += s.prefix + name
+	}
+	// Encode the path as it is signed, the standard encoding leaves some
+	// reserved characters as they are
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	u.RawPath = strings.Join(segments, "/")
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do sends a signed request for the object name with the given query and
+// body. Error responses are returned as an S3Error, or ErrObjectNotFound for
+// missing objects.
+func (s *S3Storage) do(method, name string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(name, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		// Send an empty body with its length, instead of chunks
+		req.Body = http.NoBody
+	}
+	s.sign(req, body, s.now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && name != "" {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	// The body is empty for HEAD requests
+	_ = xml.NewDecoder(resp.Body).Decode(s3Err)
+	return nil, s3Err
+}
+
+// upload sends the PUT request of the object, or of a part of it, retrying
+// it with a backoff when the request can't be sent or fails with a server
+// error.
+func (s *S3Storage) upload(name string, query url.Values, body []byte) (*http.Response, error) {
+	delay := s.retryDelay
+	for retry := 0; ; retry++ {
+		resp, err := s.do(http.MethodPut, name, query, body)
+		if err == nil || retry == maxRetries || !retryable(err) {
+			return resp, err
+		}
+		slog.Warn("S3 upload failed, retrying", "name", name, "part", query.Get("partNumber"), "error", err, "delay", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// retryable reports whether the failed request may succeed if it is sent
+// again.
+func retryable(err error) bool {
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode >= 500 || s3Err.StatusCode == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, ErrObjectNotFound)
+}
+
+// sign adds the AWS Signature Version 4 of req at time t to its headers. All
+// the headers of req are signed, with the host.
+func (s *S3Storage) sign(req *http.Request, body []byte, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, with the percent-encoding of
+// Signature Version 4, so that the URL is sent as it was signed.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes every byte of s except the unreserved characters.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// SnapshotLive is the snapshot strategy recorded for the volumes backed up
+// from their live files, as no snapshot of them could be made.
+const SnapshotLive = "live"
+
+// snapshotVolumes makes the snapshots of the volumes of the configuration c,
+// with their backup hooks running around them, and records their strategies in
+// volumesData. It returns the paths the volumes are backed up from, and a
+// function removing the snapshots. The snapshots are made in the snapshot
+// directory of c, named after the ids of the volumes, if it has one. A volume
+// which can't be snapshotted is backed up from its live files, with a
+// warning.
+func snapshotVolumes(c *config.Config, volumesData []VolumeData) ([]string, func() error, error) {
+	if c.SnapshotDir != "" {
+		if err := os.MkdirAll(c.SnapshotDir, 0o700); err != nil {
+			return nil, nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+		}
+	}
+	var snapshots []*backuptar.Snapshot
+	remove := func() error {
+		var errs []error
+		for _, snapshot := range snapshots {
+			errs = append(errs, snapshot.Remove())
+		}
+		return errors.Join(errs...)
+	}
+	srcs := make([]string, len(c.Volumes))
+	for i, v := range c.Volumes {
+		srcs[i] = v.Path
+		volumeData := &volumesData[i]
+		pre, post := backupHooks(v.Hooks)
+		scope := hookScope{operation: "backup", prefix: c.Prefix, volumeId: volumeData.Id, target: v.Path}
+		err := withHooks(scope, pre, post, func() error {
+			if volumeData.Type == "file" && volumeData.Base != "" {
+				// Unchanged since the base backup, it is not read
+				return nil
+			}
+			var dst string
+			if c.SnapshotDir != "" {
+				dst = filepath.Join(c.SnapshotDir, volumeData.Id)
+			}
+			snapshot, err := snapshotVolume(c.Snapshot, v.Path, dst, volumeData.Type)
+			if err != nil {
+				slog.Warn("Failed to snapshot volume, backing up its live files", "volume", v.Path, "error", err)
+				volumeData.Snapshot = SnapshotLive
+				return nil
+			}
+			slog.Info("Volume snapshotted", "volume", v.Path, "strategy", snapshot.Strategy, "path", snapshot.Path)
+			snapshots = append(snapshots, snapshot)
+			srcs[i] = snapshot.Path
+			volumeData.Snapshot = snapshot.Strategy
+			return nil
+		})
+		if err != nil {
+			return nil, nil, errors.Join(err, remove())
+		}
+	}
+	return srcs, remove, nil
+}
+
+// snapshotVolume makes a snapshot of the volume at path with the strategy, at
+// dst or at the default place of the snapshots if dst is empty.
+func snapshotVolume(strategy, path, dst, volumeType string) (*backuptar.Snapshot, error) {
+	if volumeType == "file" {
+		if strategy == config.SnapshotBtrfs {
+			return nil, fmt.Errorf("btrfs snapshots are only made of directories")
+		}
+		return backuptar.SnapshotFile(path, dst)
+	}
+	switch strategy {
+	case config.SnapshotAuto:
+		return backuptar.SnapshotDir(path, dst, backuptar.SnapshotBtrfs, backuptar.SnapshotReflink)
+	case config.SnapshotBtrfs:
+		return backuptar.SnapshotDir(path, dst, backuptar.SnapshotBtrfs)
+	case config.SnapshotReflink:
+		return backuptar.SnapshotDir(path, dst, backuptar.SnapshotReflink)
+	default:
+		return nil, fmt.Errorf("unknown snapshot strategy %q", strategy)
+	}
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/chunkstore"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// backupSource reads the files of the backups, from the tar archive or from
+// the chunk store.
+type backupSource interface {
+	// ReadFile returns the content of the file at name, or an error wrapping
+	// backuptar.ErrFileNotFound if there is none.
+	ReadFile(name string) ([]byte, error)
+	// ReadChecksums returns the checksums of the files of the backup of
+	// prefix.
+	ReadChecksums(prefix string) ([]backuptar.FileChecksum, error)
+}
+
+// openBackupSource returns the source of the backups of the configuration, the
+// archive at tarPath by default, and a function releasing it. A backup of a storage is downloaded to a
+// temporary file, as reading it requires seeking the archive.
+func openBackupSource(c *config.Config, tarPath string, opts []backuptar.ExtractOption) (backupSource, func(), error) {
+	switch {
+	case c.ChunkStore != nil:
+		repo, err := chunkstore.Open(c.ChunkStore.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &snapshotSource{repo: repo, snapshot: c.Prefix}, func() {}, nil
+	case c.Storage != nil:
+		storage, err := NewStorage(c.Storage)
+		if err != nil {
+			return nil, nil, err
+		}
+		objectPath, remove, err := downloadObject(storage, objectName(c))
+		if err != nil {
+			return nil, nil, err
+		}
+		return tarSource(objectPath, opts), remove, nil
+	default:
+		return tarSource(tarPath, opts), func() {}, nil
+	}
+}
+
+// archiveSource reads the backups of a tar archive.
+type archiveSource struct {
+	tarPath string
+	opts    []backuptar.ExtractOption
+}
+
+func tarSource(tarPath string, opts []backuptar.ExtractOption) *archiveSource {
+	return &archiveSource{tarPath: tarPath, opts: opts}
+}
+
+func (s *archiveSource) ReadFile(name string) ([]byte, error) {
+	return backuptar.ReadFile(s.tarPath, name, s.opts...)
+}
+
+func (s *archiveSource) ReadChecksums(prefix string) ([]backuptar.FileChecksum, error) {
+	return backuptar.ReadChecksums(s.tarPath, prefix, s.opts...)
+}
+
+// snapshotSource reads the backup of a prefix from its snapshot in a chunk
+// store repository.
+type snapshotSource struct {
+	repo     *chunkstore.Repository
+	snapshot string
+}
+
+func (s *snapshotSource) ReadFile(name string) ([]byte, error) {
+	return s.repo.ReadFile(s.snapshot, name)
+}
+
+func (s *snapshotSource) ReadChecksums(prefix string) ([]backuptar.FileChecksum, error) {
+	return s.repo.ReadChecksums(prefix)
+}
@@ -0,0 +1,304 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// ErrObjectNotFound is returned by the storages when an object does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// Storage stores the backups as objects of their own, by name. Names are
+// slash-separated paths.
+type Storage interface {
+	// Put stores the content read from r as the object name, replacing any
+	// object of the same name. The object is only stored if r is read
+	// without error.
+	Put(name string, r io.Reader) error
+	// Get returns a reader of the object name, which must be closed.
+	Get(name string) (io.ReadCloser, error)
+	// List returns the names of the objects starting with prefix, sorted.
+	List(prefix string) ([]string, error)
+	// Delete removes the object name.
+	Delete(name string) error
+}
+
+// NewStorage returns the storage configured by s.
+func NewStorage(s *config.Storage) (Storage, error) {
+	switch s.Type {
+	case "local":
+		return NewDirStorage(s.Local.Path), nil
+	case "s3":
+		return newS3StorageFromConfig(s.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", s.Type)
+	}
+}
+
+// objectName returns the name of the object holding the backup of the prefix
+// of the configuration, an archive like the ones written with
+// BackupOptions.Output.
+func objectName(c *config.Config) string {
+	return c.Prefix + ".tar"
+}
+
+// backupToStorage writes the backup as a new archive stored as the object of
+// the prefix in the configured storage.
+func backupToStorage(c *config.Config, opts BackupOptions, writerOpts []backuptar.WriterOption) error {
+	if opts.Output != nil {
+		return errors.New("backups to a storage can't be written to an output")
+	}
+	if opts.Base != "" {
+		return errors.New("incremental backups can't be stored in a storage, their base must be in the same archive")
+	}
+	storage, err := NewStorage(c.Storage)
+	if err != nil {
+		return err
+	}
+	volumesData, err := newVolumesData(c, nil)
+	if err != nil {
+		return err
+	}
+
+	// The archive is streamed to the storage as it is written
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		backupWriter, err := backuptar.NewStreamWriter(pw, writerOpts...)
+		if err == nil {
+			err = writeBackup(c, backupWriter, volumesData, nil, false)
+			if err != nil {
+				err = errors.Join(err, backupWriter.Abort())
+			} else {
+				err = backupWriter.Close()
+			}
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	slog.Info("Storing backup", "storage", c.Storage.Type, "object", objectName(c))
+	err = storage.Put(objectName(c), pr)
+	// Stop the writer if the storage failed before reading the whole archive
+	pr.CloseWithError(err)
+	writeErr := <-done
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// restoreFromStorage restores the backup stored as the object of the prefix
+// in the configured storage.
+func restoreFromStorage(c *config.Config, opts RestoreOptions, extractOpts []backuptar.ExtractOption) error {
+	if opts.Input != nil {
+		return errors.New("backups of a storage can't be restored from an input")
+	}
+	storage, err := NewStorage(c.Storage)
+	if err != nil {
+		return err
+	}
+	r, err := storage.Get(objectName(c))
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	}
+	defer r.Close()
+	slog.Info("Restoring backup from storage", "storage", c.Storage.Type, "object", objectName(c))
+	return restoreStream(c, r, opts, extractOpts)
+}
+
+// downloadObject copies the object name of storage to a temporary file, for
+// reads which need to seek the archive. The returned function removes the
+// file.
+func downloadObject(storage Storage, name string) (string, func(), error) {
+	r, err := storage.Get(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	f, err := os.CreateTemp("", "snapshotter-*.tar")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(f.Name()) }
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	return f.Name(), remove, nil
+}
+
+// listStorage returns the backups stored as objects in the configured
+// storage whose prefix is selected by match, sorted by prefix. Every object
+// is downloaded to be read.
+func listStorage(c *config.Config, match func(prefix string) bool, extractOpts []backuptar.ExtractOption) ([]BackupInfo, error) {
+	storage, err := NewStorage(c.Storage)
+	if err != nil {
+		return nil, err
+	}
+	names, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+	infos := []BackupInfo{}
+	for _, name := range names {
+		prefix, ok := strings.CutSuffix(name, ".tar")
+		if !ok || !match(prefix) {
+			continue
+		}
+		objectPath, remove, err := downloadObject(storage, name)
+		if err != nil {
+			return nil, err
+		}
+		// The object only holds the backup of its prefix
+		backups, err := listArchive(objectPath, func(p string) bool { return p == prefix }, extractOpts)
+		remove()
+		if err != nil {
+			return nil, fmt.Errorf("object %s: %w", name, err)
+		}
+		infos = append(infos, backups...)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Prefix < infos[j].Prefix
+	})
+	return infos, nil
+}
+
+// pruneStorage removes the object holding the backup of prefix from the
+// configured storage. Backups of a storage are never incremental, no other
+// backup depends on it.
+func pruneStorage(c *config.Config, prefix string) error {
+	storage, err := NewStorage(c.Storage)
+	if err != nil {
+		return err
+	}
+	name := prefix + ".tar"
+	if err := storage.Delete(name); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return fmt.Errorf("no backup found for prefix %q", prefix)
+		}
+		return err
+	}
+	slog.Info("Backup pruned", "prefix", prefix, "storage", c.Storage.Type, "object", name)
+	return nil
+}
+
+// DirStorage stores the objects as files under a local directory.
+type DirStorage struct {
+	dir string
+}
+
+// NewDirStorage returns a storage of the objects under the directory dir,
+// which is created by the first Put.
+func NewDirStorage(dir string) *DirStorage {
+	return &DirStorage{dir: dir}
+}
+
+// path returns the path of the file of the object name, which must not
+// escape the directory.
+func (s *DirStorage) path(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" || clean != "/"+name {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// Put writes the object to a temporary file renamed once complete, so that an
+// interrupted Put does not replace the object.
+func (s *DirStorage) Put(name string, r io.Reader) error {
+	objectPath, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(objectPath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), objectPath)
+}
+
+func (s *DirStorage) Get(name string) (io.ReadCloser, error) {
+	objectPath, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(objectPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	return f, err
+}
+
+func (s *DirStorage) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(s.dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && file == s.dir {
+				return nil
+			}
+			return err
+		}
+		// Skip the temporary files of the ongoing Put calls
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		relPath, err := filepath.Rel(s.dir, file)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(relPath); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *DirStorage) Delete(name string) error {
+	objectPath, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(objectPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	return err
+}
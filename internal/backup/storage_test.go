@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirStorage(t *testing.T) {
+	s := NewDirStorage(filepath.Join(t.TempDir(), "storage"))
+
+	names, err := s.List("")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	require.NoError(t, s.Put("prefix/a.tar", bytes.NewReader([]byte("a"))))
+	require.NoError(t, s.Put("prefix/b.tar", bytes.NewReader([]byte("b"))))
+	require.NoError(t, s.Put("other.tar", bytes.NewReader([]byte("other"))))
+	// Objects are replaced
+	require.NoError(t, s.Put("prefix/a.tar", bytes.NewReader([]byte("new a"))))
+
+	r, err := s.Get("prefix/a.tar")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, []byte("new a"), got)
+	_, err = s.Get("prefix/missing.tar")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	names, err = s.List("prefix/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"prefix/a.tar", "prefix/b.tar"}, names)
+
+	require.NoError(t, s.Delete("prefix/a.tar"))
+	assert.ErrorIs(t, s.Delete("prefix/a.tar"), ErrObjectNotFound)
+	names, err = s.List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"other.tar", "prefix/b.tar"}, names)
+
+	// Names can't escape the directory
+	for _, name := range []string{"../escape.tar", "/abs.tar", "a/../b.tar", ""} {
+		assert.Error(t, s.Put(name, bytes.NewReader(nil)), name)
+	}
+}
+
+func TestBackup_Storage(t *testing.T) {
+	_, server := newFakeS3(t, "backups")
+	t.Setenv(AWSAccessKeyIDEnv, "AKID")
+	t.Setenv(AWSSecretAccessKeyEnv, "secret")
+
+	tc := []struct {
+		name    string
+		storage func(t *testing.T) *config.Storage
+	}{
+		{
+			name: "local",
+			storage: func(t *testing.T) *config.Storage {
+				return &config.Storage{Type: "local", Local: &config.LocalStorage{Path: t.TempDir()}}
+			},
+		},
+		{
+			name: "s3",
+			storage: func(t *testing.T) *config.Storage {
+				return &config.Storage{Type: "s3", S3: &config.S3Storage{Endpoint: server.URL, Bucket: "backups"}}
+			},
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			volumeDir := filepath.Join(tmpDir, "volume")
+			require.NoError(t, os.MkdirAll(filepath.Join(volumeDir, "dir"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(volumeDir, "dir", "file.txt"), []byte("dir data"), 0o644))
+			volumeFile := filepath.Join(tmpDir, "volume.txt")
+			require.NoError(t, os.WriteFile(volumeFile, []byte("file data"), 0o644))
+
+			c := &config.Config{
+				Prefix:  "prefix/" + tt.name,
+				Volumes: []config.Volume{{Path: volumeDir}, {Path: volumeFile}},
+				Storage: tt.storage(t),
+			}
+			require.NoError(t, Backup(c, backuptar.Path, BackupOptions{}))
+			require.NoError(t, Verify(c, backuptar.Path, VerifyOptions{}))
+
+			require.NoError(t, os.RemoveAll(filepath.Join(volumeDir, "dir")))
+			require.NoError(t, os.WriteFile(filepath.Join(volumeDir, "new.txt"), nil, 0o644))
+			require.NoError(t, os.WriteFile(volumeFile, []byte("changed"), 0o644))
+			require.NoError(t, Restore(c, backuptar.Path, RestoreOptions{NoSameOwner: true}))
+
+			got, err := os.ReadFile(filepath.Join(volumeDir, "dir", "file.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("dir data"), got)
+			assert.NoFileExists(t, filepath.Join(volumeDir, "new.txt"))
+			got, err = os.ReadFile(volumeFile)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("file data"), got)
+
+			// The backups are listed and pruned in the storage
+			backups, err := List(c, backuptar.Path, ListOptions{})
+			require.NoError(t, err)
+			require.Len(t, backups, 1)
+			assert.Equal(t, c.Prefix, backups[0].Prefix)
+			assert.Equal(t, []VolumeInfo{
+				{Id: volumeId(volumeDir), Type: "dir", Target: volumeDir, Files: 1, Size: 8},
+				{Id: volumeId(volumeFile), Type: "file", Target: volumeFile, Files: 1, Size: 9},
+			}, backups[0].Volumes)
+			backups, err = List(c, backuptar.Path, ListOptions{Prefix: "other/*"})
+			require.NoError(t, err)
+			assert.Empty(t, backups)
+			require.NoError(t, Prune(c, backuptar.Path, c.Prefix))
+			backups, err = List(c, backuptar.Path, ListOptions{})
+			require.NoError(t, err)
+			assert.Empty(t, backups)
+			assert.ErrorContains(t, Prune(c, backuptar.Path, c.Prefix), "no backup found")
+		})
+	}
+}
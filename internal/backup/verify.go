@@ -0,0 +1,202 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+)
+
+// ErrVerificationFailed is returned by Verify when files don't match the
+// manifest.
+var ErrVerificationFailed = errors.New("backup verification failed")
+
+// VerifyOptions configures the verification of a backup.
+type VerifyOptions struct {
+	// Live also compares the files of the volume targets with the manifest,
+	// to check that a restore reproduced them.
+	Live bool
+}
+
+// Verify checks the files of the backup against its manifest, and the files
+// of the volume targets as well with opts.Live. Every mismatch is logged, and
+// ErrVerificationFailed is returned if there is any. The backup is read from
+// the archive at tarPath, unless the configuration stores it elsewhere.
+func Verify(c *config.Config, tarPath string, opts VerifyOptions) error {
+	identities, err := encryptionIdentities(c)
+	if err != nil {
+		return err
+	}
+	extractOpts := []backuptar.ExtractOption{backuptar.WithIdentities(identities...)}
+	src, release, err := openBackupSource(c, tarPath, extractOpts)
+	if err != nil {
+		return err
+	}
+	defer release()
+	volumesData, err := readVolumesData(src, VolumesDataPath(c))
+	if err != nil {
+		return err
+	}
+	if volumesData == nil {
+		return fmt.Errorf("no backup found for prefix %q", c.Prefix)
+	}
+	manifest, err := readManifest(src, ManifestPath(c))
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("backup of prefix %q has no manifest", c.Prefix)
+	}
+
+	slog.Info("Verifying backup", "prefix", c.Prefix)
+	checksums, err := src.ReadChecksums(c.Prefix)
+	if err != nil {
+		return err
+	}
+	// Incremental backups keep the files unchanged since their base in the
+	// base backups
+	storedChecksums := checksums
+	for _, prefix := range basePrefixes(c.Prefix, manifest) {
+		baseChecksums, err := src.ReadChecksums(prefix)
+		if err != nil {
+			return err
+		}
+		storedChecksums = append(storedChecksums, baseChecksums...)
+	}
+	// Files of the archive, by path
+	archived := make(map[string]backuptar.FileChecksum, len(storedChecksums))
+	for _, checksum := range storedChecksums {
+		// Like the manifest, the first entry of a path is used
+		if _, ok := archived[checksum.Name]; !ok {
+			archived[checksum.Name] = checksum
+		}
+	}
+
+	mismatches := 0
+	mismatch := func(path, reason string) {
+		slog.Error("File does not match the manifest", "path", path, "reason", reason)
+		mismatches++
+	}
+	inManifest := make(map[string]bool, len(manifest))
+	for _, entry := range manifest {
+		stored := entry.Path
+		if entry.Stored != "" {
+			stored = entry.Stored
+		}
+		inManifest[stored] = true
+		checksum, ok := archived[stored]
+		if !ok {
+			mismatch(stored, "missing from the archive")
+			continue
+		}
+		if reason := compareChecksum(entry, checksum.Size, checksum.SHA256); reason != "" {
+			mismatch(stored, reason)
+		}
+	}
+	// Files of the volumes missing from the manifest
+	for _, v := range volumesData {
+		volumePath := filepath.Join(c.Prefix, v.Id)
+		for _, checksum := range checksums {
+			if inManifest[checksum.Name] || !isVolumeFile(volumePath, checksum.Name) {
+				continue
+			}
+			if checksum.Whiteout && v.Base != "" {
+				continue
+			}
+			mismatch(checksum.Name, "missing from the manifest")
+		}
+	}
+
+	if opts.Live {
+		for _, v := range volumesData {
+			slog.Info("Verifying volume", "target", v.Target)
+			volumePath := filepath.Join(c.Prefix, v.Id)
+			for _, entry := range manifest {
+				if !isVolumeFile(volumePath, entry.Path) {
+					continue
+				}
+				relPath, err := filepath.Rel(volumePath, entry.Path)
+				if err != nil {
+					return err
+				}
+				target := filepath.Join(v.Target, relPath)
+				size, sum, err := fileChecksum(target)
+				if err != nil {
+					mismatch(target, err.Error())
+					continue
+				}
+				if reason := compareChecksum(entry, size, sum); reason != "" {
+					mismatch(target, reason)
+				}
+			}
+		}
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("%w: %d files do not match the manifest", ErrVerificationFailed, mismatches)
+	}
+	slog.Info("Backup verified", "files", len(manifest))
+	return nil
+}
+
+// basePrefixes returns the prefixes of the base backups storing the files of
+// the manifest of the backup of the given prefix, in a stable order.
+func basePrefixes(prefix string, manifest []ManifestEntry) []string {
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, entry := range manifest {
+		if entry.Stored == "" {
+			continue
+		}
+		// Files keep their path relative to the prefix across backups
+		base := strings.TrimSuffix(entry.Stored, strings.TrimPrefix(entry.Path, prefix))
+		if !seen[base] {
+			seen[base] = true
+			prefixes = append(prefixes, base)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// isVolumeFile reports whether the file at path in the archive belongs to the
+// volume stored at volumePath.
+func isVolumeFile(volumePath, path string) bool {
+	return path == volumePath || strings.HasPrefix(path, volumePath+"/")
+}
+
+// compareChecksum returns why a file of the given size and SHA-256 checksum
+// does not match entry, or an empty string if it does.
+func compareChecksum(entry ManifestEntry, size int64, sum string) string {
+	if size != entry.Size {
+		return fmt.Sprintf("size is %d instead of %d", size, entry.Size)
+	}
+	if sum != entry.SHA256 {
+		return fmt.Sprintf("sha256 is %s instead of %s", sum, entry.SHA256)
+	}
+	return ""
+}
+
+// fileChecksum returns the size and the SHA-256 checksum of the file at path.
+func fileChecksum(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
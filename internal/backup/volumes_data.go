@@ -1,11 +1,16 @@
 package backup
 
 import (
-	"archive/tar"
-	"io"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
 	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
 	"gopkg.in/yaml.v2"
 )
@@ -14,10 +19,106 @@ const (
 	VolumesDataFileName = "volumes-data.yml"
 )
 
+// MetadataVersion is the version of the metadata of the backups written by
+// this version of the snapshotter. Backups with metadata of later versions
+// are refused when restored or verified, as they could be misread.
+const MetadataVersion = "v1"
+
+// ErrUnsupportedMetadata is returned when the metadata of a backup has a
+// version this version of the snapshotter does not know.
+var ErrUnsupportedMetadata = errors.New("unsupported backup metadata version")
+
+// Version is the version of the snapshotter recorded in the metadata of the
+// backups. It is set at build time with -ldflags "-X
+// github.com/NethermindEth/docker-volumes-snapshotter/internal/backup.Version=v1.2.3",
+// or read from the build information of the binary otherwise.
+var Version string
+
+// snapshotterVersion returns the version of the snapshotter.
+func snapshotterVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// Metadata describes a backup, it is stored in the volumes data file of its
+// prefix, before the volumes. The backups of earlier versions only stored the
+// list of the volumes, which is read as metadata without a version.
+type Metadata struct {
+	// APIVersion is the version of the metadata format, empty for the legacy
+	// list of the volumes.
+	APIVersion string `yaml:"apiVersion"`
+	// CreatedAt is the time the backup started.
+	CreatedAt time.Time `yaml:"createdAt"`
+	// SnapshotterVersion is the version of the snapshotter which made the
+	// backup.
+	SnapshotterVersion string `yaml:"snapshotterVersion"`
+	// Hostname is the host name of the machine, or of the container, which
+	// made the backup.
+	Hostname string       `yaml:"hostname,omitempty"`
+	Prefix   string       `yaml:"prefix"`
+	Volumes  []VolumeData `yaml:"volumes"`
+}
+
+// newMetadata returns the metadata of the backup of the configuration c, with
+// the data of its volumes.
+func newMetadata(c *config.Config, volumesData []VolumeData) *Metadata {
+	// The host name is left out if it can't be read
+	hostname, _ := os.Hostname()
+	return &Metadata{
+		APIVersion:         MetadataVersion,
+		CreatedAt:          time.Now().UTC().Truncate(time.Second),
+		SnapshotterVersion: snapshotterVersion(),
+		Hostname:           hostname,
+		Prefix:             c.Prefix,
+		Volumes:            volumesData,
+	}
+}
+
 type VolumeData struct {
 	Id     string `yaml:"id"`
 	Type   string `yaml:"type"`
 	Target string `yaml:"target"`
+	// Base is the prefix of the backup an incremental backup of the volume
+	// is based on, it is empty for a full backup of the volume.
+	Base string `yaml:"base,omitempty"`
+	// Snapshot is the strategy of the snapshot the volume was backed up
+	// from, SnapshotLive if none could be made. It is empty if snapshots
+	// were not enabled.
+	Snapshot string `yaml:"snapshot,omitempty"`
+	// Stats counts the files of the volume, including the ones stored by
+	// its base backup. It is not set by the legacy format.
+	Stats *VolumeStats `yaml:"stats,omitempty"`
+	// Options are the options the volume was backed up with, if it had any.
+	Options *VolumeOptions `yaml:"options,omitempty"`
+}
+
+// VolumeStats counts the files of a volume.
+type VolumeStats struct {
+	// Files is the number of regular files.
+	Files int `yaml:"files"`
+	// Size is the total size of the regular files, hard links counted once.
+	Size int64 `yaml:"size"`
+}
+
+// VolumeOptions are the options of the configuration of a volume its backup
+// depends on.
+type VolumeOptions struct {
+	Xattrs  bool     `yaml:"xattrs,omitempty"`
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// volumeOptions returns the options of the volume v, or nil if it has none.
+func volumeOptions(v config.Volume) *VolumeOptions {
+	if !v.Xattrs && len(v.Include) == 0 && len(v.Exclude) == 0 {
+		return nil
+	}
+	return &VolumeOptions{Xattrs: v.Xattrs, Include: v.Include, Exclude: v.Exclude}
 }
 
 // VolumesDataPath returns the path the volumes data file in the tar archive.
@@ -27,33 +128,101 @@ func VolumesDataPath(c *config.Config) string {
 
 // GetVolumesData returns volumes data from volumesDataPath in the tar archive
 // at tarPath. Volume data is stored at the root of the prefix path defined in
-// the config file.
-func GetVolumesData(tarPath string, volumesDataPath string) ([]VolumeData, error) {
-	tarFile, err := os.Open(tarPath)
+// the config file. Both the metadata and the legacy list of the volumes are
+// read.
+func GetVolumesData(tarPath string, volumesDataPath string, opts ...backuptar.ExtractOption) ([]VolumeData, error) {
+	return readVolumesData(tarSource(tarPath, opts), volumesDataPath)
+}
+
+// GetMetadata returns the metadata of the backup from volumesDataPath in the
+// tar archive at tarPath, or nil if there is none.
+func GetMetadata(tarPath string, volumesDataPath string, opts ...backuptar.ExtractOption) (*Metadata, error) {
+	return readMetadata(tarSource(tarPath, opts), volumesDataPath)
+}
+
+// readVolumesData returns the volumes data from volumesDataPath in src, or nil
+// if there is none.
+func readVolumesData(src backupSource, volumesDataPath string) ([]VolumeData, error) {
+	metadata, err := readMetadata(src, volumesDataPath)
+	if err != nil || metadata == nil {
+		return nil, err
+	}
+	return metadata.Volumes, nil
+}
+
+// readMetadata returns the metadata from volumesDataPath in src, or nil if
+// there is none.
+func readMetadata(src backupSource, volumesDataPath string) (*Metadata, error) {
+	data, err := src.ReadFile(volumesDataPath)
 	if err != nil {
+		if errors.Is(err, backuptar.ErrFileNotFound) {
+			return nil, nil
+		}
 		return nil, err
 	}
-	defer tarFile.Close()
-	tarReader := tar.NewReader(tarFile)
-	for {
-		header, err := tarReader.Next()
-		if err != nil {
-			if err == io.EOF {
-				return nil, nil
-			}
+	metadata, err := parseMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", volumesDataPath, err)
+	}
+	return metadata, nil
+}
+
+// parseMetadata decodes the metadata of a backup, or the legacy list of its
+// volumes. Metadata of a later version is refused.
+func parseMetadata(data []byte) (*Metadata, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if _, ok := doc.([]interface{}); ok || doc == nil {
+		var volumesData []VolumeData
+		if err := yaml.Unmarshal(data, &volumesData); err != nil {
 			return nil, err
 		}
-		if header.Name == volumesDataPath {
-			data, err := io.ReadAll(tarReader)
-			if err != nil {
-				return nil, err
-			}
-			var volumesData []VolumeData
-			err = yaml.Unmarshal(data, &volumesData)
-			if err != nil {
-				return nil, err
-			}
-			return volumesData, nil
-		}
+		return &Metadata{Volumes: volumesData}, nil
+	}
+	// The version is checked before the rest is decoded, as its format may
+	// have changed
+	var version struct {
+		APIVersion string `yaml:"apiVersion"`
+	}
+	if err := yaml.Unmarshal(data, &version); err != nil {
+		return nil, err
+	}
+	if err := checkMetadataVersion(version.APIVersion); err != nil {
+		return nil, err
+	}
+	var metadata Metadata
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// checkMetadataVersion returns an error if the metadata version is not known
+// to this version of the snapshotter.
+func checkMetadataVersion(version string) error {
+	n, err := metadataVersionNumber(version)
+	if err != nil {
+		return fmt.Errorf("%w %q", ErrUnsupportedMetadata, version)
+	}
+	latest, _ := metadataVersionNumber(MetadataVersion)
+	if n > latest {
+		return fmt.Errorf("%w %s, this snapshotter (%s) reads up to %s, upgrade it to read the backup", ErrUnsupportedMetadata, version, snapshotterVersion(), MetadataVersion)
+	}
+	return nil
+}
+
+// metadataVersionNumber returns the number of a metadata version, such as 1
+// for v1.
+func metadataVersionNumber(version string) (int, error) {
+	number, ok := strings.CutPrefix(version, "v")
+	if !ok {
+		return 0, errors.New("version must start with v")
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid version %q", version)
 	}
+	return n, nil
 }
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(filepath.Join(volume, "chaindata"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "chaindata", "000001.ldb"), []byte("ldb"), 0o644))
+	require.NoError(t, os.Link(filepath.Join(volume, "chaindata", "000001.ldb"), filepath.Join(volume, "linked.ldb")))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "geth.log"), []byte("log"), 0o644))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	c := &config.Config{
+		Prefix:  "node",
+		Volumes: []config.Volume{{Path: volume, Exclude: []string{"*.log"}}},
+	}
+	before := time.Now().Add(-time.Second)
+	require.NoError(t, Backup(c, tarPath, BackupOptions{}))
+	metadata, err := GetMetadata(tarPath, VolumesDataPath(c))
+	require.NoError(t, err)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, MetadataVersion, metadata.APIVersion)
+	assert.Equal(t, "node", metadata.Prefix)
+	assert.Equal(t, hostname, metadata.Hostname)
+	assert.NotEmpty(t, metadata.SnapshotterVersion)
+	assert.WithinRange(t, metadata.CreatedAt, before, time.Now())
+	require.Len(t, metadata.Volumes, 1)
+	assert.Equal(t, VolumeData{
+		Id:      volumeId(volume),
+		Type:    "dir",
+		Target:  volume,
+		Stats:   &VolumeStats{Files: 1, Size: 3},
+		Options: &VolumeOptions{Exclude: []string{"*.log"}},
+	}, metadata.Volumes[0])
+
+	// The stats of a backup streamed with its metadata first are known too
+	var out bytes.Buffer
+	require.NoError(t, Backup(c, tarPath, BackupOptions{Output: &out}))
+	streamPath := filepath.Join(tmpDir, "stream.tar")
+	require.NoError(t, os.WriteFile(streamPath, out.Bytes(), 0o644))
+	metadata, err = GetMetadata(streamPath, VolumesDataPath(c))
+	require.NoError(t, err)
+	require.Len(t, metadata.Volumes, 1)
+	assert.Equal(t, &VolumeStats{Files: 1, Size: 3}, metadata.Volumes[0].Stats)
+}
+
+func TestRestore_Metadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	require.NoError(t, os.MkdirAll(volume, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(volume, "data"), []byte("data"), 0o644))
+	tarPath := filepath.Join(tmpDir, "backup.tar")
+	require.NoError(t, backuptar.InitBackupTar(tarPath))
+
+	// writeBackup writes a backup of the volume with the given volumes data
+	// file content
+	writeBackup := func(prefix string, volumesData interface{}) *config.Config {
+		c := &config.Config{Prefix: prefix, Volumes: []config.Volume{{Path: volume}}}
+		backupWriter, err := backuptar.NewBackupWriter(tarPath)
+		require.NoError(t, err)
+		require.NoError(t, addYAML(backupWriter, volumesData, VolumesDataPath(c)))
+		require.NoError(t, backupWriter.AddDir(volume, filepath.Join(prefix, volumeId(volume))))
+		require.NoError(t, backupWriter.Close())
+		return c
+	}
+	volumesData := []VolumeData{{Id: volumeId(volume), Type: "dir", Target: volume}}
+
+	tc := []struct {
+		name        string
+		volumesData interface{}
+		err         string
+	}{
+		{
+			name:        "legacy",
+			volumesData: volumesData,
+		},
+		{
+			name:        "current",
+			volumesData: &Metadata{APIVersion: MetadataVersion, Prefix: "current", Volumes: volumesData},
+		},
+		{
+			name:        "future",
+			volumesData: map[string]interface{}{"apiVersion": "v2", "volumes": map[string]string{"id": "changed"}},
+			err:         "unsupported backup metadata version v2, this snapshotter",
+		},
+		{
+			name:        "invalid",
+			volumesData: map[string]interface{}{"apiVersion": "beta"},
+			err:         `unsupported backup metadata version "beta"`,
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			c := writeBackup(tt.name, tt.volumesData)
+			to := t.TempDir()
+			err := Restore(c, tarPath, RestoreOptions{To: to})
+			if tt.err != "" {
+				assert.ErrorIs(t, err, ErrUnsupportedMetadata)
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			data, err := os.ReadFile(filepath.Join(to, volume, "data"))
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+			got, err := GetVolumesData(tarPath, VolumesDataPath(c))
+			require.NoError(t, err)
+			assert.Equal(t, volumesData, got)
+		})
+	}
+}
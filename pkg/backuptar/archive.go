@@ -0,0 +1,152 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// fileCompression returns the compression of the archive file f.
+func fileCompression(f *os.File) (Compression, error) {
+	magic := make([]byte, len(zstdMagic))
+	n, err := f.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return detectCompression(magic[:n]), nil
+}
+
+// errStopWalk stops walkArchive without error.
+var errStopWalk = errors.New("stop walking the archive")
+
+// walkArchive calls fn with the header and the content of the entries of the
+// archive at tarPath whose name matches, in the order of the archive. The
+// index of the archive is used to only read the matching entries, it is built
+// first if it is missing or stale. The walk stops at the first error returned
+// by fn, and errStopWalk stops it without error.
+func walkArchive(tarPath string, match func(name string) bool, fn func(header *tar.Header, r io.Reader) error) error {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	compression, err := fileCompression(file)
+	if err != nil {
+		return err
+	}
+	idx, err := openIndex(file, tarPath, compression)
+	if err != nil {
+		return err
+	}
+
+	var (
+		tarReader *tar.Reader
+		stream    io.ReadCloser
+		// next is the index entry tarReader reads next
+		next int
+	)
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
+	for i, entry := range idx.Entries {
+		if !match(entry.Name) {
+			continue
+		}
+		switch {
+		case tarReader != nil && next == i:
+			// Following entry
+		case tarReader != nil && compression != CompressionNone && next < i && idx.Entries[next].Offset == entry.Offset:
+			// Later entry of the same member, read up to it
+			for ; next < i; next++ {
+				if _, err := tarReader.Next(); err != nil {
+					return err
+				}
+			}
+		default:
+			if stream != nil {
+				stream.Close()
+			}
+			section := io.NewSectionReader(file, entry.Offset, fi.Size()-entry.Offset)
+			if compression == CompressionNone {
+				// Read the file directly, the tar reader seeks over skipped
+				// content
+				stream = io.NopCloser(section)
+				tarReader = tar.NewReader(section)
+			} else {
+				stream, err = newDecompressor(section, compression)
+				if err != nil {
+					return err
+				}
+				if _, err := io.CopyN(io.Discard, stream, entry.Skip); err != nil {
+					return fmt.Errorf("failed to seek entry %s: %w", entry.Name, err)
+				}
+				tarReader = tar.NewReader(stream)
+			}
+			next = i
+		}
+		header, err := tarReader.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read entry %s: %w", entry.Name, err)
+		}
+		next++
+		if header.Name != entry.Name {
+			// The archive was modified without changing its size and time
+			dropIndex(tarPath)
+			return fmt.Errorf("%w: found %s instead of %s", ErrInvalidIndex, header.Name, entry.Name)
+		}
+		err = fn(header, tarReader)
+		if err != nil {
+			if err == errStopWalk {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// EntryNames returns the names of the entries of the archive at tarPath under
+// the directory prefix, or all of them if prefix is empty, in the order of
+// the archive. They are read from the
+// index of the archive, which is built first if it is missing or stale.
+func EntryNames(tarPath, prefix string) ([]string, error) {
+	return entryNames(tarPath, prefix, func(indexEntry) bool { return true })
+}
+
+// Whiteouts is like EntryNames, for the whiteout entries only.
+func Whiteouts(tarPath, prefix string) ([]string, error) {
+	return entryNames(tarPath, prefix, func(entry indexEntry) bool { return entry.Whiteout })
+}
+
+// entryNames returns the names of the entries under prefix selected by keep.
+func entryNames(tarPath, prefix string, keep func(entry indexEntry) bool) ([]string, error) {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	compression, err := fileCompression(file)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := openIndex(file, tarPath, compression)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range idx.Entries {
+		if (prefix == "" || entry.Name == prefix || strings.HasPrefix(entry.Name, prefix+"/")) && keep(entry) {
+			names = append(names, entry.Name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package backuptar
+
+import (
+	"os"
+	"time"
+)
+
+// lchtimes changes the access and modification times of path. Symbolic links
+// are left untouched, as their times can't be changed on this platform.
+func lchtimes(path string, atime, mtime time.Time) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(path, atime, mtime)
+}
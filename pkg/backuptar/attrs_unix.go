@@ -0,0 +1,16 @@
+//go:build unix
+
+package backuptar
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lchtimes changes the access and modification times of path without
+// following symbolic links.
+func lchtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,96 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+// FileChecksum is the size, the modification time and the SHA-256 checksum
+// of the content of a regular file entry. The content of sparse files
+// includes their holes, and the one of encrypted files is the plaintext. The
+// writer records the modification time of the source file, the archive only
+// stores it to the second in GNU tar headers. Whiteout is set for the
+// whiteout entries read from an archive.
+type FileChecksum struct {
+	Name     string
+	Size     int64
+	ModTime  time.Time
+	SHA256   string
+	Whiteout bool
+}
+
+// Checksums returns the checksums of the regular files written so far by the
+// writer, in the order they were written. Hard links are not included, they
+// share the content of the first entry of their file.
+func (b *BackupWriter) Checksums() []FileChecksum {
+	return append([]FileChecksum(nil), b.checksums...)
+}
+
+// addChecksum records the checksum h of the content of the entry described
+// by header.
+func (b *BackupWriter) addChecksum(header *tar.Header, h hash.Hash) {
+	b.checksums = append(b.checksums, FileChecksum{
+		Name:    header.Name,
+		Size:    header.Size,
+		ModTime: header.ModTime,
+		SHA256:  hex.EncodeToString(h.Sum(nil)),
+	})
+}
+
+// ReadChecksums reads the tar archive at tarPath and returns the checksums of
+// the regular files under the directory prefix, or of all of them if prefix
+// is empty. Encrypted files are decrypted with the identities given with
+// WithIdentities.
+func ReadChecksums(tarPath, prefix string, opts ...ExtractOption) ([]FileChecksum, error) {
+	extractor := newExtractor(opts)
+	match := func(name string) bool {
+		return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/")
+	}
+	var checksums []FileChecksum
+	err := walkArchive(tarPath, match, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		content, size, err := extractor.content(header, r)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, content)
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %w", header.Name, err)
+		}
+		if n != size {
+			return fmt.Errorf("failed to read file %s: read %d bytes instead of %d", header.Name, n, size)
+		}
+		_, whiteout := IsWhiteout(header)
+		checksums = append(checksums, FileChecksum{
+			Name:     header.Name,
+			Size:     size,
+			ModTime:  header.ModTime,
+			SHA256:   hex.EncodeToString(h.Sum(nil)),
+			Whiteout: whiteout,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// hashZeros writes n zero bytes to h, for the holes of sparse files.
+func hashZeros(h hash.Hash, n int64) {
+	var zeros [sparseBlockSize]byte
+	for n > 0 {
+		chunk := min(n, int64(len(zeros)))
+		h.Write(zeros[:chunk])
+		n -= chunk
+	}
+}
@@ -0,0 +1,102 @@
+package backuptar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksums(t *testing.T) {
+	key, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	tc := []struct {
+		name     string
+		opts     []WriterOption
+		readOpts []ExtractOption
+	}{
+		{
+			name: "plain",
+		},
+		{
+			name: "zstd",
+			opts: []WriterOption{WithCompression(CompressionZstd, 0)},
+		},
+		{
+			name:     "encrypted",
+			opts:     []WriterOption{WithEncryption(key.Recipient())},
+			readOpts: []ExtractOption{WithIdentities(key)},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			srcDir := filepath.Join(tmpDir, "src")
+			require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "dir"), 0o755))
+			files := map[string]string{
+				"file.txt":         "chain data",
+				"dir/keystore.txt": "keystore",
+				"dir/empty.txt":    "",
+			}
+			for name, content := range files {
+				require.NoError(t, os.WriteFile(filepath.Join(srcDir, name), []byte(content), 0o644))
+			}
+			require.NoError(t, os.Link(filepath.Join(srcDir, "file.txt"), filepath.Join(srcDir, "link.txt")))
+
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, InitBackupTar(tarPath))
+			backupWriter, err := NewBackupWriter(tarPath, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddDir(srcDir, "prefix/dir"))
+			require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, "file.txt"), "prefix/file"))
+			require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, "file.txt"), "other/file"))
+			written := backupWriter.Checksums()
+			require.NoError(t, backupWriter.Close())
+
+			// The hard link shares the checksum of the first entry
+			require.Len(t, written, len(files)+2)
+			for _, c := range written[:len(files)] {
+				relPath, err := filepath.Rel("prefix/dir", c.Name)
+				require.NoError(t, err)
+				content, ok := files[relPath]
+				require.True(t, ok, "unexpected checksum for %s", c.Name)
+				sum := sha256.Sum256([]byte(content))
+				assert.Equal(t, hex.EncodeToString(sum[:]), c.SHA256, c.Name)
+				assert.Equal(t, int64(len(content)), c.Size, c.Name)
+			}
+
+			fi, err := os.Stat(filepath.Join(srcDir, "file.txt"))
+			require.NoError(t, err)
+			assert.True(t, fi.ModTime().Equal(written[len(files)].ModTime))
+
+			read, err := ReadChecksums(tarPath, "prefix", tt.readOpts...)
+			require.NoError(t, err)
+			assertChecksums(t, written[:len(files)+1], read)
+
+			read, err = ReadChecksums(tarPath, "", tt.readOpts...)
+			require.NoError(t, err)
+			assertChecksums(t, written, read)
+		})
+	}
+}
+
+// assertChecksums asserts that the checksums are equal, with modification
+// times compared to the second, the precision of GNU tar headers.
+func assertChecksums(t *testing.T, expected, actual []FileChecksum) {
+	t.Helper()
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		e, a := expected[i], actual[i]
+		assert.True(t, e.ModTime.Truncate(time.Second).Equal(a.ModTime.Truncate(time.Second)), "modification time of %s", e.Name)
+		e.ModTime, a.ModTime = time.Time{}, time.Time{}
+		assert.Equal(t, e, a)
+	}
+}
@@ -0,0 +1,372 @@
+package backuptar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the compression algorithm of a backup archive.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ParseCompression returns the compression algorithm named name. An empty
+// name means no compression.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q", name)
+	}
+}
+
+// detectCompression returns the compression of the archive starting with
+// magic.
+func detectCompression(magic []byte) Compression {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// newCompressor returns a writer compressing into w a new member of an
+// archive compressed with c. A level of 0 selects the default level of the
+// algorithm.
+func newCompressor(w io.Writer, c Compression, level int) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// endOfArchive returns the end-of-archive marker of an archive compressed
+// with c: the two zero blocks of the tar format, compressed in a member of
+// their own so they can be found and removed to append to the archive.
+func endOfArchive(c Compression) ([]byte, error) {
+	var buf bytes.Buffer
+	compressor, err := newCompressor(&buf, c, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = compressor.Write(make([]byte, 2*TarBlockSize))
+	if err != nil {
+		return nil, err
+	}
+	err = compressor.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// maxEndOfArchiveSize bounds the size of an end-of-archive member, whatever
+// the settings it was compressed with: two stored blocks and the framing of
+// the member.
+const maxEndOfArchiveSize = 4 * TarBlockSize
+
+// findEndOfArchive returns the offset of the end-of-archive member ending the
+// archive f of the given size, compressed with c. The last member is found by
+// decompressing the candidate members at the end of the archive, it must hold
+// the two zero blocks of the tar format and nothing else, however it was
+// compressed.
+func findEndOfArchive(f io.ReaderAt, size int64, c Compression) (int64, error) {
+	start := size - maxEndOfArchiveSize
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, size-start)
+	if _, err := f.ReadAt(tail, start); err != nil && err != io.EOF {
+		return 0, err
+	}
+	magic := gzipMagic
+	if c == CompressionZstd {
+		magic = zstdMagic
+	}
+	// The smallest candidates are tried first, the magic number may also
+	// appear in the compressed data of the member
+	for i := bytes.LastIndex(tail, magic); i >= 0; i = bytes.LastIndex(tail[:i], magic) {
+		offset := start + int64(i)
+		if isEndOfArchive(f, offset, size, c) {
+			return offset, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: archive does not end with the end-of-archive member", ErrPrepareToAppend)
+}
+
+// isEndOfArchive reports whether the member at offset in f, compressed with
+// c, ends at size and holds only the two zero blocks of the tar format.
+func isEndOfArchive(f io.ReaderAt, offset, size int64, c Compression) bool {
+	var content io.Reader
+	// end returns the offset of the end of the member once read
+	var end func() int64
+	switch c {
+	case CompressionGzip:
+		counter := &countingReadSeeker{r: io.NewSectionReader(f, offset, size-offset)}
+		br := bufio.NewReader(counter)
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return false
+		}
+		zr.Multistream(false)
+		content = zr
+		end = func() int64 { return offset + counter.n - int64(br.Buffered()) }
+	case CompressionZstd:
+		frameSize, skippable, err := zstdFrameSize(f, offset)
+		if err != nil || skippable || offset+frameSize != size {
+			return false
+		}
+		decoder, err := zstd.NewReader(io.NewSectionReader(f, offset, frameSize), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return false
+		}
+		defer decoder.Close()
+		content = decoder
+		end = func() int64 { return offset + frameSize }
+	default:
+		return false
+	}
+	data, err := io.ReadAll(io.LimitReader(content, 2*TarBlockSize+1))
+	if err != nil || len(data) != 2*TarBlockSize || end() != size {
+		return false
+	}
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// newDecompressor returns a reader of the tar stream of an archive compressed
+// with c, read from r. Compressed archives are made of several members that
+// are read as a single stream.
+func newDecompressor(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// member is a compressed member of an archive.
+type member struct {
+	// offset is the position of the member in the archive file
+	offset int64
+	// start is the position of its content in the tar stream
+	start int64
+}
+
+// memberReader reads the tar stream of a compressed archive member by member,
+// to locate the entries in their members.
+type memberReader struct {
+	file        *os.File
+	size        int64
+	compression Compression
+	// members opened so far
+	members []member
+	// pos is the position in the tar stream
+	pos int64
+	// next is the offset of the next member to open
+	next int64
+
+	current    io.Reader
+	currentEnd func() int64
+	zstd       *zstd.Decoder
+}
+
+func newMemberReader(f *os.File, size int64, c Compression) *memberReader {
+	return &memberReader{file: f, size: size, compression: c}
+}
+
+func (m *memberReader) Read(p []byte) (int, error) {
+	for {
+		if m.current == nil {
+			if m.next >= m.size {
+				return 0, io.EOF
+			}
+			if err := m.open(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := m.current.Read(p)
+		m.pos += int64(n)
+		if err == io.EOF {
+			m.next = m.currentEnd()
+			m.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// open opens the member at m.next.
+func (m *memberReader) open() error {
+	offset := m.next
+	switch m.compression {
+	case CompressionGzip:
+		// gzip leaves a byte reader right after the member it read
+		counter := &countingReadSeeker{r: io.NewSectionReader(m.file, offset, m.size-offset)}
+		br := bufio.NewReader(counter)
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		zr.Multistream(false)
+		m.current = zr
+		m.currentEnd = func() int64 { return offset + counter.n - int64(br.Buffered()) }
+	case CompressionZstd:
+		size, skippable, err := zstdFrameSize(m.file, offset)
+		if err != nil {
+			return err
+		}
+		if skippable {
+			m.next += size
+			return nil
+		}
+		if m.zstd == nil {
+			m.zstd, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+		}
+		err = m.zstd.Reset(io.NewSectionReader(m.file, offset, size))
+		if err != nil {
+			return err
+		}
+		m.current = m.zstd
+		m.currentEnd = func() int64 { return offset + size }
+	default:
+		return fmt.Errorf("archive is not compressed")
+	}
+	m.members = append(m.members, member{offset: offset, start: m.pos})
+	return nil
+}
+
+// locate returns the offset of the member holding the position pos of the tar
+// stream, and the position of pos in its content. The member must be opened.
+func (m *memberReader) locate(pos int64) (int64, int64) {
+	i := sort.Search(len(m.members), func(i int) bool { return m.members[i].start > pos }) - 1
+	if i < 0 {
+		return 0, pos
+	}
+	return m.members[i].offset, pos - m.members[i].start
+}
+
+// Close releases the resources of the reader.
+func (m *memberReader) Close() {
+	if m.zstd != nil {
+		m.zstd.Close()
+	}
+}
+
+// zstdFrameSize returns the size of the zstd frame at offset in r, and
+// whether it is a skippable frame holding no data.
+func zstdFrameSize(r io.ReaderAt, offset int64) (int64, bool, error) {
+	var header [18]byte
+	n, err := r.ReadAt(header[:], offset)
+	if n < 6 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, false, fmt.Errorf("failed to read zstd frame header: %w", err)
+	}
+	magic := binary.LittleEndian.Uint32(header[:4])
+	if magic&0xfffffff0 == 0x184d2a50 {
+		return 8 + int64(binary.LittleEndian.Uint32(header[4:8])), true, nil
+	}
+	if !bytes.Equal(header[:4], zstdMagic) {
+		return 0, false, errors.New("invalid zstd frame magic number")
+	}
+	descriptor := header[4]
+	singleSegment := descriptor&0x20 != 0
+	size := int64(5)
+	if !singleSegment {
+		// window descriptor
+		size++
+	}
+	size += []int64{0, 1, 2, 4}[descriptor&0x3]
+	contentSizeLen := []int64{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeLen == 0 && singleSegment {
+		contentSizeLen = 1
+	}
+	size += contentSizeLen
+
+	// Blocks, each with a 3 bytes header, the last one flagged
+	var blockHeader [3]byte
+	for {
+		if _, err := r.ReadAt(blockHeader[:], offset+size); err != nil {
+			return 0, false, fmt.Errorf("failed to read zstd block header: %w", err)
+		}
+		h := uint32(blockHeader[0]) | uint32(blockHeader[1])<<8 | uint32(blockHeader[2])<<16
+		size += 3
+		switch blockType := (h >> 1) & 0x3; blockType {
+		case 1: // RLE block, a single byte repeated
+			size++
+		case 3:
+			return 0, false, errors.New("invalid zstd block type")
+		default:
+			size += int64(h >> 3)
+		}
+		if h&1 != 0 {
+			break
+		}
+	}
+	if descriptor&0x4 != 0 {
+		// content checksum
+		size += 4
+	}
+	return size, false, nil
+}
@@ -0,0 +1,191 @@
+package backuptar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression_Append(t *testing.T) {
+	data := bytes.Repeat([]byte("chain data "), 1000)
+
+	tc := []struct {
+		name        string
+		compression Compression
+		magic       []byte
+		initOpts    []WriterOption
+	}{
+		{
+			name:        "gzip",
+			compression: CompressionGzip,
+			magic:       gzipMagic,
+			initOpts:    []WriterOption{WithCompression(CompressionGzip, 0)},
+		},
+		{
+			name:        "zstd",
+			compression: CompressionZstd,
+			magic:       zstdMagic,
+			initOpts:    []WriterOption{WithCompression(CompressionZstd, 0)},
+		},
+		{
+			name:        "zstd from empty uncompressed archive",
+			compression: CompressionZstd,
+			magic:       zstdMagic,
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			srcDir := filepath.Join(tmpDir, "src")
+			require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "dir"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dir", "file.txt"), data, 0o644))
+
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, InitBackupTar(tarPath, tt.initOpts...))
+
+			// Several writers append to the same archive, the first one
+			// with the explicit compression level
+			for i, prefix := range []string{"container1", "container2"} {
+				opts := []WriterOption{WithCompression(tt.compression, 3)}
+				if i > 0 {
+					opts = nil
+				}
+				backupWriter, err := NewBackupWriter(tarPath, opts...)
+				require.NoError(t, err)
+				require.NoError(t, backupWriter.AddDir(srcDir, prefix))
+				require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, "dir", "file.txt"), prefix+".txt"))
+				require.NoError(t, backupWriter.Close())
+			}
+
+			archive, err := os.ReadFile(tarPath)
+			require.NoError(t, err)
+			assert.True(t, bytes.HasPrefix(archive, tt.magic), "archive is not compressed")
+			assert.Less(t, len(archive), 2*len(data))
+
+			for _, prefix := range []string{"container1", "container2"} {
+				outDir := filepath.Join(tmpDir, "out", prefix)
+				require.NoError(t, ExtractDir(tarPath, prefix, outDir))
+				got, err := os.ReadFile(filepath.Join(outDir, "dir", "file.txt"))
+				require.NoError(t, err)
+				assert.Equal(t, data, got)
+
+				got, err = ReadFile(tarPath, prefix+".txt")
+				require.NoError(t, err)
+				assert.Equal(t, data, got)
+			}
+
+			// The compression of a non-empty archive can't change
+			_, err = NewBackupWriter(tarPath, WithCompression(CompressionNone, 0))
+			assert.ErrorIs(t, err, ErrCompressionMismatch)
+		})
+	}
+}
+
+func TestCompression_AppendForeignEndOfArchive(t *testing.T) {
+	tc := []struct {
+		name        string
+		compression Compression
+		level       int
+		content     []byte
+		err         error
+	}{
+		{
+			name:        "gzip, stored",
+			compression: CompressionGzip,
+			level:       gzip.NoCompression,
+			content:     make([]byte, 2*TarBlockSize),
+		},
+		{
+			name:        "gzip, best compression",
+			compression: CompressionGzip,
+			level:       gzip.BestCompression,
+			content:     make([]byte, 2*TarBlockSize),
+		},
+		{
+			name:        "zstd, best compression",
+			compression: CompressionZstd,
+			level:       19,
+			content:     make([]byte, 2*TarBlockSize),
+		},
+		{
+			name:        "gzip, not zero",
+			compression: CompressionGzip,
+			content:     bytes.Repeat([]byte{1}, 2*TarBlockSize),
+			err:         ErrPrepareToAppend,
+		},
+		{
+			name:        "zstd, extra block",
+			compression: CompressionZstd,
+			content:     make([]byte, 3*TarBlockSize),
+			err:         ErrPrepareToAppend,
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			filePath := filepath.Join(tmpDir, "file.txt")
+			require.NoError(t, os.WriteFile(filePath, []byte("data"), 0o644))
+
+			// An archive written by another tool ends with a member
+			// compressed with other settings than the snapshotter's
+			var archive bytes.Buffer
+			compressor, err := newCompressor(&archive, tt.compression, tt.level)
+			require.NoError(t, err)
+			_, err = compressor.Write(tt.content)
+			require.NoError(t, err)
+			require.NoError(t, compressor.Close())
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, os.WriteFile(tarPath, archive.Bytes(), 0o644))
+
+			backupWriter, err := NewBackupWriter(tarPath)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddFile(filePath, "file.txt"))
+			require.NoError(t, backupWriter.Close())
+			got, err := ReadFile(tarPath, "file.txt")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("data"), got)
+		})
+	}
+}
+
+func TestCompression_NotEmptyUncompressed(t *testing.T) {
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "file.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("data"), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddFile(filePath, "file.txt"))
+	require.NoError(t, backupWriter.Close())
+
+	_, err = NewBackupWriter(tarPath, WithCompression(CompressionGzip, 0))
+	assert.ErrorIs(t, err, ErrCompressionMismatch)
+}
+
+func TestParseCompression(t *testing.T) {
+	for name, want := range map[string]Compression{
+		"":     CompressionNone,
+		"none": CompressionNone,
+		"gzip": CompressionGzip,
+		"zstd": CompressionZstd,
+	} {
+		got, err := ParseCompression(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := ParseCompression("lz4")
+	assert.Error(t, err)
+}
@@ -7,4 +7,8 @@ const (
 	// Path is the path to the backup file inside the container. It should be
 	// the target of the volume mount for the backup file.
 	Path = "/" + FileName
+
+	// paxXattrPrefix is the prefix of the PAX records holding extended
+	// attributes, as used by GNU tar and star.
+	paxXattrPrefix = "SCHILY.xattr."
 )
@@ -0,0 +1,58 @@
+package backuptar
+
+import "archive/tar"
+
+// EntryStats counts the entries of an archive restored to a filesystem
+// target.
+type EntryStats struct {
+	// Files counts the regular and special files.
+	Files int
+	Dirs  int
+	// Links counts the symbolic and hard links.
+	Links     int
+	Whiteouts int
+	// Bytes is the size of the content of the regular files.
+	Bytes int64
+	// Missing is set if the tar path of the target had no entry.
+	Missing bool
+}
+
+// Add counts the entry described by header.
+func (s *EntryStats) Add(header *tar.Header) {
+	switch header.Typeflag {
+	case tar.TypeDir:
+		s.Dirs++
+	case tar.TypeSymlink, tar.TypeLink:
+		s.Links++
+	case tar.TypeReg:
+		s.Files++
+		s.Bytes += header.Size
+	default:
+		s.Files++
+	}
+}
+
+// WithDryRun walks the entries of an extraction without writing to the
+// filesystem: the entries which would be restored are counted in stats, by
+// the filesystem target they would be restored to. Entries are still checked
+// to stay inside their target, and the tar paths without entries are marked
+// as Missing instead of failing with ErrFileNotFound.
+func WithDryRun(stats map[string]*EntryStats) ExtractOption {
+	return func(o *extractOptions) {
+		o.dryRun = stats
+	}
+}
+
+// stats returns the stats of the filesystem target root in a dry run, or nil
+// if the entries are extracted.
+func (e *extractor) stats(root string) *EntryStats {
+	if e.opts.dryRun == nil {
+		return nil
+	}
+	s, ok := e.opts.dryRun[root]
+	if !ok {
+		s = &EntryStats{}
+		e.opts.dryRun[root] = s
+	}
+	return s
+}
@@ -0,0 +1,203 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+
+	"filippo.io/age"
+)
+
+const (
+	// paxEncryption marks the entries with encrypted content, its value is
+	// the encryption scheme.
+	paxEncryption = "SNAPSHOTTER.encryption"
+	// paxEncryptionKey holds the key the content of an entry is encrypted
+	// with, itself encrypted to the recipients of the archive.
+	paxEncryptionKey = "SNAPSHOTTER.encryption.key"
+	// paxPlainSize is the size of the content of an entry before encryption.
+	paxPlainSize = "SNAPSHOTTER.size"
+
+	encryptionAge = "age"
+
+	// ageChunkSize and ageTagSize describe the payload of age files: the
+	// plaintext is split in chunks, each sealed with an authentication tag.
+	ageChunkSize = 64 * 1024
+	ageTagSize   = 16
+)
+
+// entryEncryption encrypts the content of the entries written by a
+// BackupWriter. Encrypting every entry to the archive recipients would be
+// slow with passphrases, so the entries are encrypted with a random key
+// generated for the writer, and the key is encrypted to the recipients.
+type entryEncryption struct {
+	recipient  age.Recipient
+	wrappedKey string
+}
+
+func newEntryEncryption(recipients []age.Recipient) (*entryEncryption, error) {
+	key, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+	var wrapped bytes.Buffer
+	w, err := age.Encrypt(&wrapped, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(w, key.String())
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &entryEncryption{
+		recipient:  key.Recipient(),
+		wrappedKey: base64.StdEncoding.EncodeToString(wrapped.Bytes()),
+	}, nil
+}
+
+// writeEncrypted writes header followed by the content of the regular file f,
+// encrypted with age. Encrypted entries are not sparse. The plaintext is
+// written to h.
+func (b *BackupWriter) writeEncrypted(header *tar.Header, f *os.File, h hash.Hash) error {
+	// age writes its header as soon as the encryption starts, hold it until
+	// the entry header, which needs the encrypted size, is written.
+	var ageHeader bytes.Buffer
+	dst := &switchWriter{w: &ageHeader}
+	w, err := age.Encrypt(dst, b.encryption.recipient)
+	if err != nil {
+		return err
+	}
+
+	encryptedHeader := *header
+	encryptedHeader.Size = int64(ageHeader.Len()) + agePayloadSize(header.Size)
+	encryptedHeader.Format = tar.FormatPAX
+	encryptedHeader.PAXRecords = make(map[string]string, len(header.PAXRecords)+3)
+	for k, v := range header.PAXRecords {
+		encryptedHeader.PAXRecords[k] = v
+	}
+	encryptedHeader.PAXRecords[paxEncryption] = encryptionAge
+	encryptedHeader.PAXRecords[paxEncryptionKey] = b.encryption.wrappedKey
+	encryptedHeader.PAXRecords[paxPlainSize] = strconv.FormatInt(header.Size, 10)
+	if err := b.tarWriter.WriteHeader(&encryptedHeader); err != nil {
+		return err
+	}
+	if _, err := b.tarWriter.Write(ageHeader.Bytes()); err != nil {
+		return err
+	}
+
+	dst.w = b.tarWriter
+	n, err := io.CopyN(w, io.TeeReader(f, h), header.Size)
+	if err != nil {
+		return fmt.Errorf("file %s changed while being added: read %d bytes instead of %d: %w", header.Name, n, header.Size, err)
+	}
+	return w.Close()
+}
+
+// agePayloadSize returns the size of the sealed chunks of the age payload
+// encrypting size bytes. The plaintext is sealed in chunks of ageChunkSize
+// bytes, the last one holding the remaining bytes: a plaintext filling its
+// last chunk is not followed by an empty chunk, only an empty plaintext is
+// sealed in a single empty chunk. The nonce preceding the chunks is written by
+// age.Encrypt along with the header. TestAgePayloadSize pins this layout of
+// age's STREAM payload.
+func agePayloadSize(size int64) int64 {
+	chunks := (size + ageChunkSize - 1) / ageChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*ageTagSize
+}
+
+// isEncrypted reports whether the content of the entry described by header
+// is encrypted.
+func isEncrypted(header *tar.Header) bool {
+	_, ok := header.PAXRecords[paxEncryption]
+	return ok
+}
+
+// decrypt returns a reader of the decrypted content of the encrypted entry
+// described by header, read from r, and its size.
+func (e *extractor) decrypt(header *tar.Header, r io.Reader) (io.Reader, int64, error) {
+	if scheme := header.PAXRecords[paxEncryption]; scheme != encryptionAge {
+		return nil, 0, fmt.Errorf("unknown encryption %q for %s", scheme, header.Name)
+	}
+	size, err := strconv.ParseInt(header.PAXRecords[paxPlainSize], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid size of encrypted file %s: %w", header.Name, err)
+	}
+	key, err := e.entryKey(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	plain, err := age.Decrypt(r, key)
+	if err != nil {
+		return nil, 0, &DecryptionError{Name: header.Name, Err: err}
+	}
+	return &decryptingReader{name: header.Name, r: plain}, size, nil
+}
+
+// entryKey returns the key the content of the entry described by header is
+// encrypted with, decrypting it with the identities of the extraction.
+func (e *extractor) entryKey(header *tar.Header) (age.Identity, error) {
+	wrappedKey := header.PAXRecords[paxEncryptionKey]
+	if key, ok := e.keys[wrappedKey]; ok {
+		return key, nil
+	}
+	if len(e.opts.identities) == 0 {
+		return nil, fmt.Errorf("%w: %s is encrypted", ErrMissingKey, header.Name)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key of %s: %w", header.Name, err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(wrapped), e.opts.identities...)
+	if err != nil {
+		return nil, &DecryptionError{Name: header.Name, Err: err}
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, &DecryptionError{Name: header.Name, Err: err}
+	}
+	key, err := age.ParseX25519Identity(string(data))
+	if err != nil {
+		return nil, &DecryptionError{Name: header.Name, Err: err}
+	}
+	if e.keys == nil {
+		e.keys = make(map[string]age.Identity)
+	}
+	e.keys[wrappedKey] = key
+	return key, nil
+}
+
+// decryptingReader reports the errors of the decryption of an entry, such as
+// a corrupted content, as DecryptionError.
+type decryptingReader struct {
+	name string
+	r    io.Reader
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &DecryptionError{Name: d.name, Err: err}
+	}
+	return n, err
+}
+
+// switchWriter writes to w, which can be replaced between writes.
+type switchWriter struct {
+	w io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
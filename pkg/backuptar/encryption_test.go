@@ -0,0 +1,188 @@
+package backuptar
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	// 64KiB boundaries exercise the size of the age payload
+	files := map[string][]byte{
+		"empty.txt":    {},
+		"keystore.txt": []byte(`{"crypto":{"cipher":"aes-128-ctr"}}`),
+		"chunk.bin":    bytes.Repeat([]byte{1}, ageChunkSize),
+		"chunks.bin":   bytes.Repeat([]byte("node key "), 20000),
+	}
+
+	key, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	passphraseRecipient, err := age.NewScryptRecipient("correct horse battery staple")
+	require.NoError(t, err)
+	passphraseIdentity, err := age.NewScryptIdentity("correct horse battery staple")
+	require.NoError(t, err)
+
+	tc := []struct {
+		name       string
+		initOpts   []WriterOption
+		recipient  age.Recipient
+		identities []age.Identity
+	}{
+		{
+			name:       "x25519",
+			recipient:  key.Recipient(),
+			identities: []age.Identity{key},
+		},
+		{
+			name:       "passphrase",
+			recipient:  passphraseRecipient,
+			identities: []age.Identity{passphraseIdentity},
+		},
+		{
+			name:       "x25519 with zstd",
+			initOpts:   []WriterOption{WithCompression(CompressionZstd, 0)},
+			recipient:  key.Recipient(),
+			identities: []age.Identity{key},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			srcDir := filepath.Join(tmpDir, "src")
+			require.NoError(t, os.MkdirAll(srcDir, 0o755))
+			for name, data := range files {
+				require.NoError(t, os.WriteFile(filepath.Join(srcDir, name), data, 0o600))
+			}
+
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, InitBackupTar(tarPath, tt.initOpts...))
+
+			// An encrypted prefix next to a plain one
+			backupWriter, err := NewBackupWriter(tarPath, WithEncryption(tt.recipient))
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddDir(srcDir, "secret"))
+			require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, "keystore.txt"), "secret.txt"))
+			require.NoError(t, backupWriter.Close())
+			backupWriter, err = NewBackupWriter(tarPath)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddDir(srcDir, "plain"))
+			require.NoError(t, backupWriter.Close())
+
+			if len(tt.initOpts) == 0 {
+				archive, err := os.ReadFile(tarPath)
+				require.NoError(t, err)
+				assert.Equal(t, 1, bytes.Count(archive, files["keystore.txt"]), "keystore is stored in plaintext")
+			}
+
+			outDir := filepath.Join(tmpDir, "out")
+			require.NoError(t, ExtractDir(tarPath, "secret", outDir, WithIdentities(tt.identities...)))
+			for name, data := range files {
+				got, err := os.ReadFile(filepath.Join(outDir, name))
+				require.NoError(t, err)
+				assert.Equal(t, data, got, name)
+			}
+
+			got, err := ReadFile(tarPath, "secret.txt", WithIdentities(tt.identities...))
+			require.NoError(t, err)
+			assert.Equal(t, files["keystore.txt"], got)
+
+			outFile := filepath.Join(tmpDir, "secret.txt")
+			require.NoError(t, ExtractFile(tarPath, "secret.txt", outFile, WithIdentities(tt.identities...)))
+			got, err = os.ReadFile(outFile)
+			require.NoError(t, err)
+			assert.Equal(t, files["keystore.txt"], got)
+
+			// Plain entries don't need a key
+			require.NoError(t, ExtractDir(tarPath, "plain", filepath.Join(tmpDir, "plain")))
+		})
+	}
+}
+
+func TestEncryption_Keys(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "keystore.txt")
+	require.NoError(t, os.WriteFile(srcFile, []byte("secret"), 0o600))
+
+	key, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	otherKey, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath))
+	backupWriter, err := NewBackupWriter(tarPath, WithEncryption(key.Recipient()))
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddFile(srcFile, "secret.txt"))
+	require.NoError(t, backupWriter.Close())
+
+	tc := []struct {
+		name       string
+		identities []age.Identity
+		wantErr    func(t *testing.T, err error)
+	}{
+		{
+			name: "missing key",
+			wantErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrMissingKey)
+			},
+		},
+		{
+			name:       "wrong key",
+			identities: []age.Identity{otherKey},
+			wantErr: func(t *testing.T, err error) {
+				var decryptionErr *DecryptionError
+				require.True(t, errors.As(err, &decryptionErr), "unexpected error: %v", err)
+				assert.Equal(t, "secret.txt", decryptionErr.Name)
+			},
+		},
+		{
+			name:       "one of the keys",
+			identities: []age.Identity{otherKey, key},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "keystore.txt")
+			err := ExtractFile(tarPath, "secret.txt", out, WithIdentities(tt.identities...))
+			if tt.wantErr != nil {
+				require.Error(t, err)
+				tt.wantErr(t, err)
+				_, err = ReadFile(tarPath, "secret.txt", WithIdentities(tt.identities...))
+				require.Error(t, err)
+				tt.wantErr(t, err)
+				return
+			}
+			require.NoError(t, err)
+			got, err := os.ReadFile(out)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("secret"), got)
+		})
+	}
+}
+
+func TestAgePayloadSize(t *testing.T) {
+	key, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	for _, size := range []int64{0, 1, ageChunkSize - 1, ageChunkSize, ageChunkSize + 1, 2 * ageChunkSize} {
+		// The payload is what age writes after the header, as in
+		// writeEncrypted
+		var header, payload bytes.Buffer
+		dst := &switchWriter{w: &header}
+		w, err := age.Encrypt(dst, key.Recipient())
+		require.NoError(t, err)
+		dst.w = &payload
+		_, err = w.Write(make([]byte, size))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		assert.Equal(t, int64(payload.Len()), agePayloadSize(size), "size %d", size)
+	}
+}
@@ -1,8 +1,47 @@
 package backuptar
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrPrepareToAppend = errors.New("tar file is not prepared to append")
-	ErrFileNotFound    = errors.New("file not found")
+	ErrPrepareToAppend     = errors.New("tar file is not prepared to append")
+	ErrFileNotFound        = errors.New("file not found")
+	ErrCompressionMismatch = errors.New("archive compression mismatch")
+	ErrMissingKey          = errors.New("missing decryption key")
+	ErrInvalidIndex        = errors.New("archive index does not match the archive")
+	ErrUnsafePath          = errors.New("unsafe path in archive")
 )
+
+// DecryptionError is returned when an encrypted entry can't be decrypted,
+// because none of the provided identities matches or the content is
+// corrupted.
+type DecryptionError struct {
+	Name string
+	Err  error
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("failed to decrypt %s: %v", e.Name, e.Err)
+}
+
+func (e *DecryptionError) Unwrap() error {
+	return e.Err
+}
+
+// UnsafePathError is returned when an archive entry would be extracted outside
+// of its target, because its name has ".." components or one of its parent
+// directories is a symbolic link. It matches ErrUnsafePath.
+type UnsafePathError struct {
+	Name   string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("unsafe path %s in archive: %s", e.Name, e.Reason)
+}
+
+func (e *UnsafePathError) Unwrap() error {
+	return ErrUnsafePath
+}
@@ -0,0 +1,361 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ExtractOption configures how ExtractDir and ExtractFile restore entries.
+type ExtractOption func(*extractOptions)
+
+type extractOptions struct {
+	noSameOwner bool
+	identities  []age.Identity
+	whiteouts   bool
+	// pathFilter selects the entries to extract by path relative to their
+	// tar path, or nil to extract all of them
+	pathFilter func(relPath string) bool
+	// dryRun counts the entries by filesystem target instead of extracting
+	// them, if not nil
+	dryRun map[string]*EntryStats
+}
+
+// WithNoSameOwner restores entries owned by the user running the extraction
+// instead of the uid and gid stored in the archive, like tar --no-same-owner.
+// Ownership is only restored by default when running as root.
+func WithNoSameOwner() ExtractOption {
+	return func(o *extractOptions) {
+		o.noSameOwner = true
+	}
+}
+
+// WithIdentities decrypts the encrypted entries with the given age identities.
+// Extracting an encrypted entry without identities fails with ErrMissingKey,
+// and with a DecryptionError if none of them matches.
+func WithIdentities(identities ...age.Identity) ExtractOption {
+	return func(o *extractOptions) {
+		o.identities = append(o.identities, identities...)
+	}
+}
+
+// WithPathFilter only extracts the entries under a directory tar path whose
+// slash-separated path relative to it is selected by filter. The directory
+// itself is not restored, and whiteouts are selected by the path they delete.
+func WithPathFilter(filter func(relPath string) bool) ExtractOption {
+	return func(o *extractOptions) {
+		o.pathFilter = filter
+	}
+}
+
+// selected reports whether the entry described by header under the tar path
+// prefix is selected by the path filter.
+func (e *extractor) selected(prefix string, header *tar.Header) bool {
+	if e.opts.pathFilter == nil {
+		return true
+	}
+	name := header.Name
+	if deleted, ok := IsWhiteout(header); ok && e.opts.whiteouts {
+		name = deleted
+	}
+	relPath, ok := strings.CutPrefix(name, prefix+"/")
+	return ok && e.opts.pathFilter(relPath)
+}
+
+// extractor restores archive entries on the filesystem.
+type extractor struct {
+	opts extractOptions
+	// dirs holds the extracted directories, their mode, extended attributes
+	// and times are applied once all their content has been written.
+	dirs []extractedDir
+	// keys caches the decrypted keys of the encrypted entries, by their
+	// encrypted form.
+	keys map[string]age.Identity
+	// safeDirs holds the directories checked not to be symbolic links by
+	// resolve, with all their parents under the target.
+	safeDirs map[string]bool
+}
+
+type extractedDir struct {
+	path   string
+	header *tar.Header
+}
+
+func newExtractor(opts []ExtractOption) *extractor {
+	e := &extractor{
+		opts: extractOptions{
+			noSameOwner: os.Geteuid() != 0,
+		},
+		safeDirs: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(&e.opts)
+	}
+	return e
+}
+
+// resolve returns the filesystem path of the entry named name, at relPath under
+// the filesystem target root. Entries whose path escapes root, lexically or
+// through a symbolic link extracted earlier, are refused with an
+// UnsafePathError.
+func (e *extractor) resolve(name, root, relPath string) (string, error) {
+	root = filepath.Clean(root)
+	if relPath == "." {
+		return root, nil
+	}
+	if !filepath.IsLocal(relPath) {
+		return "", &UnsafePathError{Name: name, Reason: "path escapes the target"}
+	}
+	target := filepath.Join(root, relPath)
+	var checked []string
+	for dir := filepath.Dir(target); len(dir) > len(root) && !e.safeDirs[dir]; dir = filepath.Dir(dir) {
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			// Created as a directory by the extraction
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", &UnsafePathError{Name: name, Reason: fmt.Sprintf("parent directory %s is a symbolic link", dir)}
+		}
+		checked = append(checked, dir)
+	}
+	for _, dir := range checked {
+		e.safeDirs[dir] = true
+	}
+	return target, nil
+}
+
+// resolveWhiteout returns the filesystem path of the entry deleted by the
+// whiteout named name, at relPath under root. Whiteouts can't delete root.
+func (e *extractor) resolveWhiteout(name, root, relPath string) (string, error) {
+	if relPath == "." {
+		return "", &UnsafePathError{Name: name, Reason: "whiteout deletes the target"}
+	}
+	return e.resolve(name, root, relPath)
+}
+
+// forget drops path and the directories under it from the checked
+// directories, as it is replaced.
+func (e *extractor) forget(path string) {
+	if !e.safeDirs[path] {
+		return
+	}
+	for dir := range e.safeDirs {
+		if dir == path || strings.HasPrefix(dir, path+string(filepath.Separator)) {
+			delete(e.safeDirs, dir)
+		}
+	}
+}
+
+// extract restores the entry described by header, with its content read from
+// r, at targetPath. Hard link names are translated into filesystem paths with
+// linkTarget.
+func (e *extractor) extract(r io.Reader, header *tar.Header, targetPath string, linkTarget func(string) (string, error)) error {
+	if header.Typeflag != tar.TypeDir {
+		fileDir := filepath.Dir(targetPath)
+		err := os.MkdirAll(fileDir, 0o755)
+		if err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", fileDir, err)
+		}
+		// Replace whatever is at the target path, links and special files
+		// can't be overwritten in place, and a directory may have been
+		// replaced by a file since an earlier backup.
+		e.forget(targetPath)
+		err = os.RemoveAll(targetPath)
+		if err != nil {
+			return fmt.Errorf("failed to replace %s: %w", targetPath, err)
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if fi, err := os.Lstat(targetPath); err == nil && !fi.IsDir() {
+			// A file replaced by a directory since an earlier backup
+			if err := os.Remove(targetPath); err != nil {
+				return fmt.Errorf("failed to replace %s: %w", targetPath, err)
+			}
+		}
+		err := os.MkdirAll(targetPath, 0o755)
+		if err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
+		}
+		if err := e.chown(targetPath, header); err != nil {
+			return err
+		}
+		e.dirs = append(e.dirs, extractedDir{path: targetPath, header: header})
+		return nil
+	case tar.TypeReg:
+		err := e.writeFile(targetPath, header, r)
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		err := os.Symlink(header.Linkname, targetPath)
+		if err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", targetPath, err)
+		}
+	case tar.TypeLink:
+		oldname, err := linkTarget(header.Linkname)
+		if err != nil {
+			return err
+		}
+		err = os.Link(oldname, targetPath)
+		if err != nil {
+			return fmt.Errorf("failed to create hard link %s: %w", targetPath, err)
+		}
+		// A hard link shares the attributes of the file it points to, which
+		// are already restored.
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		err := mknod(targetPath, header)
+		if err != nil {
+			return fmt.Errorf("failed to create special file %s: %w", targetPath, err)
+		}
+	default:
+		return fmt.Errorf("unexpected typeflag %d for %s", header.Typeflag, header.Name)
+	}
+	return e.setAttributes(targetPath, header)
+}
+
+// extractFile restores the regular file entry described by header, with its
+// content read from r, at targetPath. The file is overwritten in place, so
+// that files bind-mounted in containers can be restored.
+func (e *extractor) extractFile(r io.Reader, header *tar.Header, targetPath string) error {
+	fileDir := filepath.Dir(targetPath)
+	err := os.MkdirAll(fileDir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", fileDir, err)
+	}
+	err = e.writeFile(targetPath, header, r)
+	if err != nil {
+		return err
+	}
+	return e.setAttributes(targetPath, header)
+}
+
+// finish applies the mode, extended attributes and times of the extracted
+// directories. Children are handled before their parents, so writing into a
+// directory doesn't change its modification time afterwards, and default ACLs
+// are not inherited by the restored content.
+func (e *extractor) finish() error {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		dir := e.dirs[i]
+		err := e.chmod(dir.path, dir.header)
+		if err != nil {
+			return err
+		}
+		err = setXattrs(dir.path, dir.header)
+		if err != nil {
+			return err
+		}
+		err = e.chtimes(dir.path, dir.header)
+		if err != nil {
+			return err
+		}
+	}
+	e.dirs = nil
+	return nil
+}
+
+// setAttributes applies the ownership, mode, extended attributes and times of
+// header to path. Ownership goes first, as changing it clears the setuid and
+// setgid bits and the file capabilities.
+func (e *extractor) setAttributes(path string, header *tar.Header) error {
+	err := e.chown(path, header)
+	if err != nil {
+		return err
+	}
+	err = e.chmod(path, header)
+	if err != nil {
+		return err
+	}
+	err = setXattrs(path, header)
+	if err != nil {
+		return err
+	}
+	return e.chtimes(path, header)
+}
+
+func (e *extractor) chown(path string, header *tar.Header) error {
+	if e.opts.noSameOwner {
+		return nil
+	}
+	err := os.Lchown(path, header.Uid, header.Gid)
+	if err != nil {
+		return fmt.Errorf("failed to change owner of %s: %w", path, err)
+	}
+	return nil
+}
+
+func (e *extractor) chmod(path string, header *tar.Header) error {
+	if header.Typeflag == tar.TypeSymlink {
+		// The mode of symbolic links is not used
+		return nil
+	}
+	mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	err := os.Chmod(path, mode)
+	if err != nil {
+		return fmt.Errorf("failed to change mode of %s: %w", path, err)
+	}
+	return nil
+}
+
+func (e *extractor) chtimes(path string, header *tar.Header) error {
+	if header.ModTime.IsZero() {
+		return nil
+	}
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	err := lchtimes(path, atime, header.ModTime)
+	if err != nil {
+		return fmt.Errorf("failed to change times of %s: %w", path, err)
+	}
+	return nil
+}
+
+// content returns a reader of the content of the regular file entry described
+// by header, read from r, and its size. Encrypted content is decrypted.
+func (e *extractor) content(header *tar.Header, r io.Reader) (io.Reader, int64, error) {
+	if isEncrypted(header) {
+		return e.decrypt(header, r)
+	}
+	return r, header.Size, nil
+}
+
+// writeFile writes the content of the regular file entry described by header,
+// read from r, to path. The holes of sparse entries are recreated.
+func (e *extractor) writeFile(path string, header *tar.Header, r io.Reader) error {
+	content, size, err := e.content(header, r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	var n int64
+	if isSparse(header) {
+		n, err = copySparse(f, content)
+	} else {
+		n, err = io.Copy(f, content)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to copy file %s: %w", path, err)
+	}
+	if n != size {
+		f.Close()
+		return fmt.Errorf("failed to copy file %s: copied %d bytes instead of %d", path, n, size)
+	}
+	return f.Close()
+}
@@ -0,0 +1,146 @@
+package backuptar
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Filter selects the files AddDir stores from a directory with gitignore-style
+// patterns, see NewFilter.
+type Filter struct {
+	include []pattern
+	exclude []pattern
+}
+
+// pattern is a parsed gitignore-style pattern.
+type pattern struct {
+	// parts are the path.Match patterns of the path components, "**"
+	// matching any number of components
+	parts   []string
+	dirOnly bool
+}
+
+// NewFilter returns the filter of the include and exclude patterns. A file is
+// stored if it, or one of its parent directories, matches an include pattern,
+// or if there are none, and if neither it nor one of its parent directories
+// matches an exclude pattern. Excluded directories are not walked, and the
+// directories leading to included files are stored with them.
+//
+// The patterns follow the gitignore syntax, relative to the directory. A
+// pattern with a slash at its start or middle matches the path from the
+// directory, a pattern without one matches a name at any depth. A trailing
+// slash only matches directories. "*", "?" and "[...]" match within a path
+// component, "**/" matches any number of directories, and a trailing "/**"
+// matches everything inside a directory.
+func NewFilter(include, exclude []string) (*Filter, error) {
+	f := &Filter{}
+	var err error
+	f.include, err = parsePatterns(include)
+	if err != nil {
+		return nil, err
+	}
+	f.exclude, err = parsePatterns(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parsePatterns(patterns []string) ([]pattern, error) {
+	parsed := make([]pattern, 0, len(patterns))
+	for _, p := range patterns {
+		pat, err := parsePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		parsed = append(parsed, pat)
+	}
+	return parsed, nil
+}
+
+func parsePattern(p string) (pattern, error) {
+	var pat pattern
+	p, pat.dirOnly = strings.CutSuffix(p, "/")
+	if p == "" || p == "/" {
+		return pat, fmt.Errorf("empty pattern")
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	pat.parts = strings.Split(p, "/")
+	for _, part := range pat.parts {
+		if part == "" {
+			return pat, fmt.Errorf("empty path component")
+		}
+		if _, err := path.Match(part, ""); err != nil {
+			return pat, err
+		}
+	}
+	if !anchored {
+		pat.parts = append([]string{"**"}, pat.parts...)
+	}
+	return pat, nil
+}
+
+// match reports whether the slash-separated path relPath matches the pattern.
+func (p pattern) match(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchParts(p.parts, strings.Split(relPath, "/"))
+}
+
+func matchParts(parts, names []string) bool {
+	for len(parts) > 0 {
+		if parts[0] == "**" {
+			if len(parts) == 1 {
+				// A trailing "**" matches the content of the directory
+				return len(names) > 0
+			}
+			for i := 0; i <= len(names); i++ {
+				if matchParts(parts[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(parts[0], names[0]); !ok {
+			return false
+		}
+		parts, names = parts[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+func matchAny(patterns []pattern, relPath string, isDir bool) bool {
+	for _, p := range patterns {
+		if p.match(relPath, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether the file at the slash-separated path relPath
+// matches an exclude pattern. Its parent directories are not checked, as
+// excluded directories are not walked.
+func (f *Filter) excluded(relPath string, isDir bool) bool {
+	return matchAny(f.exclude, relPath, isDir)
+}
+
+// included reports whether the file at the slash-separated path relPath, or
+// one of its parent directories, matches an include pattern.
+func (f *Filter) included(relPath string, isDir bool) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+	for p := relPath; p != "."; p = path.Dir(p) {
+		if matchAny(f.include, p, isDir || p != relPath) {
+			return true
+		}
+	}
+	return false
+}
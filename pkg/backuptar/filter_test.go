@@ -0,0 +1,114 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPattern_Match(t *testing.T) {
+	tc := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{pattern: "LOCK", path: "LOCK", match: true},
+		{pattern: "LOCK", path: "chaindata/LOCK", match: true},
+		{pattern: "*.log", path: "logs/geth.log", match: true},
+		{pattern: "*.log", path: "geth.log.1", match: false},
+		{pattern: "/LOCK", path: "chaindata/LOCK", match: false},
+		{pattern: "/LOCK", path: "LOCK", match: true},
+		{pattern: "ancient/tmp", path: "ancient/tmp", isDir: true, match: true},
+		{pattern: "ancient/tmp", path: "chaindata/ancient/tmp", isDir: true, match: false},
+		{pattern: "**/ancient/tmp", path: "chaindata/ancient/tmp", isDir: true, match: true},
+		{pattern: "**/ancient/tmp", path: "ancient/tmp", isDir: true, match: true},
+		{pattern: "a/**/b", path: "a/b", match: true},
+		{pattern: "a/**/b", path: "a/x/y/b", match: true},
+		{pattern: "a/**/b", path: "a/x/y/c", match: false},
+		{pattern: "cache/**", path: "cache", isDir: true, match: false},
+		{pattern: "cache/**", path: "cache/x/y", match: true},
+		{pattern: "tmp/", path: "data/tmp", isDir: true, match: true},
+		{pattern: "tmp/", path: "data/tmp", match: false},
+		{pattern: "[ab]?.db", path: "a1.db", match: true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			p, err := parsePattern(tt.pattern)
+			require.NoError(t, err)
+			assert.Equal(t, tt.match, p.match(tt.path, tt.isDir))
+		})
+	}
+
+	for _, invalid := range []string{"", "/", "a//b", "[a"} {
+		_, err := NewFilter(nil, []string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestFileHeaders_Filter(t *testing.T) {
+	srcDir := t.TempDir()
+	for _, file := range []string{
+		"LOCK",
+		"chaindata/000001.ldb",
+		"chaindata/LOCK",
+		"chaindata/geth.log",
+		"chaindata/ancient/data.cidx",
+		"chaindata/ancient/tmp/scratch",
+		"keystore/key1",
+		"nodes/empty/.keep",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(srcDir, filepath.Dir(file)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, file), []byte(file), 0o644))
+	}
+
+	tc := []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{
+			name:    "exclude",
+			exclude: []string{"LOCK", "*.log", "**/ancient/tmp", "nodes/"},
+			want: []string{
+				".",
+				"chaindata",
+				"chaindata/000001.ldb",
+				"chaindata/ancient",
+				"chaindata/ancient/data.cidx",
+				"keystore",
+				"keystore/key1",
+			},
+		},
+		{
+			name:    "include",
+			include: []string{"ancient", "key*"},
+			exclude: []string{"tmp/"},
+			want: []string{
+				".",
+				"chaindata",
+				"chaindata/ancient",
+				"chaindata/ancient/data.cidx",
+				"keystore",
+				"keystore/key1",
+			},
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFilter(tt.include, tt.exclude)
+			require.NoError(t, err)
+			var names []string
+			err = FileHeaders(srcDir, "", func(header *tar.Header, file string, fi os.FileInfo) error {
+				names = append(names, header.Name)
+				return nil
+			}, WithFilter(f))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// indexVersion is the version of the index format, indexes of other versions
+// are rebuilt.
+const indexVersion = 2
+
+// archiveIndex locates the entries of an archive, so that reading some of them
+// does not require scanning the whole archive. It is stored next to the
+// archive, in IndexPath, and describes the archive as it was when the index
+// was written: an index whose size or modification time don't match the
+// archive is stale.
+type archiveIndex struct {
+	Version     int          `json:"version"`
+	Size        int64        `json:"size"`
+	ModTime     time.Time    `json:"modTime"`
+	Compression Compression  `json:"compression"`
+	Entries     []indexEntry `json:"entries"`
+}
+
+// indexEntry locates an entry of the archive. Offset is where reading starts
+// in the archive file: the first header block of the entry in an uncompressed
+// archive, or the start of the compressed member holding it. Skip is the
+// number of bytes of the uncompressed stream to skip from there to reach the
+// entry. Whiteout marks the whiteout entries.
+type indexEntry struct {
+	Name     string `json:"name"`
+	Offset   int64  `json:"offset"`
+	Skip     int64  `json:"skip,omitempty"`
+	Whiteout bool   `json:"whiteout,omitempty"`
+}
+
+// IndexPath returns the path of the index of the archive at tarPath.
+func IndexPath(tarPath string) string {
+	return tarPath + ".idx"
+}
+
+// valid reports whether the index describes the archive file described by fi.
+func (idx *archiveIndex) valid(fi os.FileInfo, compression Compression) bool {
+	return idx.Version == indexVersion &&
+		idx.Size == fi.Size() &&
+		idx.ModTime.Equal(fi.ModTime()) &&
+		idx.Compression == compression
+}
+
+// builtIndexes holds the indexes built by reads, by archive path. Reads don't
+// write the index, the next BackupWriter of the archive stores it.
+var builtIndexes = struct {
+	sync.Mutex
+	m map[string]*archiveIndex
+}{m: make(map[string]*archiveIndex)}
+
+// loadIndex returns the index of the archive at tarPath, stored next to it or
+// built by a previous read, or nil if it has no valid index.
+func loadIndex(tarPath string, fi os.FileInfo, compression Compression) *archiveIndex {
+	data, err := os.ReadFile(IndexPath(tarPath))
+	if err == nil {
+		var idx archiveIndex
+		if err := json.Unmarshal(data, &idx); err == nil && idx.valid(fi, compression) {
+			return &idx
+		}
+	}
+	builtIndexes.Lock()
+	defer builtIndexes.Unlock()
+	idx, ok := builtIndexes.m[tarPath]
+	if !ok || !idx.valid(fi, compression) {
+		return nil
+	}
+	// The entries of the copy are appended to without changing the kept
+	// index
+	c := *idx
+	c.Entries = idx.Entries[:len(idx.Entries):len(idx.Entries)]
+	return &c
+}
+
+// keep keeps the index built for the archive described by fi at tarPath in
+// memory.
+func (idx *archiveIndex) keep(tarPath string, fi os.FileInfo) {
+	idx.Version = indexVersion
+	idx.Size = fi.Size()
+	idx.ModTime = fi.ModTime()
+	builtIndexes.Lock()
+	defer builtIndexes.Unlock()
+	builtIndexes.m[tarPath] = idx
+}
+
+// dropIndex removes the index of the archive at tarPath, which doesn't match
+// the archive.
+func dropIndex(tarPath string) {
+	os.Remove(IndexPath(tarPath))
+	builtIndexes.Lock()
+	defer builtIndexes.Unlock()
+	delete(builtIndexes.m, tarPath)
+}
+
+// save writes the index of the archive at tarPath, for its current state.
+// The index only speeds up reads, failing to write it is logged but not an
+// error.
+func (idx *archiveIndex) save(tarPath string) {
+	fi, err := os.Stat(tarPath)
+	if err == nil {
+		idx.Version = indexVersion
+		idx.Size = fi.Size()
+		idx.ModTime = fi.ModTime()
+		var data []byte
+		data, err = json.Marshal(idx)
+		if err == nil {
+			err = writeFileAtomic(IndexPath(tarPath), data)
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to write archive index", "path", IndexPath(tarPath), "error", err)
+	}
+}
+
+// writeFileAtomic writes data to the file at path through a temporary file,
+// so that readers never see a partially written file. Files that can't be
+// replaced, such as files bind-mounted in a container, are overwritten.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return os.WriteFile(path, data, 0o644)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+		if err != nil {
+			err = os.WriteFile(path, data, 0o644)
+		}
+	}
+	os.Remove(f.Name())
+	return err
+}
+
+// openIndex returns the index of the archive file f at tarPath, building it
+// if it is missing or stale. A built index is kept in memory, it is only
+// written by the writers of the archive.
+func openIndex(f *os.File, tarPath string, compression Compression) (*archiveIndex, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if idx := loadIndex(tarPath, fi, compression); idx != nil {
+		return idx, nil
+	}
+	slog.Info("Indexing archive", "path", tarPath)
+	idx, err := buildIndex(f, fi.Size(), compression)
+	if err != nil {
+		return nil, err
+	}
+	// The archive may have changed while it was indexed
+	after, err := f.Stat()
+	if err == nil && after.Size() == fi.Size() && after.ModTime().Equal(fi.ModTime()) {
+		idx.keep(tarPath, fi)
+	}
+	return idx, nil
+}
+
+// buildIndex scans the archive file f of the given size to index its entries.
+func buildIndex(f *os.File, size int64, compression Compression) (*archiveIndex, error) {
+	idx := &archiveIndex{Compression: compression}
+	if compression == CompressionNone {
+		r := &countingReadSeeker{r: io.NewSectionReader(f, 0, size)}
+		_, err := scan(tar.NewReader(r), func() int64 { return r.n }, func(header *tar.Header, start int64) {
+			idx.add(header, start, 0)
+		})
+		return idx, err
+	}
+	r := newMemberReader(f, size, compression)
+	defer r.Close()
+	_, err := scan(tar.NewReader(r), func() int64 { return r.pos }, func(header *tar.Header, start int64) {
+		offset, skip := r.locate(start)
+		idx.add(header, offset, skip)
+	})
+	return idx, err
+}
+
+// scan calls add with the header of every entry read from tr and the position
+// of its first header block in the tar stream. pos returns the position of tr
+// in the tar stream. The position where the entries end, before the
+// end-of-archive marker, is returned.
+func scan(tr *tar.Reader, pos func() int64, add func(header *tar.Header, start int64)) (int64, error) {
+	start := int64(0)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return start, nil
+			}
+			return 0, err
+		}
+		add(header, start)
+
+		// The reader is at the start of the content, find where it ends. The
+		// size of the stored content of sparse files is not known, read it.
+		var end int64
+		if isSparse(header) {
+			if _, err := io.Copy(io.Discard, tr); err != nil {
+				return 0, err
+			}
+			end = pos()
+		} else {
+			end = pos() + storedSize(header)
+		}
+		start = end + blockPadding(end)
+	}
+}
+
+// storedSize returns the size of the content stored after the header of a
+// non sparse entry. Like archive/tar, the size of entries that can't have
+// content is ignored.
+func storedSize(header *tar.Header) int64 {
+	switch header.Typeflag {
+	case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+		return 0
+	default:
+		return header.Size
+	}
+}
+
+// add records the entry described by header written at offset, with skip.
+func (idx *archiveIndex) add(header *tar.Header, offset, skip int64) {
+	_, whiteout := IsWhiteout(header)
+	idx.Entries = append(idx.Entries, indexEntry{Name: header.Name, Offset: offset, Skip: skip, Whiteout: whiteout})
+}
+
+// countingReadSeeker tracks the position of the reads and seeks of r.
+type countingReadSeeker struct {
+	r io.ReadSeeker
+	n int64
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	n, err := c.r.Seek(offset, whence)
+	if err == nil {
+		c.n = n
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
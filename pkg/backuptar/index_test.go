@@ -0,0 +1,206 @@
+package backuptar
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readIndex returns the index stored for the archive at tarPath.
+func readIndex(t *testing.T, tarPath string) *archiveIndex {
+	data, err := os.ReadFile(IndexPath(tarPath))
+	require.NoError(t, err)
+	var idx archiveIndex
+	require.NoError(t, json.Unmarshal(data, &idx))
+	return &idx
+}
+
+func TestIndex(t *testing.T) {
+	key, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	tc := []struct {
+		name        string
+		compression Compression
+		opts        []WriterOption
+	}{
+		{
+			name:        "uncompressed",
+			compression: CompressionNone,
+		},
+		{
+			name:        "gzip",
+			compression: CompressionGzip,
+			opts:        []WriterOption{WithCompression(CompressionGzip, 0)},
+		},
+		{
+			name:        "zstd",
+			compression: CompressionZstd,
+			opts:        []WriterOption{WithCompression(CompressionZstd, 0)},
+		},
+		{
+			name:        "zstd encrypted",
+			compression: CompressionZstd,
+			opts:        []WriterOption{WithCompression(CompressionZstd, 0), WithEncryption(key.Recipient())},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			srcDir := filepath.Join(tmpDir, "src")
+			require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "dir"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dir", "file.txt"), bytes.Repeat([]byte("block"), 1000), 0o644))
+			require.NoError(t, os.Symlink("dir/file.txt", filepath.Join(srcDir, "link")))
+			// Long names are stored in extended headers before the entry
+			longName := string(bytes.Repeat([]byte("n"), 150))
+			require.NoError(t, os.WriteFile(filepath.Join(srcDir, longName), []byte("long"), 0o644))
+
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, InitBackupTar(tarPath))
+			for _, prefix := range []string{"container1", "container2", "container3"} {
+				backupWriter, err := NewBackupWriter(tarPath, tt.opts...)
+				require.NoError(t, err)
+				require.NoError(t, backupWriter.AddDir(srcDir, prefix))
+				require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, longName), prefix+".txt"))
+				require.NoError(t, backupWriter.Close())
+			}
+
+			// The index maintained by the writers matches the archive
+			written := readIndex(t, tarPath)
+			assert.Equal(t, tt.compression, written.Compression)
+			assert.Len(t, written.Entries, 3*6)
+			f, err := os.Open(tarPath)
+			require.NoError(t, err)
+			defer f.Close()
+			fi, err := f.Stat()
+			require.NoError(t, err)
+			assert.True(t, written.valid(fi, tt.compression), "index is stale")
+			built, err := buildIndex(f, fi.Size(), tt.compression)
+			require.NoError(t, err)
+			assert.Equal(t, written.Entries, built.Entries)
+
+			// A missing index is rebuilt in memory by reads, and stored by
+			// the next writer
+			require.NoError(t, os.Remove(IndexPath(tarPath)))
+			got, err := ReadFile(tarPath, "container2.txt", WithIdentities(key))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("long"), got)
+			assert.NoFileExists(t, IndexPath(tarPath))
+			backupWriter, err := NewBackupWriter(tarPath, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, longName), "container4.txt"))
+			require.NoError(t, backupWriter.Close())
+			assert.Equal(t, written.Entries, readIndex(t, tarPath).Entries[:len(written.Entries)])
+
+			outDir := filepath.Join(tmpDir, "out")
+			require.NoError(t, ExtractDir(tarPath, "container3", outDir, WithIdentities(key)))
+			got, err = os.ReadFile(filepath.Join(outDir, longName))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("long"), got)
+		})
+	}
+}
+
+func TestIndex_SkipsOtherMembers(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "file.txt")
+	require.NoError(t, os.WriteFile(srcFile, bytes.Repeat([]byte("chain data "), 10000), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath, WithCompression(CompressionGzip, 0)))
+	for _, prefix := range []string{"container1", "container2"} {
+		backupWriter, err := NewBackupWriter(tarPath)
+		require.NoError(t, err)
+		require.NoError(t, backupWriter.AddFile(srcFile, prefix+".txt"))
+		require.NoError(t, backupWriter.Close())
+	}
+	idx := readIndex(t, tarPath)
+	require.Len(t, idx.Entries, 2)
+
+	// Corrupt the first member, keeping the index valid
+	fi, err := os.Stat(tarPath)
+	require.NoError(t, err)
+	f, err := os.OpenFile(tarPath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 64), 32)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Chtimes(tarPath, fi.ModTime(), fi.ModTime()))
+
+	_, err = ReadFile(tarPath, "container2.txt")
+	require.NoError(t, err)
+	_, err = ReadFile(tarPath, "container1.txt")
+	require.Error(t, err)
+}
+
+func TestIndex_MemberPerDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	require.NoError(t, os.MkdirAll(srcDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "file.txt"), bytes.Repeat([]byte("chain data "), 10000), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath, WithCompression(CompressionZstd, 0)))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddDir(srcDir, "volume1"))
+	require.NoError(t, backupWriter.AddDir(srcDir, "volume2"))
+	require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, "file.txt"), "volume3.txt"))
+	require.NoError(t, backupWriter.Close())
+
+	// The directories and files added by a writer start members of their own
+	idx := readIndex(t, tarPath)
+	require.Len(t, idx.Entries, 5)
+	assert.Equal(t, idx.Entries[0].Offset, idx.Entries[1].Offset)
+	assert.Less(t, idx.Entries[1].Offset, idx.Entries[2].Offset)
+	assert.Less(t, idx.Entries[3].Offset, idx.Entries[4].Offset)
+	for _, i := range []int{0, 2, 4} {
+		assert.Zero(t, idx.Entries[i].Skip, idx.Entries[i].Name)
+	}
+	got, err := ReadFile(tarPath, "volume3.txt")
+	require.NoError(t, err)
+	assert.Len(t, got, 110000)
+	f, err := os.Open(tarPath)
+	require.NoError(t, err)
+	defer f.Close()
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	built, err := buildIndex(f, fi.Size(), CompressionZstd)
+	require.NoError(t, err)
+	assert.Equal(t, idx.Entries, built.Entries)
+}
+
+func TestIndex_Invalid(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "file.txt")
+	require.NoError(t, os.WriteFile(srcFile, []byte("data"), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddFile(srcFile, "file1.txt"))
+	require.NoError(t, backupWriter.AddFile(srcFile, "file2.txt"))
+	require.NoError(t, backupWriter.Close())
+
+	// Entries swapped in an index that still looks valid
+	idx := readIndex(t, tarPath)
+	idx.Entries[0].Name, idx.Entries[1].Name = idx.Entries[1].Name, idx.Entries[0].Name
+	data, err := json.Marshal(idx)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(IndexPath(tarPath), data, 0o644))
+
+	_, err = ReadFile(tarPath, "file2.txt")
+	require.ErrorIs(t, err, ErrInvalidIndex)
+	// The index is rebuilt by the next read
+	got, err := ReadFile(tarPath, "file2.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), got)
+}
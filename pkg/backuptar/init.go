@@ -11,20 +11,40 @@ const TarBlockSize = 512
 
 // InitBackupTar creates an empty tar file at the given path with the correct
 // size fto be reade for append operations. If the file already exists, it is
-// truncated and overwritten.
-func InitBackupTar(path string) error {
+// truncated and overwritten. With WithCompression, the file only holds the
+// compressed end-of-archive marker. An empty index is written next to it.
+func InitBackupTar(path string, opts ...WriterOption) error {
+	o := newWriterOptions(opts)
+	data := make([]byte, 2*TarBlockSize)
+	if o.compression != "" && o.compression != CompressionNone {
+		var err error
+		data, err = endOfArchive(o.compression)
+		if err != nil {
+			return err
+		}
+	}
+
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	n, err := file.Write(make([]byte, 2*TarBlockSize))
+	n, err := file.Write(data)
 	if err != nil {
 		return err
 	}
-	if n != 2*TarBlockSize {
+	if n != len(data) {
 		return errors.New("failed to write empty tar file")
 	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	compression := o.compression
+	if compression == "" {
+		compression = CompressionNone
+	}
+	(&archiveIndex{Compression: compression}).save(path)
 	return nil
 }
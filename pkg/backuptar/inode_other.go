@@ -0,0 +1,23 @@
+//go:build !unix
+
+package backuptar
+
+import "os"
+
+// inode identifies a file on the filesystem, shared by all its hard links.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkInode always reports false, hard links are not detected on this
+// platform.
+func hardlinkInode(fi os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+// isDeviceRoot always reports false, devices are not compared on this
+// platform.
+func isDeviceRoot(path string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package backuptar
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// inode identifies a file on the filesystem, shared by all its hard links.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkInode returns the inode of fi if it has more than one hard link.
+func hardlinkInode(fi os.FileInfo) (inode, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return inode{}, false
+	}
+	return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// isDeviceRoot reports whether path is on a device different from the one of
+// its parent directory.
+func isDeviceRoot(path string) (bool, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	parent, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	return fi.Sys().(*syscall.Stat_t).Dev != parent.Sys().(*syscall.Stat_t).Dev, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package backuptar
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+// mknod is not supported on this platform.
+func mknod(path string, header *tar.Header) error {
+	return fmt.Errorf("cannot create special file %s: not supported on this platform", header.Name)
+}
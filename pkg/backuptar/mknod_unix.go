@@ -0,0 +1,27 @@
+//go:build unix && !freebsd
+
+package backuptar
+
+import (
+	"archive/tar"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// mknod creates the FIFO or device node described by header at path.
+func mknod(path string, header *tar.Header) error {
+	mode := uint32(header.Mode & 0o777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	default:
+		return fmt.Errorf("unexpected typeflag %d for special file %s", header.Typeflag, header.Name)
+	}
+	dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	return unix.Mknod(path, mode, int(dev))
+}
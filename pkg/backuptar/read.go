@@ -4,99 +4,159 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
+	"path"
 	"strings"
 )
 
 // ExtractDir extracts the directory srcTarPath from the tar archive at tarPath
-// to the filesystem path fsPathTarget.
-func ExtractDir(tarPath, srcTarPath, fsPathTarget string) error {
-	tarFile, err := os.Open(tarPath)
-	if err != nil {
-		return err
+// to the filesystem path fsPathTarget. Ownership, permissions and times are
+// restored from the archive, the ones of directories are applied after their
+// content is extracted.
+func ExtractDir(tarPath, srcTarPath, fsPathTarget string, opts ...ExtractOption) error {
+	extractor := newExtractor(opts)
+	srcTarPath = path.Clean(srcTarPath)
+	// relPath returns the path of the entry named name relative to
+	// srcTarPath, if it is under it.
+	relPath := func(name string) (string, bool) {
+		if name == srcTarPath {
+			return ".", true
+		}
+		return strings.CutPrefix(name, srcTarPath+"/")
 	}
-	defer tarFile.Close()
-	tarReader := tar.NewReader(tarFile)
-	for {
-		header, err := tarReader.Next()
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
+	// Hard links point to entries of the same directory, resolve them inside
+	// fsPathTarget.
+	linkTarget := func(linkname string) (string, error) {
+		rel, ok := relPath(linkname)
+		if !ok {
+			return "", &UnsafePathError{Name: linkname, Reason: "hard link target is outside of " + srcTarPath}
 		}
-		if strings.HasPrefix(header.Name, srcTarPath) && header.Name != srcTarPath {
-			// Build target path from header name
-			relPath, err := filepath.Rel(srcTarPath, header.Name)
+		return extractor.resolve(linkname, fsPathTarget, rel)
+	}
+	match := func(name string) bool {
+		_, ok := relPath(name)
+		return ok
+	}
+	err := walkArchive(tarPath, match, func(header *tar.Header, r io.Reader) error {
+		if header.Name == srcTarPath && header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("%s is not a directory", srcTarPath)
+		}
+		if !extractor.selected(srcTarPath, header) {
+			return nil
+		}
+		if deleted, ok := IsWhiteout(header); ok && extractor.opts.whiteouts && header.Name != srcTarPath {
+			rel, _ := relPath(deleted)
+			targetPath, err := extractor.resolveWhiteout(header.Name, fsPathTarget, rel)
 			if err != nil {
-				return fmt.Errorf("failed to get relative path: %w", err)
+				return err
 			}
-			targetPath := filepath.Join(fsPathTarget, relPath)
-
-			// Restore item
-			switch header.Typeflag {
-			case tar.TypeDir:
-				err := os.MkdirAll(targetPath, 0o755)
-				if err != nil {
-					return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
-				}
-			case tar.TypeReg:
-				fileDir := filepath.Dir(targetPath)
-				err := os.MkdirAll(fileDir, 0o755)
-				if err != nil {
-					return fmt.Errorf("failed to create directory %s: %w", fileDir, err)
-				}
-				f, err := os.OpenFile(targetPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm())
-				if err != nil {
-					return err
-				}
-				n, err := io.Copy(f, tarReader)
-				if err != nil {
-					return fmt.Errorf("failed to copy file %s: %w", targetPath, err)
-				}
-				if n != header.Size {
-					return fmt.Errorf("failed to copy file %s: copied %d bytes instead of %d", targetPath, n, header.Size)
-				}
-			default:
-				return fmt.Errorf("unexpected typeflag %d for %s", header.Typeflag, header.Name)
+			if stats := extractor.stats(fsPathTarget); stats != nil {
+				stats.Whiteouts++
+				return nil
 			}
+			return applyWhiteout(targetPath)
 		}
+		// Build target path from header name
+		rel, _ := relPath(header.Name)
+		targetPath, err := extractor.resolve(header.Name, fsPathTarget, rel)
+		if err != nil {
+			return err
+		}
+		if stats := extractor.stats(fsPathTarget); stats != nil {
+			stats.Add(header)
+			return nil
+		}
+
+		// Restore item
+		return extractor.extract(r, header, targetPath, linkTarget)
+	})
+	if err != nil {
+		return err
 	}
+	return extractor.finish()
 }
 
 // ExtractFile extracts the file srcTarPath from the tar archive at tarPath to
-// the filesystem path fsPathTarget.
-func ExtractFile(tarPath, srcTarPath, fsPathTarget string) error {
-	tarFile, err := os.Open(tarPath)
+// the filesystem path fsPathTarget, with the ownership, permissions and times
+// stored in the archive.
+func ExtractFile(tarPath, srcTarPath, fsPathTarget string, opts ...ExtractOption) error {
+	found := false
+	err := walkArchive(tarPath, isName(srcTarPath), func(header *tar.Header, r io.Reader) error {
+		found = true
+		err := newExtractor(opts).extractFile(r, header, fsPathTarget)
+		if err != nil {
+			return err
+		}
+		return errStopWalk
+	})
 	if err != nil {
 		return err
 	}
-	defer tarFile.Close()
-	tarReader := tar.NewReader(tarFile)
-	for header, err := tarReader.Next(); err != io.EOF; header, err = tarReader.Next() {
+	if !found {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+// ExtractAll extracts the directories and files of the tar archive at tarPath
+// in a single pass, each tar path key of targets being extracted to the
+// filesystem path it maps to. Directories are extracted like ExtractDir, and
+// files like ExtractFile. ErrFileNotFound is returned if a tar path is not in
+// the archive.
+func ExtractAll(tarPath string, targets map[string]string, opts ...ExtractOption) error {
+	extractor := NewExtractor(targets, opts...)
+	err := walkArchive(tarPath, extractor.Match, extractor.Extract)
+	if err != nil {
+		return err
+	}
+	return extractor.Finish()
+}
+
+// ReadFile returns the content of the file srcTarPath in the tar archive at
+// tarPath. ErrFileNotFound is returned if there is no such file.
+func ReadFile(tarPath, srcTarPath string, opts ...ExtractOption) ([]byte, error) {
+	var data []byte
+	found := false
+	err := walkArchive(tarPath, isName(srcTarPath), func(header *tar.Header, r io.Reader) error {
+		found = true
+		content, _, err := newExtractor(opts).content(header, r)
 		if err != nil {
 			return err
 		}
-		if header.Name == srcTarPath {
-			fileDir := filepath.Dir(fsPathTarget)
-			err := os.MkdirAll(fileDir, 0o755)
-			if err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", fileDir, err)
-			}
-			f, err := os.OpenFile(fsPathTarget, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm())
-			if err != nil {
-				return fmt.Errorf("failed to open file %s: %w", fsPathTarget, err)
-			}
-			n, err := io.Copy(f, tarReader)
-			if err != nil {
-				return fmt.Errorf("failed to copy file %s: %w", fsPathTarget, err)
-			}
-			if n != header.Size {
-				return fmt.Errorf("failed to copy file %s: copied %d bytes instead of %d", fsPathTarget, n, header.Size)
-			}
-			return nil
+		data, err = io.ReadAll(content)
+		if err != nil {
+			return err
 		}
+		return errStopWalk
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrFileNotFound
+	}
+	return data, nil
+}
+
+// Stat returns the header of the entry srcTarPath in the tar archive at
+// tarPath. ErrFileNotFound is returned if there is no such entry.
+func Stat(tarPath, srcTarPath string) (*tar.Header, error) {
+	var header *tar.Header
+	err := walkArchive(tarPath, isName(srcTarPath), func(h *tar.Header, r io.Reader) error {
+		header = h
+		return errStopWalk
+	})
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, ErrFileNotFound
+	}
+	return header, nil
+}
+
+// isName returns a function matching the entries named name.
+func isName(name string) func(string) bool {
+	return func(entryName string) bool {
+		return entryName == name
 	}
-	return ErrFileNotFound
 }
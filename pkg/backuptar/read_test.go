@@ -3,10 +3,12 @@ package backuptar
 import (
 	"archive/tar"
 	"bytes"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -192,3 +194,328 @@ func TestExtractFile(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractAll(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dir", "file.txt"), []byte("dir data"), 0o644))
+	require.NoError(t, os.Link(filepath.Join(srcDir, "dir", "file.txt"), filepath.Join(srcDir, "link.txt")))
+	srcFile := filepath.Join(tmpDir, "volume.txt")
+	require.NoError(t, os.WriteFile(srcFile, []byte("file data"), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath, WithCompression(CompressionGzip, 0)))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddDir(srcDir, "prefix/volume1"))
+	require.NoError(t, backupWriter.AddFile(srcFile, "prefix/volume2"))
+	require.NoError(t, backupWriter.AddDir(srcDir, "prefix/volume10"))
+	require.NoError(t, backupWriter.AddDir(srcDir, "other/volume1"))
+	require.NoError(t, backupWriter.Close())
+
+	check := func(t *testing.T, outDir string) {
+		got, err := os.ReadFile(filepath.Join(outDir, "volume1", "dir", "file.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("dir data"), got)
+		linkInfo, err := os.Stat(filepath.Join(outDir, "volume1", "link.txt"))
+		require.NoError(t, err)
+		fileInfo, err := os.Stat(filepath.Join(outDir, "volume1", "dir", "file.txt"))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(linkInfo, fileInfo), "hard link was not restored")
+		got, err = os.ReadFile(filepath.Join(outDir, "volume2.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("file data"), got)
+		// Only the requested tar paths are extracted
+		entries, err := os.ReadDir(outDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 2)
+	}
+	targets := func(outDir string) map[string]string {
+		return map[string]string{
+			"prefix/volume1": filepath.Join(outDir, "volume1"),
+			"prefix/volume2": filepath.Join(outDir, "volume2.txt"),
+		}
+	}
+
+	t.Run("archive", func(t *testing.T) {
+		outDir := filepath.Join(tmpDir, "out-archive")
+		require.NoError(t, ExtractAll(tarPath, targets(outDir)))
+		check(t, outDir)
+	})
+	t.Run("stream", func(t *testing.T) {
+		outDir := filepath.Join(tmpDir, "out-stream")
+		f, err := os.Open(tarPath)
+		require.NoError(t, err)
+		defer f.Close()
+		// Hide the file methods, a stream can't be seeked
+		require.NoError(t, ExtractAllFrom(struct{ io.Reader }{f}, targets(outDir)))
+		check(t, outDir)
+	})
+	t.Run("missing tar path", func(t *testing.T) {
+		outDir := filepath.Join(tmpDir, "out-missing")
+		err := ExtractAll(tarPath, map[string]string{
+			"prefix/volume1": filepath.Join(outDir, "volume1"),
+			"prefix/volume3": filepath.Join(outDir, "volume3"),
+		})
+		assert.ErrorIs(t, err, ErrFileNotFound)
+	})
+}
+
+func TestExtractAll_PathFilter(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "keystore"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "keystore", "key1"), []byte("key1"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "keystore", "key2"), []byte("key2"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "db"), []byte("db"), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddDir(srcDir, "prefix/volume"))
+	require.NoError(t, backupWriter.Close())
+
+	outDir := filepath.Join(tmpDir, "out")
+	require.NoError(t, os.MkdirAll(outDir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "db"), []byte("live db"), 0o644))
+	err = ExtractAll(tarPath, map[string]string{"prefix/volume": outDir}, WithPathFilter(func(relPath string) bool {
+		return relPath == "keystore" || relPath == "keystore/key1"
+	}))
+	require.NoError(t, err)
+
+	got, err := os.ReadFile(filepath.Join(outDir, "keystore", "key1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("key1"), got)
+	assert.NoFileExists(t, filepath.Join(outDir, "keystore", "key2"))
+	// Files which are not selected are left as they are
+	got, err = os.ReadFile(filepath.Join(outDir, "db"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("live db"), got)
+	// The volume directory is not restored
+	fi, err := os.Stat(outDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o700), fi.Mode().Perm())
+}
+
+// testEntry is an entry of a tar archive written by writeTestTar.
+type testEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+	whiteout bool
+}
+
+// writeTestTar returns an uncompressed tar archive of the entries.
+func writeTestTar(t testing.TB, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0o755,
+			Size:     int64(len(entry.content)),
+		}
+		if entry.whiteout {
+			header.PAXRecords = map[string]string{paxWhiteout: "1"}
+		}
+		require.NoError(t, tarWriter.WriteHeader(header))
+		_, err := tarWriter.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	return buf.Bytes()
+}
+
+func TestExtractDir_UnsafePaths(t *testing.T) {
+	root := func(t *testing.T) string {
+		return filepath.Join(t.TempDir(), "root")
+	}
+	tc := []struct {
+		name string
+		// entries returns the entries of the archive, outside is a directory
+		// next to the extracted one
+		entries func(outside string) []testEntry
+		err     error
+	}{
+		{
+			name: "dot dot",
+			entries: func(outside string) []testEntry {
+				return []testEntry{
+					{name: "vol/abc", typeflag: tar.TypeDir},
+					{name: "vol/abc/../../outside/escape.txt", typeflag: tar.TypeReg, content: "escape"},
+				}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "absolute symlink parent",
+			entries: func(outside string) []testEntry {
+				return []testEntry{
+					{name: "vol/abc", typeflag: tar.TypeDir},
+					{name: "vol/abc/link", typeflag: tar.TypeSymlink, linkname: outside},
+					{name: "vol/abc/link/escape.txt", typeflag: tar.TypeReg, content: "escape"},
+				}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "relative symlink parent",
+			entries: func(outside string) []testEntry {
+				return []testEntry{
+					{name: "vol/abc", typeflag: tar.TypeDir},
+					{name: "vol/abc/dir", typeflag: tar.TypeDir},
+					{name: "vol/abc/dir/link", typeflag: tar.TypeSymlink, linkname: "../../outside"},
+					{name: "vol/abc/dir/link/escape.txt", typeflag: tar.TypeReg, content: "escape"},
+				}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "directory replaced by symlink",
+			entries: func(outside string) []testEntry {
+				return []testEntry{
+					{name: "vol/abc", typeflag: tar.TypeDir},
+					{name: "vol/abc/dir", typeflag: tar.TypeDir},
+					{name: "vol/abc/dir/file.txt", typeflag: tar.TypeReg, content: "file"},
+					{name: "vol/abc/dir", typeflag: tar.TypeSymlink, linkname: outside},
+					{name: "vol/abc/dir/escape.txt", typeflag: tar.TypeReg, content: "escape"},
+				}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "hard link outside",
+			entries: func(outside string) []testEntry {
+				return []testEntry{
+					{name: "vol/abc", typeflag: tar.TypeDir},
+					{name: "vol/abc/link", typeflag: tar.TypeLink, linkname: "vol/abc/../../outside/secret"},
+				}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "whiteout of the parent",
+			entries: func(outside string) []testEntry {
+				return []testEntry{
+					{name: "vol/abc", typeflag: tar.TypeDir},
+					{name: "vol/abc/.wh..", typeflag: tar.TypeReg, whiteout: true},
+				}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "prefix collision",
+			entries: func(outside string) []testEntry {
+				return []testEntry{
+					{name: "vol/abc", typeflag: tar.TypeDir},
+					{name: "vol/abc/file.txt", typeflag: tar.TypeReg, content: "file"},
+					{name: "vol/abcdef/escape.txt", typeflag: tar.TypeReg, content: "escape"},
+				}
+			},
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			extracts := map[string]func(tarPath, outDir string) error{
+				"dir": func(tarPath, outDir string) error {
+					return ExtractDir(tarPath, "vol/abc", outDir, WithNoSameOwner(), WithWhiteouts())
+				},
+				"all": func(tarPath, outDir string) error {
+					return ExtractAll(tarPath, map[string]string{"vol/abc": outDir}, WithNoSameOwner(), WithWhiteouts())
+				},
+			}
+			for name, extract := range extracts {
+				t.Run(name, func(t *testing.T) {
+					tmpDir := root(t)
+					outside := filepath.Join(tmpDir, "outside")
+					require.NoError(t, os.MkdirAll(outside, 0o755))
+					require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o600))
+					tarPath := filepath.Join(tmpDir, "test.tar")
+					require.NoError(t, os.WriteFile(tarPath, writeTestTar(t, tt.entries(outside)), 0o644))
+
+					err := extract(tarPath, filepath.Join(tmpDir, "out"))
+					if tt.err != nil {
+						assert.ErrorIs(t, err, tt.err)
+						var pathErr *UnsafePathError
+						assert.ErrorAs(t, err, &pathErr)
+					} else {
+						assert.NoError(t, err)
+					}
+					// Nothing is written outside of the extracted directory
+					entries, err := os.ReadDir(outside)
+					require.NoError(t, err)
+					assert.Len(t, entries, 1)
+					assert.NoFileExists(t, filepath.Join(tmpDir, "escape.txt"))
+					assert.NoFileExists(t, filepath.Join(tmpDir, "out", "escape.txt"))
+				})
+			}
+		})
+	}
+}
+
+// treeState describes every file under root except the tree of skip, by path
+// relative to root.
+func treeState(t *testing.T, root, skip string) map[string]string {
+	state := make(map[string]string)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == skip {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		// The times of the directories change with their entries, which
+		// are described themselves
+		desc := fi.Mode().String()
+		if fi.Mode().IsRegular() {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			desc += " " + fi.ModTime().String() + " " + string(data)
+		}
+		state[rel] = desc
+		return nil
+	})
+	require.NoError(t, err)
+	return state
+}
+
+func FuzzExtractAllFrom(f *testing.F) {
+	f.Add(writeTestTar(f, []testEntry{
+		{name: "vol/abc", typeflag: tar.TypeDir},
+		{name: "vol/abc/dir/file.txt", typeflag: tar.TypeReg, content: "file"},
+		{name: "vol/abc/link", typeflag: tar.TypeLink, linkname: "vol/abc/dir/file.txt"},
+		{name: "vol/abc/.wh.file.txt", typeflag: tar.TypeReg},
+	}))
+	f.Add(writeTestTar(f, []testEntry{
+		{name: "vol/abc", typeflag: tar.TypeDir},
+		{name: "vol/abc/../escape.txt", typeflag: tar.TypeReg, content: "escape"},
+		{name: "vol/abc/link", typeflag: tar.TypeSymlink, linkname: "/"},
+		{name: "vol/abc/link/escape.txt", typeflag: tar.TypeReg, content: "escape"},
+		{name: "vol/abcdef/escape.txt", typeflag: tar.TypeReg, content: "escape"},
+	}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// The target is nested, so that entries escaping it by a few levels
+		// still land in the temporary directory
+		tmpDir := t.TempDir()
+		outDir := filepath.Join(tmpDir, "a", "b", "out")
+		for _, dir := range []string{tmpDir, filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "a", "b")} {
+			require.NoError(t, os.MkdirAll(dir, 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "sentinel"), []byte("sentinel"), 0o600))
+		}
+		before := treeState(t, tmpDir, outDir)
+		// Errors are expected, the extraction must only stay in its target
+		_ = ExtractAllFrom(bytes.NewReader(data), map[string]string{"vol/abc": outDir}, WithNoSameOwner(), WithWhiteouts())
+		assert.Equal(t, before, treeState(t, tmpDir, outDir), "written outside of the target")
+	})
+}
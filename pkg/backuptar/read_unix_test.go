@@ -0,0 +1,186 @@
+//go:build unix
+
+package backuptar
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestExtractDir_RoundTrip(t *testing.T) {
+	fileContents := []byte("test file contents")
+
+	tc := []struct {
+		name  string
+		root  bool
+		setup func(t *testing.T, dir string)
+		check func(t *testing.T, dir string)
+	}{
+		{
+			name: "symlink",
+			setup: func(t *testing.T, dir string) {
+				require.NoError(t, os.Mkdir(filepath.Join(dir, "db-v3"), 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "db-v3", "file.txt"), fileContents, 0o644))
+				require.NoError(t, os.Symlink("db-v3", filepath.Join(dir, "current")))
+				require.NoError(t, os.Symlink("/does/not/exist", filepath.Join(dir, "dangling")))
+			},
+			check: func(t *testing.T, dir string) {
+				link, err := os.Readlink(filepath.Join(dir, "current"))
+				require.NoError(t, err)
+				assert.Equal(t, "db-v3", link)
+				data, err := os.ReadFile(filepath.Join(dir, "current", "file.txt"))
+				require.NoError(t, err)
+				assert.Equal(t, fileContents, data)
+				link, err = os.Readlink(filepath.Join(dir, "dangling"))
+				require.NoError(t, err)
+				assert.Equal(t, "/does/not/exist", link)
+			},
+		},
+		{
+			name: "hardlink",
+			setup: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), fileContents, 0o644))
+				require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0o755))
+				require.NoError(t, os.Link(filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub", "b.txt")))
+			},
+			check: func(t *testing.T, dir string) {
+				a, err := os.Stat(filepath.Join(dir, "a.txt"))
+				require.NoError(t, err)
+				b, err := os.Stat(filepath.Join(dir, "sub", "b.txt"))
+				require.NoError(t, err)
+				assert.True(t, os.SameFile(a, b), "files are not hard linked")
+				data, err := os.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+				require.NoError(t, err)
+				assert.Equal(t, fileContents, data)
+			},
+		},
+		{
+			name: "fifo",
+			setup: func(t *testing.T, dir string) {
+				require.NoError(t, unix.Mkfifo(filepath.Join(dir, "pipe"), 0o640))
+			},
+			check: func(t *testing.T, dir string) {
+				info, err := os.Lstat(filepath.Join(dir, "pipe"))
+				require.NoError(t, err)
+				assert.Equal(t, os.ModeNamedPipe, info.Mode().Type())
+			},
+		},
+		{
+			name: "char device",
+			root: true,
+			setup: func(t *testing.T, dir string) {
+				err := mknod(filepath.Join(dir, "null"), &tar.Header{Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3})
+				require.NoError(t, err)
+			},
+			check: func(t *testing.T, dir string) {
+				info, err := os.Lstat(filepath.Join(dir, "null"))
+				require.NoError(t, err)
+				assert.Equal(t, os.ModeDevice|os.ModeCharDevice, info.Mode().Type())
+				var st unix.Stat_t
+				require.NoError(t, unix.Lstat(filepath.Join(dir, "null"), &st))
+				assert.Equal(t, uint32(1), unix.Major(uint64(st.Rdev)))
+				assert.Equal(t, uint32(3), unix.Minor(uint64(st.Rdev)))
+			},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.root && os.Geteuid() != 0 {
+				t.Skip("test requires root")
+			}
+			tmpDir := t.TempDir()
+			srcDir := filepath.Join(tmpDir, "src")
+			require.NoError(t, os.Mkdir(srcDir, 0o755))
+			tt.setup(t, srcDir)
+
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, InitBackupTar(tarPath))
+			backupWriter, err := NewBackupWriter(tarPath)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddDir(srcDir, "test"))
+			require.NoError(t, backupWriter.Close())
+
+			outDir := filepath.Join(tmpDir, "out")
+			require.NoError(t, ExtractDir(tarPath, "test", outDir))
+			tt.check(t, outDir)
+		})
+	}
+}
+
+func TestExtractDir_Attributes(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root")
+	}
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	modTime := time.Date(2023, 5, 1, 10, 30, 0, 0, time.UTC)
+	accessTime := time.Date(2023, 6, 1, 10, 30, 0, 0, time.UTC)
+
+	// Create a directory tree with custom ownership, modes and times
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "data"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "data", "bin"), []byte("binary"), 0o755))
+	require.NoError(t, os.Symlink("bin", filepath.Join(srcDir, "data", "link")))
+	for _, p := range []string{"data/bin", "data/link", "data", "."} {
+		require.NoError(t, os.Lchown(filepath.Join(srcDir, p), 1000, 1001))
+	}
+	require.NoError(t, os.Chmod(filepath.Join(srcDir, "data", "bin"), 0o755|os.ModeSetuid|os.ModeSetgid))
+	require.NoError(t, os.Chmod(filepath.Join(srcDir, "data"), 0o750|os.ModeSticky))
+	require.NoError(t, os.Chmod(srcDir, 0o700))
+	for _, p := range []string{"data/bin", "data/link", "data", "."} {
+		require.NoError(t, lchtimes(filepath.Join(srcDir, p), accessTime, modTime))
+	}
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddDir(srcDir, "test"))
+	require.NoError(t, backupWriter.Close())
+
+	t.Run("same owner", func(t *testing.T) {
+		outDir := filepath.Join(t.TempDir(), "out")
+		require.NoError(t, ExtractDir(tarPath, "test", outDir))
+
+		want := map[string]os.FileMode{
+			".":        os.ModeDir | 0o700,
+			"data":     os.ModeDir | os.ModeSticky | 0o750,
+			"data/bin": os.ModeSetuid | os.ModeSetgid | 0o755,
+		}
+		for p, mode := range want {
+			info, err := os.Stat(filepath.Join(outDir, p))
+			require.NoError(t, err)
+			assert.Equal(t, mode, info.Mode(), p)
+		}
+		for _, p := range []string{".", "data", "data/bin", "data/link"} {
+			info, err := os.Lstat(filepath.Join(outDir, p))
+			require.NoError(t, err)
+			var st unix.Stat_t
+			require.NoError(t, unix.Lstat(filepath.Join(outDir, p), &st))
+			assert.Equal(t, uint32(1000), st.Uid, p)
+			assert.Equal(t, uint32(1001), st.Gid, p)
+			assert.True(t, modTime.Equal(info.ModTime()), "%s: mod time %s", p, info.ModTime())
+			assert.Equal(t, accessTime.Unix(), st.Atim.Sec, p)
+		}
+	})
+
+	t.Run("no same owner", func(t *testing.T) {
+		outDir := filepath.Join(t.TempDir(), "out")
+		require.NoError(t, ExtractDir(tarPath, "test", outDir, WithNoSameOwner()))
+
+		info, err := os.Stat(filepath.Join(outDir, "data", "bin"))
+		require.NoError(t, err)
+		var st unix.Stat_t
+		require.NoError(t, unix.Stat(filepath.Join(outDir, "data", "bin"), &st))
+		assert.Equal(t, uint32(0), st.Uid)
+		assert.Equal(t, uint32(0), st.Gid)
+		assert.Equal(t, os.ModeSetuid|os.ModeSetgid|0o755, info.Mode())
+	})
+}
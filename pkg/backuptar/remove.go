@@ -0,0 +1,219 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// entrySpan locates the stored form of an entry in the tar stream of an
+// archive: its header blocks, content and padding.
+type entrySpan struct {
+	name string
+	// header of the entry, for the index of the rewritten archive
+	header *tar.Header
+	// start and end are the positions of the entry in the tar stream
+	start, end int64
+	// member is the offset of the compressed member holding the start of the
+	// entry, 0 in an uncompressed archive
+	member int64
+}
+
+// RemoveEntries rewrites the archive at tarPath without the entries for which
+// remove returns true, and returns how many were removed. i is the position
+// of the entry named name in the archive, as listed by EntryNames, so that
+// entries sharing a name can be told apart.
+//
+// The kept entries are copied as they are stored, encrypted or sparse, and
+// the archive keeps its compression: the kept entries of a compressed member
+// are compressed again together, at the default level of the algorithm. The
+// archive is written to a temporary file replacing it, or copied back in
+// place if it can't be replaced, such as an archive bind-mounted in a
+// container. Nothing is written if no entry is removed.
+func RemoveEntries(tarPath string, remove func(i int, name string) bool) (int, error) {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	compression, err := fileCompression(file)
+	if err != nil {
+		return 0, err
+	}
+	spans, err := entrySpans(file, fi.Size(), compression)
+	if err != nil {
+		return 0, err
+	}
+	keep := make([]bool, len(spans))
+	removed := 0
+	for i, span := range spans {
+		keep[i] = !remove(i, span.name)
+		if !keep[i] {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(tarPath), ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	idx, err := copyEntries(tmp, file, fi.Size(), compression, spans, keep)
+	if err == nil {
+		err = tmp.Chmod(fi.Mode().Perm())
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to rewrite archive %s: %w", tarPath, err)
+	}
+	if err := replaceFile(tmp.Name(), tarPath); err != nil {
+		return 0, fmt.Errorf("failed to replace archive %s: %w", tarPath, err)
+	}
+	idx.save(tarPath)
+	return removed, nil
+}
+
+// entrySpans scans the archive file f of the given size to locate its
+// entries in its tar stream.
+func entrySpans(f *os.File, size int64, compression Compression) ([]entrySpan, error) {
+	var (
+		spans  []entrySpan
+		end    int64
+		err    error
+		locate = func(pos int64) int64 { return 0 }
+	)
+	add := func(header *tar.Header, start int64) {
+		if len(spans) > 0 {
+			spans[len(spans)-1].end = start
+		}
+		spans = append(spans, entrySpan{name: header.Name, header: header, start: start, member: locate(start)})
+	}
+	if compression == CompressionNone {
+		r := &countingReadSeeker{r: io.NewSectionReader(f, 0, size)}
+		end, err = scan(tar.NewReader(r), func() int64 { return r.n }, add)
+	} else {
+		r := newMemberReader(f, size, compression)
+		defer r.Close()
+		locate = func(pos int64) int64 {
+			offset, _ := r.locate(pos)
+			return offset
+		}
+		end, err = scan(tar.NewReader(r), func() int64 { return r.pos }, add)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(spans) > 0 {
+		spans[len(spans)-1].end = end
+	}
+	return spans, nil
+}
+
+// copyEntries writes to dst an archive holding the entries of the archive
+// file src whose keep flag is set, and returns its index.
+func copyEntries(dst io.Writer, src *os.File, size int64, compression Compression, spans []entrySpan, keep []bool) (*archiveIndex, error) {
+	var r io.Reader
+	if compression == CompressionNone {
+		r = io.NewSectionReader(src, 0, size)
+	} else {
+		members := newMemberReader(src, size, compression)
+		defer members.Close()
+		r = members
+	}
+	idx := &archiveIndex{Compression: compression}
+	out := &countingWriter{w: dst}
+	var (
+		// stream compresses the current member, counted by memberOut
+		stream       io.WriteCloser
+		memberOut    *countingWriter
+		memberOffset int64
+		// member is the offset of the source member of the current one
+		member int64
+		pos    int64
+	)
+	for i, span := range spans {
+		if _, err := io.CopyN(io.Discard, r, span.start-pos); err != nil {
+			return nil, err
+		}
+		pos = span.start
+		if !keep[i] {
+			continue
+		}
+		if stream == nil || span.member != member {
+			if stream != nil {
+				if err := stream.Close(); err != nil {
+					return nil, err
+				}
+			}
+			var err error
+			stream, err = newCompressor(out, compression, 0)
+			if err != nil {
+				return nil, err
+			}
+			memberOut = &countingWriter{w: stream}
+			memberOffset = out.n
+			member = span.member
+		}
+		if compression == CompressionNone {
+			idx.add(span.header, memberOffset+memberOut.n, 0)
+		} else {
+			idx.add(span.header, memberOffset, memberOut.n)
+		}
+		if _, err := io.CopyN(memberOut, r, span.end-span.start); err != nil {
+			return nil, fmt.Errorf("failed to copy entry %s: %w", span.name, err)
+		}
+		pos = span.end
+	}
+	if stream != nil {
+		if err := stream.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	eof := make([]byte, 2*TarBlockSize)
+	if compression != CompressionNone {
+		var err error
+		eof, err = endOfArchive(compression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := out.Write(eof); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// replaceFile renames the file src over dst. If dst can't be replaced, such
+// as a bind-mounted file, the content of src is copied into it instead.
+func replaceFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !isBusy(err) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package backuptar
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveEntries(t *testing.T) {
+	key, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	tc := []struct {
+		name string
+		opts []WriterOption
+	}{
+		{
+			name: "uncompressed",
+		},
+		{
+			name: "gzip",
+			opts: []WriterOption{WithCompression(CompressionGzip, 0)},
+		},
+		{
+			name: "zstd encrypted",
+			opts: []WriterOption{WithCompression(CompressionZstd, 0), WithEncryption(key.Recipient())},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			srcDir := filepath.Join(tmpDir, "src")
+			require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "dir"), 0o755))
+			content := bytes.Repeat([]byte("block"), 1000)
+			require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dir", "file.txt"), content, 0o644))
+			// A file with a hole, stored as a sparse entry when not encrypted
+			sparse, err := os.Create(filepath.Join(srcDir, "sparse"))
+			require.NoError(t, err)
+			_, err = sparse.WriteAt([]byte("end"), 1<<20)
+			require.NoError(t, err)
+			require.NoError(t, sparse.Close())
+
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, InitBackupTar(tarPath))
+			prefixes := []string{"container1", "container2", "container3"}
+			for _, prefix := range prefixes {
+				backupWriter, err := NewBackupWriter(tarPath, tt.opts...)
+				require.NoError(t, err)
+				require.NoError(t, backupWriter.AddDir(srcDir, prefix))
+				require.NoError(t, backupWriter.Close())
+			}
+			names, err := EntryNames(tarPath, "")
+			require.NoError(t, err)
+
+			// Nothing to remove leaves the archive untouched
+			before, err := os.Stat(tarPath)
+			require.NoError(t, err)
+			removed, err := RemoveEntries(tarPath, func(i int, name string) bool { return false })
+			require.NoError(t, err)
+			assert.Equal(t, 0, removed)
+			after, err := os.Stat(tarPath)
+			require.NoError(t, err)
+			assert.Equal(t, before.ModTime(), after.ModTime())
+
+			removed, err = RemoveEntries(tarPath, func(i int, name string) bool {
+				return strings.HasPrefix(name, "container2")
+			})
+			require.NoError(t, err)
+			assert.Equal(t, len(names)/3, removed)
+
+			var expected []string
+			for _, name := range names {
+				if !strings.HasPrefix(name, "container2") {
+					expected = append(expected, name)
+				}
+			}
+			got, err := EntryNames(tarPath, "")
+			require.NoError(t, err)
+			assert.Equal(t, expected, got)
+
+			// The index written for the new archive matches it
+			written := readIndex(t, tarPath)
+			require.NoError(t, os.Remove(IndexPath(tarPath)))
+			f, err := os.Open(tarPath)
+			require.NoError(t, err)
+			defer f.Close()
+			fi, err := f.Stat()
+			require.NoError(t, err)
+			built, err := buildIndex(f, fi.Size(), written.Compression)
+			require.NoError(t, err)
+			assert.Equal(t, built.Entries, written.Entries)
+
+			for _, prefix := range []string{"container1", "container3"} {
+				dst := filepath.Join(tmpDir, "dst", prefix)
+				require.NoError(t, ExtractDir(tarPath, prefix, dst, WithIdentities(key)))
+				data, err := os.ReadFile(filepath.Join(dst, "dir", "file.txt"))
+				require.NoError(t, err)
+				assert.Equal(t, content, data)
+				data, err = os.ReadFile(filepath.Join(dst, "sparse"))
+				require.NoError(t, err)
+				assert.Len(t, data, 1<<20+3)
+				assert.Equal(t, []byte("end"), data[1<<20:])
+			}
+
+			// The rewritten archive can still be appended to
+			backupWriter, err := NewBackupWriter(tarPath, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddDir(srcDir, "container2"))
+			require.NoError(t, backupWriter.Close())
+			got, err = EntryNames(tarPath, "container2")
+			require.NoError(t, err)
+			assert.Len(t, got, len(names)/3)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// entryRouter routes the entries of an archive to the filesystem targets of
+// the tar paths they are under.
+type entryRouter struct {
+	targets map[string]string
+	// prefixes are the tar paths of targets, longest first so that nested
+	// tar paths take precedence
+	prefixes []string
+	// found records the tar paths with extracted entries
+	found map[string]bool
+}
+
+func newEntryRouter(targets map[string]string) *entryRouter {
+	r := &entryRouter{
+		targets: make(map[string]string, len(targets)),
+		found:   make(map[string]bool, len(targets)),
+	}
+	for prefix, target := range targets {
+		prefix = path.Clean(prefix)
+		r.targets[prefix] = target
+		r.prefixes = append(r.prefixes, prefix)
+	}
+	sort.Slice(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i]) > len(r.prefixes[j])
+	})
+	return r
+}
+
+// route returns the tar path the entry named name is under, and the path of
+// the entry relative to it, "." for the tar path itself.
+func (r *entryRouter) route(name string) (string, string, bool) {
+	for _, prefix := range r.prefixes {
+		if name == prefix {
+			return prefix, ".", true
+		}
+		if relPath, ok := strings.CutPrefix(name, prefix+"/"); ok {
+			return prefix, relPath, true
+		}
+	}
+	return "", "", false
+}
+
+func (r *entryRouter) match(name string) bool {
+	_, _, ok := r.route(name)
+	return ok
+}
+
+// linkTarget returns the filesystem path of the hard link target linkname.
+func (r *entryRouter) linkTarget(extractor *extractor, linkname string) (string, error) {
+	prefix, relPath, ok := r.route(linkname)
+	if !ok {
+		return "", fmt.Errorf("hard link target %s is not extracted", linkname)
+	}
+	return extractor.resolve(linkname, r.targets[prefix], relPath)
+}
+
+// extract restores the entry described by header, with its content read from
+// r, with extractor.
+func (r *entryRouter) extract(extractor *extractor, header *tar.Header, content io.Reader) error {
+	prefix, relPath, ok := r.route(header.Name)
+	if !ok {
+		return nil
+	}
+	r.found[prefix] = true
+	if !extractor.selected(prefix, header) {
+		return nil
+	}
+	if extractor.opts.whiteouts && header.Name != prefix {
+		if deleted, ok := IsWhiteout(header); ok {
+			prefix, relPath, _ := r.route(deleted)
+			target, err := extractor.resolveWhiteout(header.Name, r.targets[prefix], relPath)
+			if err != nil {
+				return err
+			}
+			if stats := extractor.stats(r.targets[prefix]); stats != nil {
+				stats.Whiteouts++
+				return nil
+			}
+			return applyWhiteout(target)
+		}
+	}
+	target, err := extractor.resolve(header.Name, r.targets[prefix], relPath)
+	if err != nil {
+		return err
+	}
+	if header.Name == prefix && header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeReg {
+		return fmt.Errorf("%s is not a directory or a regular file", prefix)
+	}
+	if stats := extractor.stats(r.targets[prefix]); stats != nil {
+		stats.Add(header)
+		return nil
+	}
+	if header.Name == prefix && header.Typeflag == tar.TypeReg {
+		return extractor.extractFile(content, header, target)
+	}
+	return extractor.extract(content, header, target, func(linkname string) (string, error) {
+		return r.linkTarget(extractor, linkname)
+	})
+}
+
+// finish completes the extraction, and checks that every tar path was found.
+func (r *entryRouter) finish(extractor *extractor) error {
+	err := extractor.finish()
+	if err != nil {
+		return err
+	}
+	for _, prefix := range r.prefixes {
+		if r.found[prefix] {
+			continue
+		}
+		if stats := extractor.stats(r.targets[prefix]); stats != nil {
+			stats.Missing = true
+			continue
+		}
+		return fmt.Errorf("%w: %s", ErrFileNotFound, prefix)
+	}
+	return nil
+}
+
+// Extractor restores entries to filesystem targets like ExtractAll, for
+// entries read from other sources than a tar archive, such as another
+// storage format using the headers of this package.
+type Extractor struct {
+	router    *entryRouter
+	extractor *extractor
+}
+
+// NewExtractor returns an Extractor restoring each tar path key of targets to
+// the filesystem path it maps to.
+func NewExtractor(targets map[string]string, opts ...ExtractOption) *Extractor {
+	return &Extractor{
+		router:    newEntryRouter(targets),
+		extractor: newExtractor(opts),
+	}
+}
+
+// Match reports whether the entry named name is under one of the tar paths
+// of the targets.
+func (e *Extractor) Match(name string) bool {
+	return e.router.match(name)
+}
+
+// Extract restores the entry described by header, with its content read from
+// r. Entries which don't match are ignored.
+func (e *Extractor) Extract(header *tar.Header, r io.Reader) error {
+	return e.router.extract(e.extractor, header, r)
+}
+
+// Finish completes the extraction once all the entries are extracted.
+// ErrFileNotFound is returned if a tar path had no entry.
+func (e *Extractor) Finish() error {
+	return e.router.finish(e.extractor)
+}
@@ -0,0 +1,195 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Strategies of the snapshots made by SnapshotDir and SnapshotFile.
+const (
+	// SnapshotBtrfs is a read-only snapshot of a btrfs subvolume.
+	SnapshotBtrfs = "btrfs"
+	// SnapshotReflink is a copy whose files share their data blocks with
+	// the originals, on filesystems supporting reflinks such as btrfs and
+	// XFS.
+	SnapshotReflink = "reflink"
+)
+
+// SnapshotName is the name of the snapshot of a directory made without a
+// staging path. It is made inside the directory, so that it is on the same
+// filesystem even if the directory is a mount point, and should always be
+// excluded from the walks of the directory, which may hold the snapshot of an
+// interrupted backup. The snapshot of a file without a staging path is made
+// next to it, named SnapshotName followed by a dash and the name of the file.
+const SnapshotName = ".snapshotter-snapshot"
+
+// Snapshot is a point-in-time copy of a directory or a file, made cheaply by
+// the filesystem, to back it up while it keeps changing.
+type Snapshot struct {
+	// Path is the path of the copy.
+	Path string
+	// Strategy is the strategy the snapshot was made with.
+	Strategy string
+}
+
+// SnapshotDir makes a snapshot of the directory src at dst with the first of
+// the strategies that works, and returns the errors of all of them if none
+// does. dst must be on the filesystem of src, the snapshot is made inside src
+// if it is empty. The snapshot of an interrupted backup is removed first.
+func SnapshotDir(src, dst string, strategies ...string) (*Snapshot, error) {
+	path := dst
+	if path == "" {
+		path = snapshotPath(src, true)
+	}
+	if err := removeSnapshot(path); err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, strategy := range strategies {
+		var err error
+		switch strategy {
+		case SnapshotBtrfs:
+			err = btrfsSnapshot(src, path)
+		case SnapshotReflink:
+			err = cloneTree(src, path, cloneFile)
+		default:
+			err = errors.New("unknown strategy")
+		}
+		if err == nil {
+			return &Snapshot{Path: path, Strategy: strategy}, nil
+		}
+		errs = append(errs, fmt.Errorf("%s snapshot of %s failed: %w", strategy, src, err))
+		if err := removeSnapshot(path); err != nil {
+			return nil, errors.Join(append(errs, err)...)
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no snapshot strategy for %s", src)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// SnapshotFile makes a reflink copy of the regular file src at dst, which
+// must be on the filesystem of src, or next to src if dst is empty.
+func SnapshotFile(src, dst string) (*Snapshot, error) {
+	path := dst
+	if path == "" {
+		path = snapshotPath(src, false)
+	}
+	if err := removeSnapshot(path); err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+	header, err := fileHeader(src, fi, "", path, addOptions{xattrs: true})
+	if err == nil {
+		err = cloneContent(src, path, fi, cloneFile)
+	}
+	if err == nil {
+		err = newExtractor(nil).setAttributes(path, header)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s snapshot of %s failed: %w", SnapshotReflink, src, err)
+		return nil, errors.Join(err, removeSnapshot(path))
+	}
+	return &Snapshot{Path: path, Strategy: SnapshotReflink}, nil
+}
+
+// snapshotPath returns the path of the snapshot of the directory or file src
+// made without a staging path.
+func snapshotPath(src string, dir bool) string {
+	if dir {
+		return filepath.Join(src, SnapshotName)
+	}
+	return filepath.Join(filepath.Dir(src), SnapshotName+"-"+filepath.Base(src))
+}
+
+// RemoveStaleSnapshot removes the snapshot of the directory or file src left
+// by an interrupted backup without a staging path, if there is one.
+func RemoveStaleSnapshot(src string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return removeSnapshot(snapshotPath(src, fi.IsDir()))
+}
+
+// Remove deletes the snapshot.
+func (s *Snapshot) Remove() error {
+	return removeSnapshot(s.Path)
+}
+
+// removeSnapshot removes the snapshot at path, if there is one. Btrfs
+// snapshots are deleted as subvolumes, which is quicker, and the only way for
+// read-only ones.
+func removeSnapshot(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	subvolume, err := isSubvolume(path)
+	if err != nil {
+		return err
+	}
+	if subvolume {
+		return deleteSubvolume(path)
+	}
+	return os.RemoveAll(path)
+}
+
+// cloneTree copies the directory src to dst, with the attributes of its
+// files, the content of the regular files being copied by clone. The snapshot
+// in src is skipped.
+func cloneTree(src, dst string, clone func(dst, src *os.File) error) error {
+	filter, err := NewFilter(nil, []string{"/" + SnapshotName + "/"})
+	if err != nil {
+		return err
+	}
+	e := newExtractor(nil)
+	linkTarget := func(name string) (string, error) {
+		return filepath.Join(dst, name), nil
+	}
+	err = FileHeaders(src, "", func(header *tar.Header, file string, fi os.FileInfo) error {
+		target := filepath.Join(dst, header.Name)
+		if header.Typeflag == tar.TypeReg {
+			if err := cloneContent(file, target, fi, clone); err != nil {
+				return err
+			}
+			return e.setAttributes(target, header)
+		}
+		return e.extract(nil, header, target, linkTarget)
+	}, WithXattrs(), WithFilter(filter))
+	if err != nil {
+		return err
+	}
+	return e.finish()
+}
+
+// cloneContent creates the regular file dst with the content of the file src
+// described by fi, copied by clone.
+func cloneContent(src, dst string, fi os.FileInfo, clone func(dst, src *os.File) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = clone(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clone file %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
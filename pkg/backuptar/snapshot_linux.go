@@ -0,0 +1,102 @@
+package backuptar
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Btrfs ioctls and structures, from linux/btrfs.h.
+const (
+	btrfsIocSnapDestroy  = 0x5000940f
+	btrfsIocSnapCreateV2 = 0x50009417
+	btrfsSubvolRdonly    = 1 << 1
+	// btrfsFirstFreeObjectid is the inode number of the root directory of
+	// the subvolumes
+	btrfsFirstFreeObjectid = 256
+)
+
+type btrfsVolArgs struct {
+	fd   int64
+	name [4088]byte
+}
+
+type btrfsVolArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	unused  [4]uint64
+	name    [4040]byte
+}
+
+// cloneFile shares the data blocks of src with dst, which must be on the same
+// filesystem.
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// isSubvolume reports whether path is the root directory of a btrfs
+// subvolume.
+func isSubvolume(path string) (bool, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return false, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR || st.Ino != btrfsFirstFreeObjectid {
+		return false, nil
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return false, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return uint32(fs.Type) == unix.BTRFS_SUPER_MAGIC, nil
+}
+
+// btrfsSnapshot makes a read-only snapshot of the btrfs subvolume src at dst.
+func btrfsSnapshot(src, dst string) error {
+	subvolume, err := isSubvolume(src)
+	if err != nil {
+		return err
+	}
+	if !subvolume {
+		return errors.New("not a btrfs subvolume")
+	}
+	srcDir, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcDir.Close()
+	parent, err := os.Open(filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	args := btrfsVolArgsV2{fd: int64(srcDir.Fd()), flags: btrfsSubvolRdonly}
+	copy(args.name[:len(args.name)-1], filepath.Base(dst))
+	return ioctl(parent, btrfsIocSnapCreateV2, unsafe.Pointer(&args))
+}
+
+// deleteSubvolume deletes the btrfs subvolume at path.
+func deleteSubvolume(path string) error {
+	parent, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	var args btrfsVolArgs
+	copy(args.name[:len(args.name)-1], filepath.Base(path))
+	return ioctl(parent, btrfsIocSnapDestroy, unsafe.Pointer(&args))
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	runtime.KeepAlive(f)
+	if errno != 0 {
+		return &os.PathError{Op: "ioctl", Path: f.Name(), Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package backuptar
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile always fails, reflinks are only supported on Linux.
+func cloneFile(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
+
+// isSubvolume reports false, btrfs subvolumes are only supported on Linux.
+func isSubvolume(path string) (bool, error) {
+	return false, nil
+}
+
+// btrfsSnapshot always fails, btrfs subvolumes are only supported on Linux.
+func btrfsSnapshot(src, dst string) error {
+	return errors.ErrUnsupported
+}
+
+// deleteSubvolume always fails, btrfs subvolumes are only supported on Linux.
+func deleteSubvolume(path string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,146 @@
+package backuptar
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneTree(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "chaindata", "ancient"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "chaindata", "000001.ldb"), []byte("ldb"), 0o600))
+	require.NoError(t, os.Link(filepath.Join(src, "chaindata", "000001.ldb"), filepath.Join(src, "chaindata", "linked.ldb")))
+	require.NoError(t, os.Symlink("chaindata/000001.ldb", filepath.Join(src, "current")))
+	// A snapshot of an interrupted backup
+	require.NoError(t, os.MkdirAll(filepath.Join(src, SnapshotName, "chaindata"), 0o755))
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "chaindata"), mtime, mtime))
+
+	// The content is copied instead of cloned, which the filesystem of the
+	// test may not support
+	dst := filepath.Join(t.TempDir(), "snapshot")
+	err := cloneTree(src, dst, func(dst, src *os.File) error {
+		_, err := io.Copy(dst, src)
+		return err
+	})
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(dst)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"chaindata", "current"}, names)
+	data, err := os.ReadFile(filepath.Join(dst, "current"))
+	require.NoError(t, err)
+	assert.Equal(t, "ldb", string(data))
+	fi, err := os.Stat(filepath.Join(dst, "chaindata"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o750), fi.Mode().Perm())
+	assert.True(t, fi.ModTime().Equal(mtime))
+	fi, err = os.Stat(filepath.Join(dst, "chaindata", "000001.ldb"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	linked, err := os.Stat(filepath.Join(dst, "chaindata", "linked.ldb"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(fi, linked))
+}
+
+func TestSnapshotDir(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "data"), []byte("data"), 0o644))
+
+	_, err := SnapshotDir(src, "", "overlay")
+	assert.ErrorContains(t, err, "unknown strategy")
+	_, err = SnapshotDir(src, "")
+	assert.ErrorContains(t, err, "no snapshot strategy")
+
+	s, err := SnapshotDir(src, "", SnapshotBtrfs, SnapshotReflink)
+	if err != nil {
+		// Neither btrfs nor reflinks are supported by the filesystem of the
+		// test, the failed snapshot is removed
+		assert.ErrorContains(t, err, "btrfs snapshot")
+		assert.ErrorContains(t, err, "reflink snapshot")
+		_, err := os.Lstat(filepath.Join(src, SnapshotName))
+		assert.True(t, os.IsNotExist(err))
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(s.Path, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	require.NoError(t, s.Remove())
+	_, err = os.Lstat(s.Path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSnapshot_Staging(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "data"), []byte("data"), 0o644))
+	staging := t.TempDir()
+
+	tc := []struct {
+		name     string
+		snapshot func(dst string) (*Snapshot, error)
+	}{
+		{
+			name: "dir",
+			snapshot: func(dst string) (*Snapshot, error) {
+				return SnapshotDir(src, dst, SnapshotReflink)
+			},
+		},
+		{
+			name: "file",
+			snapshot: func(dst string) (*Snapshot, error) {
+				return SnapshotFile(filepath.Join(src, "data"), dst)
+			},
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(staging, tt.name)
+			s, err := tt.snapshot(dst)
+			if err != nil {
+				// Reflinks are not supported by the filesystem of the
+				// test, the failed snapshot is removed from the staging
+				// directory
+				assert.ErrorContains(t, err, "to "+dst)
+				_, err := os.Lstat(dst)
+				assert.True(t, os.IsNotExist(err))
+			} else {
+				assert.Equal(t, dst, s.Path)
+				require.NoError(t, s.Remove())
+			}
+			// Nothing is made in or next to the volume
+			entries, err := os.ReadDir(src)
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
+
+func TestRemoveStaleSnapshot(t *testing.T) {
+	src := t.TempDir()
+	file := filepath.Join(src, "file")
+	require.NoError(t, os.WriteFile(file, []byte("file"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, SnapshotName, "chaindata"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, SnapshotName+"-file"), []byte("file"), 0o644))
+
+	require.NoError(t, RemoveStaleSnapshot(src))
+	_, err := os.Lstat(filepath.Join(src, SnapshotName))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, RemoveStaleSnapshot(file))
+	_, err = os.Lstat(filepath.Join(src, SnapshotName+"-file"))
+	assert.True(t, os.IsNotExist(err))
+	// Nothing is left to remove
+	require.NoError(t, RemoveStaleSnapshot(src))
+	require.NoError(t, RemoveStaleSnapshot(filepath.Join(src, "missing")))
+	_, err = os.Stat(file)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,237 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// paxGNUSparsePrefix is the prefix of the PAX records describing a sparse
+	// file in the GNU formats.
+	paxGNUSparsePrefix = "GNU.sparse."
+
+	// sparseBlockSize is the granularity at which runs of zeros are turned
+	// into holes when a sparse file is restored.
+	sparseBlockSize = 4096
+)
+
+// region is a range of a file holding data.
+type region struct {
+	offset int64
+	length int64
+}
+
+// writeSparse writes the regular file f, described by header, as a PAX 1.0
+// sparse entry like GNU tar does: only the data regions of the file are
+// stored, preceded by a map of their offsets and lengths.
+//
+// archive/tar can't write sparse entries, so the entry is written to the
+// underlying stream, after the pending data of the tar writer is flushed by
+// startEntry.
+// The content of the file, holes included, is written to h.
+func (b *BackupWriter) writeSparse(header *tar.Header, f *os.File, regions []region, h hash.Hash) error {
+	// GNU tar ends the map with an empty region when the file ends with a
+	// hole, to record the real size of the file.
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length < header.Size {
+		regions = append(regions, region{offset: header.Size})
+	}
+	sparseMap := strconv.AppendInt(nil, int64(len(regions)), 10)
+	sparseMap = append(sparseMap, '\n')
+	storedSize := int64(0)
+	for _, r := range regions {
+		sparseMap = strconv.AppendInt(sparseMap, r.offset, 10)
+		sparseMap = append(sparseMap, '\n')
+		sparseMap = strconv.AppendInt(sparseMap, r.length, 10)
+		sparseMap = append(sparseMap, '\n')
+		storedSize += r.length
+	}
+	sparseMap = append(sparseMap, make([]byte, blockPadding(int64(len(sparseMap))))...)
+	storedSize += int64(len(sparseMap))
+
+	sparseHeader := *header
+	dir, file := path.Split(header.Name)
+	sparseHeader.Name = path.Join(dir, "GNUSparseFile.0", file)
+	sparseHeader.Size = storedSize
+	sparseHeader.Format = tar.FormatPAX
+	rawHeader, err := encodeHeader(&sparseHeader, map[string]string{
+		paxGNUSparsePrefix + "major":    "1",
+		paxGNUSparsePrefix + "minor":    "0",
+		paxGNUSparsePrefix + "name":     header.Name,
+		paxGNUSparsePrefix + "realsize": strconv.FormatInt(header.Size, 10),
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.out.Write(rawHeader); err != nil {
+		return err
+	}
+	if _, err := b.out.Write(sparseMap); err != nil {
+		return err
+	}
+	offset := int64(0)
+	for _, r := range regions {
+		hashZeros(h, r.offset-offset)
+		offset = r.offset + r.length
+		n, err := io.Copy(b.out, io.TeeReader(io.NewSectionReader(f, r.offset, r.length), h))
+		if err != nil {
+			return err
+		}
+		if n != r.length {
+			return fmt.Errorf("file %s changed while being added: read %d bytes instead of %d", header.Name, n, r.length)
+		}
+	}
+	_, err = b.out.Write(make([]byte, blockPadding(storedSize)))
+	return err
+}
+
+// encodeHeader returns the raw tar header blocks of header, with the extra
+// PAX records merged into its PAX extended header. archive/tar drops GNU
+// sparse records from Header.PAXRecords, so the extended header is built here.
+func encodeHeader(header *tar.Header, extra map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tar.NewWriter(&buf).WriteHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	// The last block is the header itself, anything before is an extended
+	// header. Read it back to get the records archive/tar generated.
+	raw := buf.Bytes()
+	written, err := tar.NewReader(bytes.NewReader(raw)).Next()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]string, len(written.PAXRecords)+len(extra))
+	for k, v := range written.PAXRecords {
+		records[k] = v
+	}
+	for k, v := range extra {
+		records[k] = v
+	}
+	paxHeader, err := paxHeaderBlocks(header.Name, records)
+	if err != nil {
+		return nil, err
+	}
+	return append(paxHeader, raw[len(raw)-TarBlockSize:]...), nil
+}
+
+// paxHeaderBlocks returns the PAX extended header, with its data, holding
+// records for the entry named name.
+func paxHeaderBlocks(name string, records map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var data []byte
+	for _, k := range keys {
+		v := records[k]
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return nil, fmt.Errorf("invalid PAX record key %q", k)
+		}
+		// The length of a record includes the digits of the length itself,
+		// which may add a digit.
+		size := len(k) + len(v) + 3
+		size += len(strconv.Itoa(size))
+		record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+		if len(record) != size {
+			record = strconv.Itoa(len(record)) + " " + k + "=" + v + "\n"
+		}
+		data = append(data, record...)
+	}
+
+	block := make([]byte, TarBlockSize)
+	dir, file := path.Split(name)
+	headerName := path.Join(dir, "PaxHeaders.0", file)
+	if len(headerName) > 100 {
+		headerName = headerName[:100]
+	}
+	copy(block[0:100], headerName)
+	copy(block[100:108], "0000644\x00")                       // mode
+	copy(block[108:116], "0000000\x00")                       // uid
+	copy(block[116:124], "0000000\x00")                       // gid
+	copy(block[124:136], fmt.Sprintf("%011o\x00", len(data))) // size
+	copy(block[136:148], "00000000000\x00")                   // mtime
+	block[156] = tar.TypeXHeader
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+	// The checksum is computed with the checksum field filled with spaces
+	copy(block[148:156], "        ")
+	checksum := 0
+	for _, c := range block {
+		checksum += int(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+
+	data = append(data, make([]byte, blockPadding(int64(len(data))))...)
+	return append(block, data...), nil
+}
+
+// blockPadding returns the number of bytes needed to pad size to a multiple of
+// the tar block size.
+func blockPadding(size int64) int64 {
+	return -size & (TarBlockSize - 1)
+}
+
+// isSparse reports whether header describes a file that was stored without
+// its holes.
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range header.PAXRecords {
+		if strings.HasPrefix(k, paxGNUSparsePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// copySparse copies r into f, seeking over blocks of zeros instead of writing
+// them so they become holes in f.
+func copySparse(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, 32*sparseBlockSize)
+	var written int64
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		for off := 0; off < n; off += sparseBlockSize {
+			block := buf[off:min(off+sparseBlockSize, n)]
+			var err error
+			if isZero(block) {
+				_, err = f.Seek(int64(len(block)), io.SeekCurrent)
+			} else {
+				_, err = f.Write(block)
+			}
+			if err != nil {
+				return written, err
+			}
+			written += int64(len(block))
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+	// Seeking past the end doesn't extend the file, a trailing hole needs the
+	// size to be set.
+	return written, f.Truncate(written)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package backuptar
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataRegions returns the regions of f holding data, found with SEEK_DATA and
+// SEEK_HOLE, or nil if f, described by fi, has no holes.
+func dataRegions(f *os.File, fi os.FileInfo) ([]region, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Blocks*512 >= fi.Size() {
+		// Every byte is allocated, there are no holes
+		return nil, nil
+	}
+	fd := int(f.Fd())
+	size := fi.Size()
+	regions := []region{}
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, unix.ENXIO) {
+				// Only a hole is left
+				break
+			}
+			if errors.Is(err, unix.EINVAL) {
+				// SEEK_DATA is not supported by the filesystem
+				return nil, nil
+			}
+			return nil, err
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		regions = append(regions, region{offset: data, length: hole - data})
+		offset = hole
+	}
+	if len(regions) == 1 && regions[0].offset == 0 && regions[0].length == size {
+		return nil, nil
+	}
+	return regions, nil
+}
@@ -0,0 +1,98 @@
+package backuptar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupWriter_Sparse(t *testing.T) {
+	const size = 64 << 20
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	require.NoError(t, os.Mkdir(srcDir, 0o755))
+
+	// Create files with data between holes, and ending with a hole
+	data := bytes.Repeat([]byte("rocksdb"), 1000)
+	files := map[string][]int64{
+		"journal":  {0, size / 2},
+		"prealloc": {size / 4},
+		"empty":    {},
+	}
+	for name, offsets := range files {
+		f, err := os.Create(filepath.Join(srcDir, name))
+		require.NoError(t, err)
+		require.NoError(t, f.Truncate(size))
+		for _, offset := range offsets {
+			_, err := f.WriteAt(data, offset)
+			require.NoError(t, err)
+		}
+		require.NoError(t, f.Close())
+	}
+	info, err := os.Stat(filepath.Join(srcDir, "journal"))
+	require.NoError(t, err)
+	if info.Sys().(*syscall.Stat_t).Blocks*512 >= size {
+		t.Skip("filesystem does not support sparse files")
+	}
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddDir(srcDir, "test"))
+	require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, "prealloc"), "prealloc"))
+	require.NoError(t, backupWriter.Close())
+
+	// Only the data regions are stored
+	tarInfo, err := os.Stat(tarPath)
+	require.NoError(t, err)
+	assert.Less(t, tarInfo.Size(), int64(1<<20))
+
+	outDir := filepath.Join(tmpDir, "out")
+	require.NoError(t, ExtractDir(tarPath, "test", outDir))
+	require.NoError(t, ExtractFile(tarPath, "prealloc", filepath.Join(tmpDir, "prealloc")))
+
+	check := func(path string, offsets []int64) {
+		want := make([]byte, size)
+		for _, offset := range offsets {
+			copy(want[offset:], data)
+		}
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(want, got), "content of %s differs", path)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Less(t, info.Sys().(*syscall.Stat_t).Blocks*512, int64(1<<20), "holes of %s were not recreated", path)
+	}
+	for name, offsets := range files {
+		check(filepath.Join(outDir, name), offsets)
+	}
+	check(filepath.Join(tmpDir, "prealloc"), files["prealloc"])
+
+	// The index locates the entries following the sparse ones
+	f, err := os.Open(tarPath)
+	require.NoError(t, err)
+	defer f.Close()
+	built, err := buildIndex(f, tarInfo.Size(), CompressionNone)
+	require.NoError(t, err)
+	assert.Equal(t, readIndex(t, tarPath).Entries, built.Entries)
+
+	// Checksums cover the holes
+	checksums, err := ReadChecksums(tarPath, "")
+	require.NoError(t, err)
+	assert.Equal(t, backupWriter.Checksums(), checksums)
+	for _, c := range checksums {
+		assert.Equal(t, int64(size), c.Size)
+		if filepath.Base(c.Name) == "empty" {
+			want := sha256.Sum256(make([]byte, size))
+			assert.Equal(t, hex.EncodeToString(want[:]), c.SHA256)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Prefixes of the names of the staging and previous content paths of the
+// staged targets.
+const (
+	stagingPrefix = ".snapshotter-restore-"
+	oldPrefix     = ".snapshotter-old-"
+)
+
+// StagedTarget restores a filesystem target atomically: the entries are
+// extracted to its staging Path, and Commit replaces the target with them.
+// The previous content of the target is kept until Finish, so that Rollback
+// can bring it back.
+//
+// A target is replaced by exchanging it with its staging path, which is next
+// to it. Mount points, such as the volumes of a container, can't be renamed:
+// the staging path of a directory mount point is inside it and the entries
+// are moved one by one, and the content of a file mount point is copied in
+// place.
+type StagedTarget struct {
+	// Path is the path the target is extracted to.
+	Path   string
+	target string
+	dir    bool
+	// exists is set if there was a target to replace
+	exists bool
+	// inPlace is set for mount points, whose entries or content are moved
+	// instead of the target itself
+	inPlace bool
+	// old holds the previous content of the target once committed
+	old       string
+	committed bool
+	// moved is set once the staged entries of an in-place directory started
+	// moving into the target
+	moved bool
+	// oldHeader holds the attributes of an in-place directory target before
+	// it was committed
+	oldHeader *tar.Header
+	extractor *extractor
+}
+
+// StageDir stages the restore of the directory target. The ownership of the
+// restored files follows the extract options.
+func StageDir(target string, opts ...ExtractOption) (*StagedTarget, error) {
+	s := &StagedTarget{target: target, dir: true, extractor: newExtractor(opts)}
+	fi, err := os.Lstat(target)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("path %s exists, but is not a directory", target)
+		}
+		s.exists = true
+		s.inPlace, err = isMountPoint(target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !s.inPlace {
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return nil, err
+		}
+		s.Path, err = os.MkdirTemp(filepath.Dir(target), stagingPrefix+filepath.Base(target)+"-")
+		if err != nil && s.exists {
+			// The parent directory can't be written, the entries are
+			// moved instead
+			s.inPlace = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if s.inPlace {
+		s.Path, err = os.MkdirTemp(target, stagingPrefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// StageFile stages the restore of the regular file target.
+func StageFile(target string, opts ...ExtractOption) (*StagedTarget, error) {
+	s := &StagedTarget{target: target, extractor: newExtractor(opts)}
+	fi, err := os.Lstat(target)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if fi.IsDir() {
+			return nil, fmt.Errorf("path %s exists, but is a directory", target)
+		}
+		s.exists = true
+		s.inPlace, err = isMountPoint(target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(target), stagingPrefix+filepath.Base(target)+"-")
+	if err != nil {
+		return nil, err
+	}
+	s.Path = f.Name()
+	return s, f.Close()
+}
+
+// Commit replaces the target with the staged entries. If it fails, the
+// target is left as it was, or in a state Rollback brings back.
+func (s *StagedTarget) Commit() error {
+	if s.committed {
+		return nil
+	}
+	switch {
+	case !s.exists:
+		if err := os.Rename(s.Path, s.target); err != nil {
+			return err
+		}
+		s.committed = true
+		return nil
+	case s.inPlace && s.dir:
+		return s.commitEntries()
+	case s.inPlace:
+		return s.commitCopy()
+	}
+	// The staging path receives the previous content
+	if err := exchange(s.Path, s.target); err == nil {
+		s.old = s.Path
+		s.committed = true
+		return nil
+	}
+	old := s.Path + ".old"
+	if err := os.Rename(s.target, old); err != nil {
+		if !s.dir && isBusy(err) {
+			// A mount point which is not listed as such
+			return s.commitCopy()
+		}
+		return err
+	}
+	if err := os.Rename(s.Path, s.target); err != nil {
+		return errors.Join(err, os.Rename(old, s.target))
+	}
+	// Keep the staging path for the new content on rollback
+	s.old = old
+	s.committed = true
+	return nil
+}
+
+// commitEntries moves the entries of the directory target to an old directory
+// inside it, and the staged entries into it.
+func (s *StagedTarget) commitEntries() error {
+	var err error
+	s.oldHeader, err = dirHeader(s.target)
+	if err != nil {
+		return err
+	}
+	s.old, err = os.MkdirTemp(s.target, oldPrefix)
+	if err != nil {
+		return err
+	}
+	s.committed = true
+	if err := moveEntries(s.target, s.old, s.isStagingEntry); err != nil {
+		return err
+	}
+	s.moved = true
+	if err := moveEntries(s.Path, s.target, nil); err != nil {
+		return err
+	}
+	// The attributes of the restored directory were applied to its staging
+	// path, the times are applied last as the moves change them
+	header, err := dirHeader(s.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(s.Path); err != nil {
+		return err
+	}
+	return s.extractor.setAttributes(s.target, header)
+}
+
+// commitCopy copies the previous content of the file target aside, and the
+// staged content into it in place.
+func (s *StagedTarget) commitCopy() error {
+	f, err := os.CreateTemp(filepath.Dir(s.Path), oldPrefix+filepath.Base(s.target)+"-")
+	if err != nil {
+		return err
+	}
+	s.old = f.Name()
+	f.Close()
+	if err := copyFile(s.target, s.old, s.extractor); err != nil {
+		return errors.Join(err, os.Remove(s.old))
+	}
+	s.committed = true
+	if err := copyFile(s.Path, s.target, s.extractor); err != nil {
+		return err
+	}
+	return os.Remove(s.Path)
+}
+
+// isStagingEntry reports whether the entry of the target directory named name
+// is its staging or old directory.
+func (s *StagedTarget) isStagingEntry(name string) bool {
+	return name == filepath.Base(s.Path) || name == filepath.Base(s.old)
+}
+
+// Rollback discards the staged entries and, if the target was committed,
+// brings its previous content back.
+func (s *StagedTarget) Rollback() error {
+	if !s.committed {
+		return os.RemoveAll(s.Path)
+	}
+	var err error
+	switch {
+	case !s.exists:
+		err = os.Rename(s.target, s.Path)
+	case s.inPlace && s.dir:
+		err = s.rollbackEntries()
+	case s.inPlace:
+		err = copyFile(s.old, s.target, s.extractor)
+		if err == nil {
+			err = os.Remove(s.old)
+		}
+	case s.old == s.Path:
+		err = exchange(s.Path, s.target)
+	default:
+		err = os.Rename(s.target, s.Path)
+		if err == nil {
+			err = os.Rename(s.old, s.target)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to roll back the restore of %s: %w", s.target, err)
+	}
+	s.committed = false
+	return os.RemoveAll(s.Path)
+}
+
+// rollbackEntries moves the restored entries of an in-place directory back to
+// its staging path, and the previous ones back into it.
+func (s *StagedTarget) rollbackEntries() error {
+	if s.moved {
+		if err := os.MkdirAll(s.Path, 0o700); err != nil {
+			return err
+		}
+		if err := moveEntries(s.target, s.Path, s.isStagingEntry); err != nil {
+			return err
+		}
+	}
+	if err := moveEntries(s.old, s.target, nil); err != nil {
+		return err
+	}
+	if err := os.Remove(s.old); err != nil {
+		return err
+	}
+	return s.extractor.setAttributes(s.target, s.oldHeader)
+}
+
+// Finish removes the previous content of a committed target.
+func (s *StagedTarget) Finish() error {
+	if !s.committed || s.old == "" {
+		return nil
+	}
+	return os.RemoveAll(s.old)
+}
+
+// moveEntries renames the entries of the directory src into the directory
+// dst, except the ones skipped.
+func moveEntries(src, dst string, skip func(name string) bool) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if skip != nil && skip(entry.Name()) {
+			continue
+		}
+		err := os.Rename(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirHeader returns the header of the directory at path, with its attributes
+// and extended attributes.
+func dirHeader(path string) (*tar.Header, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	return fileHeader(path, fi, "", path, addOptions{xattrs: true})
+}
+
+// copyFile copies the content and the attributes of the regular file src to
+// dst, which is overwritten in place. Holes are kept.
+func copyFile(src, dst string, e *extractor) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	header, err := fileHeader(src, fi, "", dst, addOptions{xattrs: true})
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = copySparse(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy file %s to %s: %w", src, dst, err)
+	}
+	return e.setAttributes(dst, header)
+}
+
+// isBusy reports whether err is returned for renaming a mount point, or
+// across filesystems.
+func isBusy(err error) bool {
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		return false
+	}
+	return errors.Is(linkErr.Err, syscall.EBUSY) || errors.Is(linkErr.Err, syscall.EXDEV)
+}
@@ -0,0 +1,13 @@
+package backuptar
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnescapeMountInfo(t *testing.T) {
+	assert.Equal(t, "/mnt/my volume", unescapeMountInfo(`/mnt/my\040volume`))
+	assert.Equal(t, `/mnt/a\b`, unescapeMountInfo(`/mnt/a\134b`))
+	assert.Equal(t, "/mnt/data", unescapeMountInfo("/mnt/data"))
+}
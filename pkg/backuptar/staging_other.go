@@ -0,0 +1,24 @@
+//go:build !linux
+
+package backuptar
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// exchange always fails, paths can't be swapped atomically on this platform.
+func exchange(a, b string) error {
+	return &os.LinkError{Op: "exchange", Old: a, New: b, Err: errors.ErrUnsupported}
+}
+
+// isMountPoint reports whether path is on a device different from the one of
+// its parent directory. Bind mounts on the same device are not detected.
+func isMountPoint(path string) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	return isDeviceRoot(path)
+}
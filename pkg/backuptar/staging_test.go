@@ -0,0 +1,135 @@
+package backuptar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagedTarget_Dir(t *testing.T) {
+	tc := []struct {
+		name    string
+		inPlace bool
+	}{
+		{name: "exchange"},
+		{name: "in place", inPlace: true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "volume")
+			require.NoError(t, os.MkdirAll(filepath.Join(target, "sub"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(target, "sub", "old"), []byte("old"), 0o644))
+			stage := func(t *testing.T) *StagedTarget {
+				s, err := StageDir(target)
+				require.NoError(t, err)
+				if tt.inPlace {
+					// Stage the directory as a mount point
+					require.NoError(t, os.Remove(s.Path))
+					s.inPlace = true
+					s.Path, err = os.MkdirTemp(target, stagingPrefix)
+					require.NoError(t, err)
+				}
+				require.NoError(t, os.Chmod(s.Path, 0o750))
+				require.NoError(t, os.WriteFile(filepath.Join(s.Path, "new"), []byte("new"), 0o644))
+				return s
+			}
+			assertEntries := func(t *testing.T, want ...string) {
+				entries, err := os.ReadDir(target)
+				require.NoError(t, err)
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				assert.Equal(t, want, names)
+				// Nothing is left next to the target
+				siblings, err := os.ReadDir(filepath.Dir(target))
+				require.NoError(t, err)
+				assert.Len(t, siblings, 1)
+			}
+
+			// Rolled back before commit
+			s := stage(t)
+			require.NoError(t, s.Rollback())
+			assertEntries(t, "sub")
+
+			// Rolled back after commit
+			s = stage(t)
+			require.NoError(t, s.Commit())
+			fi, err := os.Stat(target)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o750), fi.Mode().Perm())
+			require.NoError(t, s.Rollback())
+			assertEntries(t, "sub")
+			fi, err = os.Stat(target)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+
+			// Committed
+			s = stage(t)
+			require.NoError(t, s.Commit())
+			require.NoError(t, s.Finish())
+			assertEntries(t, "new")
+		})
+	}
+}
+
+func TestStagedTarget_File(t *testing.T) {
+	tc := []struct {
+		name    string
+		inPlace bool
+	}{
+		{name: "exchange"},
+		{name: "in place", inPlace: true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			target := filepath.Join(tmpDir, "volume.txt")
+			require.NoError(t, os.WriteFile(target, []byte("old"), 0o644))
+			stage := func(t *testing.T) *StagedTarget {
+				s, err := StageFile(target)
+				require.NoError(t, err)
+				s.inPlace = tt.inPlace
+				require.NoError(t, os.WriteFile(s.Path, []byte("new"), 0o600))
+				return s
+			}
+			assertFile := func(t *testing.T, want string) {
+				got, err := os.ReadFile(target)
+				require.NoError(t, err)
+				assert.Equal(t, want, string(got))
+			}
+			assertClean := func(t *testing.T) {
+				entries, err := os.ReadDir(tmpDir)
+				require.NoError(t, err)
+				assert.Len(t, entries, 1)
+			}
+
+			s := stage(t)
+			require.NoError(t, s.Commit())
+			assertFile(t, "new")
+			require.NoError(t, s.Rollback())
+			assertFile(t, "old")
+			assertClean(t)
+
+			s = stage(t)
+			require.NoError(t, s.Commit())
+			require.NoError(t, s.Finish())
+			assertFile(t, "new")
+			assertClean(t)
+		})
+	}
+}
+
+func TestStagedTarget_NewTarget(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "parent", "volume")
+	s, err := StageDir(target)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(s.Path, "new"), []byte("new"), 0o644))
+	require.NoError(t, s.Commit())
+	assert.FileExists(t, filepath.Join(target, "new"))
+	require.NoError(t, s.Rollback())
+	assert.NoDirExists(t, target)
+}
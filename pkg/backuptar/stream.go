@@ -0,0 +1,126 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// StreamReader reads an archive sequentially, from a reader that can't be
+// seeked such as the standard input. Its methods consume the archive: each
+// one continues reading where the previous one stopped.
+type StreamReader struct {
+	stream    io.ReadCloser
+	tarReader *tar.Reader
+}
+
+// NewStreamReader returns a StreamReader reading the archive from r. The
+// compression of the archive is detected.
+func NewStreamReader(r io.Reader) (*StreamReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	stream, err := newDecompressor(br, detectCompression(magic))
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader{stream: stream, tarReader: tar.NewReader(stream)}, nil
+}
+
+// ExtractAllFrom is like ExtractAll, but reads the archive sequentially from
+// r, for archives that can't be seeked such as pipes.
+func ExtractAllFrom(r io.Reader, targets map[string]string, opts ...ExtractOption) error {
+	stream, err := NewStreamReader(r)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	return stream.ExtractAll(targets, opts...)
+}
+
+// ReadFile returns the content of the next file named name in the archive,
+// skipping the entries before it. ErrFileNotFound is returned if the end of
+// the archive is reached.
+func (s *StreamReader) ReadFile(name string, opts ...ExtractOption) ([]byte, error) {
+	return s.readFile(name, isName(name), opts)
+}
+
+// ReadFileBefore is like ReadFile, but fails if an entry under the directory
+// dir comes before the file, as reading the file would consume it.
+func (s *StreamReader) ReadFileBefore(name, dir string, opts ...ExtractOption) ([]byte, error) {
+	return s.readFile(name, func(entryName string) bool {
+		return entryName == name || strings.HasPrefix(entryName, dir+"/")
+	}, opts)
+}
+
+// readFile returns the content of the next file named name, failing on the
+// other entries matched by match before it.
+func (s *StreamReader) readFile(name string, match func(name string) bool, opts []ExtractOption) ([]byte, error) {
+	var data []byte
+	found := false
+	err := s.walk(match, func(header *tar.Header, r io.Reader) error {
+		if header.Name != name {
+			return fmt.Errorf("%s is stored after %s, it can't be read first from a stream", name, header.Name)
+		}
+		found = true
+		content, _, err := newExtractor(opts).content(header, r)
+		if err != nil {
+			return err
+		}
+		data, err = io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		return errStopWalk
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrFileNotFound
+	}
+	return data, nil
+}
+
+// ExtractAll is like the ExtractAll function, for the rest of the archive.
+func (s *StreamReader) ExtractAll(targets map[string]string, opts ...ExtractOption) error {
+	extractor := NewExtractor(targets, opts...)
+	err := s.walk(extractor.Match, extractor.Extract)
+	if err != nil {
+		return err
+	}
+	return extractor.Finish()
+}
+
+// Close releases the resources of the reader, it does not close the
+// underlying reader.
+func (s *StreamReader) Close() error {
+	return s.stream.Close()
+}
+
+// walk is like walkArchive for the rest of the archive.
+func (s *StreamReader) walk(match func(name string) bool, fn func(header *tar.Header, r io.Reader) error) error {
+	for {
+		header, err := s.tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !match(header.Name) {
+			continue
+		}
+		err = fn(header, s.tarReader)
+		if err != nil {
+			if err == errStopWalk {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package backuptar
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	tc := []struct {
+		name string
+		opts []WriterOption
+	}{
+		{
+			name: "uncompressed",
+		},
+		{
+			name: "zstd",
+			opts: []WriterOption{WithCompression(CompressionZstd, 0)},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			srcDir := filepath.Join(tmpDir, "src")
+			require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "dir"), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dir", "file.txt"), []byte("chain data"), 0o644))
+			layout := filepath.Join(tmpDir, "layout.yml")
+			require.NoError(t, os.WriteFile(layout, []byte("volume: dir"), 0o644))
+
+			var buf bytes.Buffer
+			backupWriter, err := NewStreamWriter(&buf, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddFile(layout, "prefix/layout.yml"))
+			require.NoError(t, backupWriter.AddDir(srcDir, "prefix/volume"))
+			require.NoError(t, backupWriter.Close())
+			archive := buf.Bytes()
+
+			// The layout is read before the volume, in a single pass
+			stream, err := NewStreamReader(struct{ io.Reader }{bytes.NewReader(archive)})
+			require.NoError(t, err)
+			got, err := stream.ReadFile("prefix/layout.yml")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("volume: dir"), got)
+			outDir := filepath.Join(tmpDir, "out")
+			require.NoError(t, stream.ExtractAll(map[string]string{"prefix/volume": outDir}))
+			_, err = stream.ReadFile("prefix/layout.yml")
+			assert.ErrorIs(t, err, ErrFileNotFound)
+			require.NoError(t, stream.Close())
+			got, err = os.ReadFile(filepath.Join(outDir, "dir", "file.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("chain data"), got)
+
+			// Once stored in a file, the streamed archive can be appended to
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, os.WriteFile(tarPath, archive, 0o644))
+			backupWriter, err = NewBackupWriter(tarPath)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddDir(srcDir, "other/volume"))
+			require.NoError(t, backupWriter.Close())
+			require.NoError(t, ExtractAll(tarPath, map[string]string{
+				"prefix/volume": filepath.Join(tmpDir, "out1"),
+				"other/volume":  filepath.Join(tmpDir, "out2"),
+			}))
+		})
+	}
+}
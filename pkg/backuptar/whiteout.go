@@ -0,0 +1,75 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// WhiteoutPrefix is the prefix of the base name of whiteout entries. A
+// whiteout named dir/.wh.name records that dir/name was deleted since the
+// backup an incremental backup is based on, like in OCI image layers.
+const WhiteoutPrefix = ".wh."
+
+// paxWhiteout marks the whiteout entries, so that files whose names start
+// with WhiteoutPrefix are not taken for whiteouts.
+const paxWhiteout = "SNAPSHOTTER.whiteout"
+
+// WithWhiteouts applies the whiteout entries instead of extracting them: the
+// files they name are removed from the target. It is used to restore
+// incremental backups over the restored state of their base.
+func WithWhiteouts() ExtractOption {
+	return func(o *extractOptions) {
+		o.whiteouts = true
+	}
+}
+
+// AddWhiteout adds a whiteout entry recording that the file or directory at
+// the tar path name was deleted.
+func (b *BackupWriter) AddWhiteout(name string) error {
+	header := WhiteoutHeader(name)
+	if err := b.startEntry(header); err != nil {
+		return err
+	}
+	return b.tarWriter.WriteHeader(header)
+}
+
+// WhiteoutHeader returns the header of the whiteout entry recording that the
+// file or directory at the tar path name was deleted.
+func WhiteoutHeader(name string) *tar.Header {
+	return &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       path.Join(path.Dir(name), WhiteoutPrefix+path.Base(name)),
+		Mode:       0o600,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{paxWhiteout: "1"},
+		Format:     tar.FormatPAX,
+	}
+}
+
+// IsWhiteout reports whether the entry described by header is a whiteout, and
+// returns the name of the entry it deletes. Whiteouts are marked with a PAX
+// record, other entries named like them are regular files.
+func IsWhiteout(header *tar.Header) (string, bool) {
+	if header.Typeflag != tar.TypeReg || header.PAXRecords[paxWhiteout] != "1" {
+		return "", false
+	}
+	base, ok := strings.CutPrefix(path.Base(header.Name), WhiteoutPrefix)
+	if !ok || base == "" {
+		return "", false
+	}
+	return path.Join(path.Dir(header.Name), base), true
+}
+
+// applyWhiteout removes the file or directory at targetPath deleted by a
+// whiteout.
+func applyWhiteout(targetPath string) error {
+	err := os.RemoveAll(targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %w", targetPath, err)
+	}
+	return nil
+}
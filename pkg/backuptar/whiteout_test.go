@@ -0,0 +1,101 @@
+package backuptar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncremental(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dir", "deleted.txt"), []byte("deleted"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "unchanged.txt"), []byte("unchanged"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "changed.txt"), []byte("old"), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddDir(srcDir, "full"))
+	require.NoError(t, backupWriter.Close())
+
+	// Incremental backup skipping the unchanged file
+	require.NoError(t, os.RemoveAll(filepath.Join(srcDir, "dir")))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "changed.txt"), []byte("new"), 0o644))
+	backupWriter, err = NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	unchanged := WithUnchanged(func(relPath string, fi os.FileInfo) bool {
+		return relPath == "unchanged.txt"
+	})
+	require.NoError(t, backupWriter.AddDir(srcDir, "incremental", unchanged))
+	require.NoError(t, backupWriter.AddWhiteout("incremental/dir"))
+	require.NoError(t, backupWriter.Close())
+
+	names, err := EntryNames(tarPath, "incremental")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"incremental", "incremental/changed.txt", "incremental/.wh.dir"}, names)
+
+	// Whiteouts remove the deleted files from the restored base
+	outDir := filepath.Join(tmpDir, "out")
+	require.NoError(t, ExtractAll(tarPath, map[string]string{"full": outDir}))
+	require.NoError(t, ExtractAll(tarPath, map[string]string{"incremental": outDir}, WithWhiteouts()))
+	got, err := os.ReadFile(filepath.Join(outDir, "changed.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), got)
+	got, err = os.ReadFile(filepath.Join(outDir, "unchanged.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("unchanged"), got)
+	assert.NoDirExists(t, filepath.Join(outDir, "dir"))
+	assert.NoFileExists(t, filepath.Join(outDir, WhiteoutPrefix+"dir"))
+
+	// ExtractDir applies them as well
+	dirOut := filepath.Join(tmpDir, "dir-out")
+	require.NoError(t, ExtractDir(tarPath, "full", dirOut))
+	require.NoError(t, ExtractDir(tarPath, "incremental", dirOut, WithWhiteouts()))
+	assert.NoDirExists(t, filepath.Join(dirOut, "dir"))
+
+	// Without WithWhiteouts, they are regular files
+	plainOut := filepath.Join(tmpDir, "plain")
+	require.NoError(t, ExtractDir(tarPath, "incremental", plainOut))
+	assert.FileExists(t, filepath.Join(plainOut, WhiteoutPrefix+"dir"))
+	assert.NoFileExists(t, filepath.Join(plainOut, "unchanged.txt"))
+}
+
+func TestWhiteout_NamedFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	require.NoError(t, os.MkdirAll(srcDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "foo"), []byte("foo"), 0o644))
+	// A file named like a whiteout is not one
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, WhiteoutPrefix+"foo"), []byte("not a whiteout"), 0o644))
+
+	tarPath := filepath.Join(tmpDir, "test.tar")
+	require.NoError(t, InitBackupTar(tarPath))
+	backupWriter, err := NewBackupWriter(tarPath)
+	require.NoError(t, err)
+	require.NoError(t, backupWriter.AddDir(srcDir, "incremental"))
+	require.NoError(t, backupWriter.AddWhiteout("incremental/bar"))
+	require.NoError(t, backupWriter.Close())
+
+	whiteouts, err := Whiteouts(tarPath, "incremental")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"incremental/.wh.bar"}, whiteouts)
+
+	outDir := filepath.Join(tmpDir, "out")
+	require.NoError(t, os.MkdirAll(outDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "bar"), []byte("bar"), 0o644))
+	require.NoError(t, ExtractAll(tarPath, map[string]string{"incremental": outDir}, WithWhiteouts()))
+	got, err := os.ReadFile(filepath.Join(outDir, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("foo"), got)
+	got, err = os.ReadFile(filepath.Join(outDir, WhiteoutPrefix+"foo"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("not a whiteout"), got)
+	assert.NoFileExists(t, filepath.Join(outDir, "bar"))
+	assert.NoFileExists(t, filepath.Join(outDir, WhiteoutPrefix+"bar"))
+}
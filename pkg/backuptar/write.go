@@ -2,109 +2,400 @@ package backuptar
 
 import (
 	"archive/tar"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
 )
 
 // BackupWriter is a struct that write files into the backup tar file.
 type BackupWriter struct {
-	file      *os.File
+	// file is the archive file appended to, nil when writing a stream
+	file *os.File
+	// dst receives the archive, the file or the stream, and counts the bytes
+	// written to it
+	dst *countingWriter
+	// stream receives the tar stream, it is either the file itself or a
+	// compressor writing to it.
+	stream io.WriteCloser
+	// out counts the bytes of the tar stream written to stream
+	out       *countingWriter
 	tarWriter *tar.Writer
+	// compression and level of the members of a compressed archive
+	compression Compression
+	level       int
+	// memberOffset is the position in dst of the compressed member being
+	// written, and memberStart the position of its content in the tar stream
+	memberOffset int64
+	memberStart  int64
+	// endOfArchive is the end-of-archive member written after the entries of
+	// a compressed archive.
+	endOfArchive []byte
+	// encryption encrypts the content of the files, if enabled.
+	encryption *entryEncryption
+	// checksums of the regular files written by the writer
+	checksums []FileChecksum
+	// index of the archive, updated with the new entries, or nil if the
+	// archive had no valid index
+	index *archiveIndex
+	// appendAt is the offset of the first entry written by the writer
+	appendAt int64
+	// trailer is the end of the archive file removed to append to it, and
+	// indexed the number of entries of the index before, restored by Abort
+	trailer []byte
+	indexed int
+}
+
+// WriterOption configures how NewBackupWriter and InitBackupTar write the
+// archive.
+type WriterOption func(*writerOptions)
+
+type writerOptions struct {
+	compression Compression
+	level       int
+	recipients  []age.Recipient
+}
+
+// WithCompression compresses the archive with the algorithm c at the given
+// level, 0 selecting the default level of the algorithm. The directories and
+// files added by a BackupWriter are compressed in members of their own, so
+// compressed archives can still be appended to, and reading a directory does
+// not decompress the others.
+func WithCompression(c Compression, level int) WriterOption {
+	return func(o *writerOptions) {
+		o.compression = c
+		o.level = level
+	}
+}
+
+// WithEncryption encrypts the content of the files written to the archive
+// with age, so that only the identities matching recipients can decrypt it.
+// Names, metadata and extended attributes of the entries are not encrypted.
+func WithEncryption(recipients ...age.Recipient) WriterOption {
+	return func(o *writerOptions) {
+		o.recipients = recipients
+	}
+}
+
+func newWriterOptions(opts []WriterOption) writerOptions {
+	var o writerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
-// NewBackupWriter creates a new BackupWriter.
-func NewBackupWriter(tarPath string) (*BackupWriter, error) {
+// NewBackupWriter creates a new BackupWriter appending to the archive at
+// tarPath. The entries are compressed like the ones already in the archive.
+// An empty archive is compressed as requested with WithCompression, while
+// requesting a different compression than the one of a non-empty archive is
+// an error.
+func NewBackupWriter(tarPath string, opts ...WriterOption) (*BackupWriter, error) {
 	tarFile, err := os.OpenFile(tarPath, os.O_RDWR, 0o644)
 	if err != nil {
 		return nil, err
 	}
+	w, err := newBackupWriter(tarFile, newWriterOptions(opts))
+	if err != nil {
+		tarFile.Close()
+		return nil, err
+	}
+	return w, nil
+}
 
+func newBackupWriter(tarFile *os.File, o writerOptions) (*BackupWriter, error) {
 	stats, err := tarFile.Stat()
 	if err != nil {
 		return nil, err
 	}
-	if stats.Size() < 2*TarBlockSize {
-		return nil, fmt.Errorf("%w: tar file size is less than 2 blocks", ErrPrepareToAppend)
+	compression, err := fileCompression(tarFile)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check if the last 1024 bytes are all 0
-	d := make([]byte, 1024)
-	n, err := tarFile.ReadAt(d, stats.Size()-1024)
+	var appendAt int64
+	index := loadIndex(tarFile.Name(), stats, compression)
+	if compression == CompressionNone {
+		if stats.Size() < 2*TarBlockSize {
+			return nil, fmt.Errorf("%w: tar file size is less than 2 blocks", ErrPrepareToAppend)
+		}
+
+		// Check if the last 1024 bytes are all 0
+		d := make([]byte, 1024)
+		n, err := tarFile.ReadAt(d, stats.Size()-1024)
+		if err != nil {
+			return nil, err
+		}
+		if n != 1024 {
+			return nil, fmt.Errorf("%w: read %d bytes instead of 1024", ErrPrepareToAppend, n)
+		}
+		for _, b := range d {
+			if b != 0 {
+				return nil, fmt.Errorf("%w: last 1024 bytes are not all 0", ErrPrepareToAppend)
+			}
+		}
+		appendAt = stats.Size() - 1024
+
+		if o.compression != "" && o.compression != CompressionNone {
+			// Only an empty archive can start being compressed
+			if stats.Size() != 2*TarBlockSize {
+				return nil, fmt.Errorf("%w: archive is not compressed with %s", ErrCompressionMismatch, o.compression)
+			}
+			compression = o.compression
+			appendAt = 0
+		}
+	} else {
+		if o.compression != "" && o.compression != compression {
+			return nil, fmt.Errorf("%w: archive is compressed with %s instead of %s", ErrCompressionMismatch, compression, o.compression)
+		}
+		appendAt, err = findEndOfArchive(tarFile, stats.Size(), compression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the end-of-archive marker to restore it if the writer is aborted
+	trailer := make([]byte, stats.Size()-appendAt)
+	_, err = tarFile.ReadAt(trailer, appendAt)
 	if err != nil {
 		return nil, err
 	}
-	if n != 1024 {
-		return nil, fmt.Errorf("%w: read %d bytes instead of 1024", ErrPrepareToAppend, n)
-	}
-	for _, b := range d {
-		if b != 0 {
-			return nil, fmt.Errorf("%w: last 1024 bytes are not all 0", ErrPrepareToAppend)
-		}
+	// Seek the end-of-archive marker
+	_, err = tarFile.Seek(appendAt, io.SeekStart)
+	if err != nil {
+		return nil, err
 	}
-	// Seek last 1024 bytes
-	_, err = tarFile.Seek(-1024, io.SeekEnd)
+	// Truncate the end-of-archive marker
+	err = tarFile.Truncate(appendAt)
 	if err != nil {
 		return nil, err
 	}
-	// Truncate last 1024 bytes
-	err = tarFile.Truncate(stats.Size() - 1024)
+
+	if appendAt == 0 {
+		// Nothing to index in an empty archive
+		index = &archiveIndex{}
+	}
+	if index != nil {
+		index.Compression = compression
+	}
+
+	w, err := newWriter(tarFile, compression, o)
 	if err != nil {
 		return nil, err
 	}
-	return &BackupWriter{
-		file:      tarFile,
-		tarWriter: tar.NewWriter(tarFile),
-	}, nil
+	w.file = tarFile
+	w.index = index
+	w.appendAt = appendAt
+	w.trailer = trailer
+	if index != nil {
+		w.indexed = len(index.Entries)
+	}
+	return w, nil
 }
 
-// AddDir adds a directory into the backup tar file.
-func (b *BackupWriter) AddDir(src, dest string) error {
-	// walk through every file in the folder
-	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+// NewStreamWriter creates a new BackupWriter writing a new archive to w, such
+// as the standard output. The archive is compressed as requested with
+// WithCompression, and can later be appended to like any other archive once
+// stored in a file.
+func NewStreamWriter(w io.Writer, opts ...WriterOption) (*BackupWriter, error) {
+	o := newWriterOptions(opts)
+	compression := o.compression
+	if compression == "" {
+		compression = CompressionNone
+	}
+	return newWriter(w, compression, o)
+}
+
+// newWriter returns a BackupWriter writing entries compressed with
+// compression to dst.
+func newWriter(dst io.Writer, compression Compression, o writerOptions) (*BackupWriter, error) {
+	counted := &countingWriter{w: dst}
+	stream, err := newCompressor(counted, compression, o.level)
+	if err != nil {
+		return nil, err
+	}
+	out := &countingWriter{w: stream}
+	w := &BackupWriter{
+		dst:         counted,
+		stream:      stream,
+		out:         out,
+		tarWriter:   tar.NewWriter(out),
+		compression: compression,
+		level:       o.level,
+	}
+	if compression != CompressionNone {
+		w.endOfArchive, err = endOfArchive(compression)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		// generate tar header
-		header, err := tar.FileInfoHeader(fi, file)
+	}
+	if len(o.recipients) > 0 {
+		w.encryption, err = newEntryEncryption(o.recipients)
 		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// AddOption configures how AddDir and AddFile store files.
+type AddOption func(*addOptions)
+
+type addOptions struct {
+	xattrs    bool
+	unchanged func(relPath string, fi os.FileInfo) bool
+	filter    *Filter
+}
+
+// WithXattrs stores the extended attributes of the files as PAX records. They
+// include POSIX ACLs, SELinux labels and file capabilities.
+func WithXattrs() AddOption {
+	return func(o *addOptions) {
+		o.xattrs = true
+	}
+}
+
+// WithUnchanged skips the regular files of AddDir for which unchanged returns
+// true, for incremental backups. relPath is the path of the file relative to
+// the source directory. Hard links to a skipped file are still written.
+func WithUnchanged(unchanged func(relPath string, fi os.FileInfo) bool) AddOption {
+	return func(o *addOptions) {
+		o.unchanged = unchanged
+	}
+}
+
+// WithFilter only stores the files of AddDir selected by the filter f.
+func WithFilter(f *Filter) AddOption {
+	return func(o *addOptions) {
+		o.filter = f
+	}
+}
+
+func newAddOptions(opts []AddOption) addOptions {
+	var o addOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// AddDir adds a directory into the backup tar file. Symbolic links are stored
+// with their targets, files with several hard links are stored once and
+// referenced by the following links, and FIFOs and device nodes are stored as
+// special entries.
+func (b *BackupWriter) AddDir(src, dest string, opts ...AddOption) error {
+	if err := b.startMember(); err != nil {
+		return err
+	}
+	return FileHeaders(src, dest, func(header *tar.Header, file string, fi os.FileInfo) error {
+		// write header, followed by the content of regular files
+		if header.Typeflag == tar.TypeReg {
+			return b.writeRegular(header, file, fi)
+		}
+		if err := b.startEntry(header); err != nil {
 			return err
 		}
+		return b.tarWriter.WriteHeader(header)
+	}, opts...)
+}
 
-		fileRelPath, err := filepath.Rel(src, file)
+// FileHeaders calls fn with the header of every file under the directory src
+// as AddDir stores them under dest, with the path and the information of the
+// file. The content of regular files is read by fn from their path. It lets
+// other storage formats store the same entries as the tar archive.
+func FileHeaders(src, dest string, fn func(header *tar.Header, file string, fi os.FileInfo) error, opts ...AddOption) error {
+	o := newAddOptions(opts)
+	// names of the entries already written for inodes with several links
+	hardlinks := make(map[inode]string)
+	add := func(file string, fi os.FileInfo, fileRelPath string) error {
+		var (
+			link string
+			err  error
+		)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(file)
+			if err != nil {
+				return err
+			}
+		}
+
+		// generate tar header
+		header, err := fileHeader(file, fi, link, filepath.Join(dest, fileRelPath), o)
 		if err != nil {
 			return err
 		}
 
-		header.Name = filepath.Join(dest, fileRelPath)
+		if header.Typeflag == tar.TypeReg {
+			if id, ok := hardlinkInode(fi); ok {
+				if first, ok := hardlinks[id]; ok {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = first
+					header.Size = 0
+				} else {
+					hardlinks[id] = header.Name
+				}
+			}
+		}
+		if header.Typeflag == tar.TypeReg && o.unchanged != nil && o.unchanged(fileRelPath, fi) {
+			return nil
+		}
+		return fn(header, file, fi)
+	}
 
-		// write header
-		if err := b.tarWriter.WriteHeader(header); err != nil {
+	// directories not selected by the filter, stored once a file under them
+	// is, from the outermost
+	type pendingDir struct {
+		relPath string
+		fi      os.FileInfo
+	}
+	var pending []pendingDir
+	// walk through every file in the folder
+	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fileRelPath, err := filepath.Rel(src, file)
+		if err != nil {
 			return err
 		}
+		if o.filter == nil || fileRelPath == "." {
+			return add(file, fi, fileRelPath)
+		}
 
-		// if not a dir, write file content
-		if !fi.IsDir() {
-			data, err := os.Open(file)
-			if err != nil {
-				return err
+		relPath := filepath.ToSlash(fileRelPath)
+		// The walk left the pending directories which are not parents
+		for len(pending) > 0 && !strings.HasPrefix(relPath, filepath.ToSlash(pending[len(pending)-1].relPath)+"/") {
+			pending = pending[:len(pending)-1]
+		}
+		switch {
+		case o.filter.excluded(relPath, fi.IsDir()):
+			if fi.IsDir() {
+				return filepath.SkipDir
 			}
-			if _, err := io.Copy(b.tarWriter, data); err != nil {
-				return err
+			return nil
+		case !o.filter.included(relPath, fi.IsDir()):
+			if fi.IsDir() {
+				pending = append(pending, pendingDir{relPath: fileRelPath, fi: fi})
 			}
-			err = data.Close()
-			if err != nil {
+			return nil
+		}
+		for _, dir := range pending {
+			if err := add(filepath.Join(src, dir.relPath), dir.fi, dir.relPath); err != nil {
 				return err
 			}
 		}
-		return nil
+		pending = pending[:0]
+		return add(file, fi, fileRelPath)
 	})
 }
 
 // AddFile adds a file into the backup tar file.
-func (b *BackupWriter) AddFile(src, dest string) error {
+func (b *BackupWriter) AddFile(src, dest string, opts ...AddOption) error {
 	fi, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -115,33 +406,186 @@ func (b *BackupWriter) AddFile(src, dest string) error {
 	}
 
 	// generate tar header
-	header, err := tar.FileInfoHeader(fi, src)
+	header, err := fileHeader(src, fi, "", dest, newAddOptions(opts))
 	if err != nil {
 		return err
 	}
 
-	header.Name = dest
+	if err := b.startMember(); err != nil {
+		return err
+	}
+	return b.writeRegular(header, src, fi)
+}
 
-	// write header
-	if err := b.tarWriter.WriteHeader(header); err != nil {
+// writeRegular writes header followed by the content of the regular file at
+// path, described by fi. Files with holes are written as sparse entries,
+// unless they are encrypted.
+func (b *BackupWriter) writeRegular(header *tar.Header, path string, fi os.FileInfo) error {
+	data, err := os.Open(path)
+	if err != nil {
 		return err
 	}
+	defer data.Close()
 
-	data, err := os.Open(src)
+	if err := b.startEntry(header); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if b.encryption != nil {
+		err = b.writeEncrypted(header, data, h)
+	} else {
+		var regions []region
+		regions, err = dataRegions(data, fi)
+		if err != nil {
+			return err
+		}
+		if regions != nil {
+			err = b.writeSparse(header, data, regions, h)
+		} else if err = b.tarWriter.WriteHeader(header); err == nil {
+			_, err = io.Copy(b.tarWriter, io.TeeReader(data, h))
+		}
+	}
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(b.tarWriter, data); err != nil {
+	b.addChecksum(header, h)
+	return nil
+}
+
+// startEntry ends the previous entry and records the position of the entry
+// described by header in the index.
+func (b *BackupWriter) startEntry(header *tar.Header) error {
+	err := b.tarWriter.Flush()
+	if err != nil {
 		return err
 	}
-	return data.Close()
+	if b.index == nil {
+		return nil
+	}
+	if b.endOfArchive == nil {
+		b.index.add(header, b.appendAt+b.out.n, 0)
+	} else {
+		b.index.add(header, b.appendAt+b.memberOffset, b.out.n-b.memberStart)
+	}
+	return nil
 }
 
-// Close closes the backup tar file.
+// startMember ends the compressed member holding the previous entries, so the
+// entries added next, such as the files of another volume, are read without
+// decompressing them.
+func (b *BackupWriter) startMember() error {
+	if b.endOfArchive == nil || b.out.n == b.memberStart {
+		return nil
+	}
+	err := b.tarWriter.Flush()
+	if err != nil {
+		return err
+	}
+	err = b.stream.Close()
+	if err != nil {
+		return err
+	}
+	b.stream, err = newCompressor(b.dst, b.compression, b.level)
+	if err != nil {
+		return err
+	}
+	b.out.w = b.stream
+	b.memberOffset = b.dst.n
+	b.memberStart = b.out.n
+	return nil
+}
+
+// fileHeader returns the tar header named name for the file at path described
+// by fi. The GNU format is used to keep access times, which USTAR can't store,
+// unless extended attributes require PAX records.
+func fileHeader(path string, fi os.FileInfo, link, name string, o addOptions) (*tar.Header, error) {
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	header.Format = tar.FormatGNU
+	if o.xattrs {
+		records, err := xattrRecords(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			header.PAXRecords = records
+			header.Format = tar.FormatPAX
+		}
+	}
+	return header, nil
+}
+
+// Close ends the archive, closes the backup tar file and updates its index.
+// The destination of a writer created with NewStreamWriter is not closed.
 func (w *BackupWriter) Close() error {
-	err := w.tarWriter.Close()
+	err := w.close()
+	if err != nil {
+		return err
+	}
+	if w.file != nil && w.index != nil {
+		w.index.save(w.file.Name())
+	}
+	return nil
+}
+
+// Abort discards the entries written by the writer, instead of closing it
+// after a failure: the archive file is truncated back to its size before the
+// writer appended to it, and its end-of-archive marker is restored. A stream
+// is left without its end-of-archive marker, so that its readers fail instead
+// of reading an incomplete archive.
+func (w *BackupWriter) Abort() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Truncate(w.appendAt)
+	if err == nil {
+		_, err = w.file.WriteAt(w.trailer, w.appendAt)
+	}
+	if err == nil && w.index != nil {
+		w.index.Entries = w.index.Entries[:w.indexed]
+		w.index.Compression, err = fileCompression(w.file)
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore archive %s: %w", w.file.Name(), err)
+	}
+	if w.index != nil {
+		w.index.save(w.file.Name())
+	}
+	return nil
+}
+
+func (w *BackupWriter) close() error {
+	err := w.writeEnd()
 	if err != nil {
 		return err
 	}
+	if w.file == nil {
+		return nil
+	}
 	return w.file.Close()
 }
+
+// writeEnd writes the end-of-archive marker after the entries.
+func (w *BackupWriter) writeEnd() error {
+	if w.endOfArchive == nil {
+		return w.tarWriter.Close()
+	}
+	// End the member holding the new entries, the end-of-archive marker goes
+	// in a member of its own.
+	err := w.tarWriter.Flush()
+	if err != nil {
+		return err
+	}
+	err = w.stream.Close()
+	if err != nil {
+		return err
+	}
+	_, err = w.dst.Write(w.endOfArchive)
+	return err
+}
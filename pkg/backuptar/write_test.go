@@ -190,3 +190,73 @@ func TestBackupWriter_AddFile(t *testing.T) {
 		"test.txt",
 	}, tarFiles)
 }
+
+func TestBackupWriter_Abort(t *testing.T) {
+	tc := []struct {
+		name     string
+		initOpts []WriterOption
+		opts     []WriterOption
+		first    bool
+	}{
+		{
+			name:  "uncompressed",
+			first: true,
+		},
+		{
+			name:     "gzip",
+			initOpts: []WriterOption{WithCompression(CompressionGzip, 0)},
+			first:    true,
+		},
+		{
+			name: "empty archive compressed by the writer",
+			opts: []WriterOption{WithCompression(CompressionZstd, 0)},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			srcDir := filepath.Join(tmpDir, "src")
+			require.NoError(t, os.MkdirAll(srcDir, 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("data"), 0o644))
+
+			tarPath := filepath.Join(tmpDir, "test.tar")
+			require.NoError(t, InitBackupTar(tarPath, tt.initOpts...))
+			if tt.first {
+				backupWriter, err := NewBackupWriter(tarPath)
+				require.NoError(t, err)
+				require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, "file.txt"), "first.txt"))
+				require.NoError(t, backupWriter.Close())
+			}
+			before, err := os.ReadFile(tarPath)
+			require.NoError(t, err)
+			indexBefore := readIndex(t, tarPath)
+
+			backupWriter, err := NewBackupWriter(tarPath, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddDir(srcDir, "aborted"))
+			require.NoError(t, backupWriter.Abort())
+
+			// The archive and its index are back to their state before the
+			// writer
+			after, err := os.ReadFile(tarPath)
+			require.NoError(t, err)
+			assert.Equal(t, before, after)
+			fi, err := os.Stat(tarPath)
+			require.NoError(t, err)
+			indexAfter := readIndex(t, tarPath)
+			assert.True(t, indexAfter.valid(fi, indexBefore.Compression), "index is stale")
+			assert.ElementsMatch(t, indexBefore.Entries, indexAfter.Entries)
+			_, err = ReadFile(tarPath, "aborted/file.txt")
+			assert.ErrorIs(t, err, ErrFileNotFound)
+
+			backupWriter, err = NewBackupWriter(tarPath, tt.opts...)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddFile(filepath.Join(srcDir, "file.txt"), "second.txt"))
+			require.NoError(t, backupWriter.Close())
+			got, err := ReadFile(tarPath, "second.txt")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("data"), got)
+		})
+	}
+}
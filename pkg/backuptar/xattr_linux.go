@@ -0,0 +1,72 @@
+package backuptar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrRecords returns the extended attributes of path as PAX records. POSIX
+// ACLs are stored by the kernel as system.posix_acl_* attributes, so they
+// are included. Symbolic links are not followed.
+func xattrRecords(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list extended attributes of %s: %w", path, err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(path, names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes of %s: %w", path, err)
+	}
+
+	records := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			if errors.Is(err, unix.ENODATA) {
+				// Removed after listing
+				continue
+			}
+			return nil, fmt.Errorf("failed to get extended attribute %s of %s: %w", name, path, err)
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get extended attribute %s of %s: %w", name, path, err)
+		}
+		records[paxXattrPrefix+name] = string(value[:size])
+	}
+	return records, nil
+}
+
+// setXattrs applies the extended attributes stored in the PAX records of
+// header to path. Attributes not supported by the filesystem, or that the
+// process is not allowed to set, are skipped with a warning.
+func setXattrs(path string, header *tar.Header) error {
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		err := unix.Lsetxattr(path, name, []byte(value), 0)
+		if err != nil {
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+				slog.Warn("Skipping extended attribute", "path", path, "name", name, "error", err)
+				continue
+			}
+			return fmt.Errorf("failed to set extended attribute %s of %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package backuptar
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestExtractDir_Xattrs(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	require.NoError(t, os.Mkdir(srcDir, 0o755))
+	filePath := filepath.Join(srcDir, "file.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("data"), 0o644))
+	err := unix.Lsetxattr(filePath, "user.snapshotter", []byte("value\x00with\x00nul"), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("filesystem does not support extended attributes")
+	}
+	require.NoError(t, err)
+	require.NoError(t, unix.Lsetxattr(srcDir, "user.dir", []byte("dir value"), 0))
+
+	tc := []struct {
+		name   string
+		opts   []AddOption
+		values map[string]string
+	}{
+		{
+			name: "without xattrs",
+		},
+		{
+			name: "with xattrs",
+			opts: []AddOption{WithXattrs()},
+			values: map[string]string{
+				"file.txt": "value\x00with\x00nul",
+				".":        "dir value",
+			},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			tarPath := filepath.Join(t.TempDir(), "test.tar")
+			require.NoError(t, InitBackupTar(tarPath))
+			backupWriter, err := NewBackupWriter(tarPath)
+			require.NoError(t, err)
+			require.NoError(t, backupWriter.AddDir(srcDir, "test", tt.opts...))
+			require.NoError(t, backupWriter.Close())
+
+			outDir := filepath.Join(t.TempDir(), "out")
+			require.NoError(t, ExtractDir(tarPath, "test", outDir))
+
+			for _, p := range []string{"file.txt", "."} {
+				size, err := unix.Llistxattr(filepath.Join(outDir, p), nil)
+				require.NoError(t, err)
+				want, ok := tt.values[p]
+				if !ok {
+					assert.Zero(t, size, p)
+					continue
+				}
+				names := make([]byte, size)
+				_, err = unix.Llistxattr(filepath.Join(outDir, p), names)
+				require.NoError(t, err)
+				name := "user.snapshotter"
+				if p == "." {
+					name = "user.dir"
+				}
+				value := make([]byte, 64)
+				n, err := unix.Lgetxattr(filepath.Join(outDir, p), name, value)
+				require.NoError(t, err)
+				assert.Equal(t, want, string(value[:n]), p)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package backuptar
+
+import (
+	"archive/tar"
+	"log/slog"
+	"strings"
+)
+
+// xattrRecords returns no records, extended attributes are only supported on
+// Linux.
+func xattrRecords(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// setXattrs warns about the extended attributes of header, as they can't be
+// restored on this platform.
+func setXattrs(path string, header *tar.Header) error {
+	for key := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			slog.Warn("Skipping extended attribute", "path", path, "name", name, "error", "not supported on this platform")
+		}
+	}
+	return nil
+}
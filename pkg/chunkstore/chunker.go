@@ -0,0 +1,138 @@
+package chunkstore
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Default chunk sizes of new repositories. Chunks are large enough to keep the
+// snapshot trees small, and small enough to share most of the content of
+// files which are only partly modified between snapshots.
+const (
+	defaultMinChunkSize = 256 << 10
+	defaultAvgChunkSize = 1 << 20
+	defaultMaxChunkSize = 4 << 20
+)
+
+// chunkSizes are the parameters of the chunker. They are stored in the
+// repository, changing them would stop the deduplication of the content
+// chunked before.
+type chunkSizes struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+func (s chunkSizes) validate() error {
+	if s.Min <= 0 || s.Min > s.Avg || s.Avg > s.Max || s.Avg&(s.Avg-1) != 0 {
+		return errors.New("invalid chunk sizes: min <= avg <= max are required, avg being a power of two")
+	}
+	return nil
+}
+
+// gear is the table of random values of the gear rolling hash. It is derived
+// from a fixed seed, the cut points and then the chunks of a file depend on it.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	state := uint64(0x736e617073686f74)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks with FastCDC: a cut
+// point is where the gear hash of the last bytes matches a mask, so that
+// inserting or removing data only changes the chunks around the edit. Cut
+// points are harder to match before the average size and easier after it, to
+// keep the chunk sizes close to the average.
+type chunker struct {
+	r     io.Reader
+	sizes chunkSizes
+	// maskS and maskL are the masks used before and after the average size
+	maskS, maskL uint64
+	buf          []byte
+	// start and end delimit the buffered data not returned yet
+	start, end int
+	eof        bool
+}
+
+func newChunker(r io.Reader, sizes chunkSizes) *chunker {
+	b := bits.TrailingZeros(uint(sizes.Avg))
+	return &chunker{
+		r:     r,
+		sizes: sizes,
+		maskS: ^uint64(0) << (64 - (b + 1)),
+		maskL: ^uint64(0) << (64 - (b - 1)),
+		buf:   make([]byte, sizes.Max),
+	}
+}
+
+// Next returns the next chunk of the stream, which is only valid until the
+// following call. io.EOF is returned at the end of the stream.
+func (c *chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill reads the stream until a maximum size chunk is buffered, or up to its
+// end.
+func (c *chunker) fill() error {
+	if c.end-c.start >= c.sizes.Max || c.eof {
+		return nil
+	}
+	// Move the remaining data to the start of the buffer
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk starting data.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.sizes.Min {
+		return n
+	}
+	n = min(n, c.sizes.Max)
+	normal := min(n, c.sizes.Avg)
+	var hash uint64
+	i := c.sizes.Min
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
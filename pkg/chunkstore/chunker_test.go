@@ -0,0 +1,78 @@
+package chunkstore
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSizes = chunkSizes{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+
+// chunks returns the chunks of data.
+func chunks(t *testing.T, data []byte, sizes chunkSizes) [][]byte {
+	c := newChunker(bytes.NewReader(data), sizes)
+	var result [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return result
+		}
+		require.NoError(t, err)
+		result = append(result, bytes.Clone(chunk))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	result := chunks(t, data, testSizes)
+	assert.Equal(t, data, bytes.Join(result, nil))
+	for i, chunk := range result {
+		assert.LessOrEqual(t, len(chunk), testSizes.Max)
+		if i < len(result)-1 {
+			assert.Greater(t, len(chunk), testSizes.Min)
+		}
+	}
+	// Chunks are close to the average size
+	avg := len(data) / len(result)
+	assert.Greater(t, avg, testSizes.Avg/2)
+	assert.Less(t, avg, testSizes.Avg*2)
+
+	// Inserting data only changes the chunks around the insertion
+	edited := append(bytes.Clone(data[:len(data)/2]), []byte("inserted")...)
+	edited = append(edited, data[len(data)/2:]...)
+	editedResult := chunks(t, edited, testSizes)
+	known := make(map[string]bool, len(result))
+	for _, chunk := range result {
+		known[string(chunk)] = true
+	}
+	shared := 0
+	for _, chunk := range editedResult {
+		if known[string(chunk)] {
+			shared++
+		}
+	}
+	assert.GreaterOrEqual(t, shared, len(editedResult)-3)
+}
+
+func TestChunker_Small(t *testing.T) {
+	assert.Empty(t, chunks(t, nil, testSizes))
+	assert.Equal(t, [][]byte{[]byte("small")}, chunks(t, []byte("small"), testSizes))
+	// Content without cut points is split at the maximum size
+	zeros := make([]byte, 2*testSizes.Max+1)
+	result := chunks(t, zeros, testSizes)
+	require.Len(t, result, 3)
+	assert.Len(t, result[2], 1)
+}
+
+func TestChunkSizes_Validate(t *testing.T) {
+	assert.NoError(t, testSizes.validate())
+	assert.Error(t, chunkSizes{Min: 1 << 10, Avg: 3 << 10, Max: 16 << 10}.validate())
+	assert.Error(t, chunkSizes{Min: 8 << 10, Avg: 4 << 10, Max: 16 << 10}.validate())
+	assert.Error(t, chunkSizes{}.validate())
+}
@@ -0,0 +1,96 @@
+package chunkstore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+)
+
+// GCStats counts the chunks removed by CollectGarbage.
+type GCStats struct {
+	Chunks int
+	Bytes  int64
+}
+
+// RemoveSnapshot removes the snapshot of the given name. Its chunks are kept
+// until CollectGarbage finds that no other snapshot references them.
+// backuptar.ErrFileNotFound is returned if there is no such snapshot.
+func (r *Repository) RemoveSnapshot(name string) error {
+	err := os.Remove(r.snapshotPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: snapshot %s", backuptar.ErrFileNotFound, name)
+	}
+	return err
+}
+
+// snapshotNames returns the names of the snapshots of the repository.
+func (r *Repository) snapshotNames() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(r.path, snapshotsDir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		// Skip the temporary files of the snapshots being written
+		escaped, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
+		name, err := url.PathUnescape(escaped)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot file %s: %w", entry.Name(), err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// CollectGarbage removes the chunks no snapshot references: the ones only
+// referenced by removed or replaced snapshots, and the ones of writers which
+// were not closed. The chunks of a snapshot being written are not referenced
+// until its writer is closed, so it must not run during a backup to the
+// repository. Nothing is removed if a snapshot can't be read.
+func (r *Repository) CollectGarbage() (GCStats, error) {
+	var stats GCStats
+	names, err := r.snapshotNames()
+	if err != nil {
+		return stats, err
+	}
+	referenced := make(map[string]bool)
+	for _, name := range names {
+		s, err := r.loadSnapshot(name)
+		if err != nil {
+			return stats, err
+		}
+		for _, entry := range s.Entries {
+			for _, id := range entry.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+	err = filepath.WalkDir(filepath.Join(r.path, chunksDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") || referenced[d.Name()] {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		stats.Chunks++
+		stats.Bytes += fi.Size()
+		return nil
+	})
+	return stats, err
+}
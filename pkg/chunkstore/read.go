@@ -0,0 +1,117 @@
+package chunkstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+)
+
+// chunkReader reads the content of a file from its chunks.
+type chunkReader struct {
+	repo   *Repository
+	chunks []string
+	// buf is the part of the current chunk not read yet
+	buf []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.repo.readChunk(r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.chunks = r.chunks[1:]
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *Repository) content(entry treeEntry) io.Reader {
+	return &chunkReader{repo: r, chunks: entry.Chunks}
+}
+
+// ReadFile returns the content of the regular file name of the snapshot of
+// the given name. backuptar.ErrFileNotFound is returned if the snapshot or
+// the file don't exist.
+func (r *Repository) ReadFile(snapshotName, name string) ([]byte, error) {
+	s, err := r.loadSnapshot(snapshotName)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range s.Entries {
+		if entry.Name != name {
+			continue
+		}
+		if entry.Type != tar.TypeReg {
+			return nil, fmt.Errorf("%s is not a regular file", name)
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r.content(entry)); err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", name, err)
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", backuptar.ErrFileNotFound, name)
+}
+
+// ExtractAll restores the entries of the snapshot of the given name under
+// each path key of targets to the filesystem path it maps to, like
+// backuptar.ExtractAll does for a tar archive.
+func (r *Repository) ExtractAll(snapshotName string, targets map[string]string, opts ...backuptar.ExtractOption) error {
+	s, err := r.loadSnapshot(snapshotName)
+	if err != nil {
+		return err
+	}
+	extractor := backuptar.NewExtractor(targets, opts...)
+	for _, entry := range s.Entries {
+		if !extractor.Match(entry.Name) {
+			continue
+		}
+		if err := extractor.Extract(entry.header(), r.content(entry)); err != nil {
+			return err
+		}
+	}
+	return extractor.Finish()
+}
+
+// ReadChecksums returns the checksums of the regular files of the snapshot of
+// the given name, like backuptar.ReadChecksums. Every chunk is read and
+// checked against its id.
+func (r *Repository) ReadChecksums(snapshotName string) ([]backuptar.FileChecksum, error) {
+	s, err := r.loadSnapshot(snapshotName)
+	if err != nil {
+		return nil, err
+	}
+	var checksums []backuptar.FileChecksum
+	for _, entry := range s.Entries {
+		if entry.Type != tar.TypeReg {
+			continue
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, r.content(entry))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", entry.Name, err)
+		}
+		if n != entry.Size {
+			return nil, fmt.Errorf("failed to read file %s: read %d bytes instead of %d", entry.Name, n, entry.Size)
+		}
+		checksums = append(checksums, backuptar.FileChecksum{
+			Name:     entry.Name,
+			Size:     entry.Size,
+			ModTime:  entry.ModTime,
+			SHA256:   hex.EncodeToString(h.Sum(nil)),
+			Whiteout: entry.Whiteout,
+		})
+	}
+	return checksums, nil
+}
@@ -0,0 +1,171 @@
+package chunkstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// repositoryVersion is the version of the repository format, repositories of
+// other versions can't be opened.
+const repositoryVersion = 1
+
+const (
+	configFileName = "config.json"
+	chunksDir      = "chunks"
+	snapshotsDir   = "snapshots"
+)
+
+// ErrCorruptChunk is returned when the content of a chunk does not match its
+// hash.
+var ErrCorruptChunk = errors.New("corrupt chunk")
+
+// repositoryConfig is stored in the config.json file of the repository.
+type repositoryConfig struct {
+	Version int        `json:"version"`
+	Chunker chunkSizes `json:"chunker"`
+}
+
+// Repository is a directory storing the content of the backed up files as
+// content-defined chunks, each unique chunk being stored once, and the tree of
+// every snapshot referencing them. Its layout is:
+//
+//	config.json              version and chunker parameters
+//	chunks/<xx>/<sha256>     chunks, by the SHA-256 hash of their content
+//	snapshots/<name>.json    snapshot trees, by escaped snapshot name
+type Repository struct {
+	path  string
+	sizes chunkSizes
+}
+
+// Open opens the repository at path. The repository is created if path does
+// not exist or is an empty directory.
+func Open(path string) (*Repository, error) {
+	data, err := os.ReadFile(filepath.Join(path, configFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return create(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config repositoryConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid repository config: %w", err)
+	}
+	if config.Version != repositoryVersion {
+		return nil, fmt.Errorf("unsupported repository version %d", config.Version)
+	}
+	if err := config.Chunker.validate(); err != nil {
+		return nil, err
+	}
+	return &Repository{path: path, sizes: config.Chunker}, nil
+}
+
+// create initializes a new repository at path, which must not exist or be
+// an empty directory.
+func create(path string) (*Repository, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not a chunk store repository: it is not empty and has no %s", path, configFileName)
+	}
+	for _, dir := range []string{chunksDir, snapshotsDir} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	config := repositoryConfig{
+		Version: repositoryVersion,
+		Chunker: chunkSizes{
+			Min: defaultMinChunkSize,
+			Avg: defaultAvgChunkSize,
+			Max: defaultMaxChunkSize,
+		},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(path, configFileName), data); err != nil {
+		return nil, err
+	}
+	return &Repository{path: path, sizes: config.Chunker}, nil
+}
+
+// chunkPath returns the path of the chunk of the given id. Chunks are spread
+// over subdirectories named after the first byte of their hash.
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.path, chunksDir, id[:2], id)
+}
+
+// snapshotPath returns the path of the tree of the snapshot of the given
+// name. Names are escaped, as prefixes may hold slashes.
+func (r *Repository) snapshotPath(name string) string {
+	return filepath.Join(r.path, snapshotsDir, url.PathEscape(name)+".json")
+}
+
+// putChunk stores data as a chunk, unless a chunk with the same content is
+// already stored, and returns its id. It reports whether the chunk is new.
+func (r *Repository) putChunk(data []byte) (string, bool, error) {
+	hash := sha256.Sum256(data)
+	id := hex.EncodeToString(hash[:])
+	path := r.chunkPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return id, false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", false, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", false, err
+	}
+	return id, true, nil
+}
+
+// readChunk returns the content of the chunk of the given id, after checking
+// that it matches the id.
+func (r *Repository) readChunk(id string) ([]byte, error) {
+	if len(id) != 2*sha256.Size {
+		return nil, fmt.Errorf("%w: invalid id %q", ErrCorruptChunk, id)
+	}
+	data, err := os.ReadFile(r.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	if hex.EncodeToString(hash[:]) != id {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptChunk, id)
+	}
+	return data, nil
+}
+
+// writeFileAtomic writes data to a temporary file renamed to path, so that
+// path is never seen partly written, even if the process is interrupted.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
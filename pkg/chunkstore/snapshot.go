@@ -0,0 +1,154 @@
+package chunkstore
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+)
+
+// snapshotVersion is the version of the snapshot tree format.
+const snapshotVersion = 1
+
+// paxXattrPrefix is the prefix of the PAX records holding extended
+// attributes in the headers of the backuptar package.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// paxWhiteout is the PAX record marking whiteouts in the headers of the
+// backuptar package.
+const paxWhiteout = "SNAPSHOTTER.whiteout"
+
+// snapshot is the tree of a snapshot: its entries, named like the entries of
+// a tar archive written by the backuptar package, in the order they were
+// added.
+type snapshot struct {
+	Version int         `json:"version"`
+	Time    time.Time   `json:"time"`
+	Entries []treeEntry `json:"entries"`
+}
+
+// treeEntry describes a file of a snapshot with the fields of its tar
+// header. The content of regular files is the concatenation of their chunks.
+// Extended attributes are kept as bytes, they are not always valid UTF-8.
+type treeEntry struct {
+	Name       string            `json:"name"`
+	Type       byte              `json:"type"`
+	Linkname   string            `json:"linkname,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	Mode       int64             `json:"mode"`
+	Uid        int               `json:"uid"`
+	Gid        int               `json:"gid"`
+	Uname      string            `json:"uname,omitempty"`
+	Gname      string            `json:"gname,omitempty"`
+	ModTime    time.Time         `json:"mtime"`
+	AccessTime time.Time         `json:"atime,omitempty"`
+	ChangeTime time.Time         `json:"ctime,omitempty"`
+	Devmajor   int64             `json:"devmajor,omitempty"`
+	Devminor   int64             `json:"devminor,omitempty"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"`
+	Whiteout   bool              `json:"whiteout,omitempty"`
+	Chunks     []string          `json:"chunks,omitempty"`
+}
+
+func newTreeEntry(header *tar.Header) treeEntry {
+	entry := treeEntry{
+		Name:       header.Name,
+		Type:       header.Typeflag,
+		Linkname:   header.Linkname,
+		Size:       header.Size,
+		Mode:       header.Mode,
+		Uid:        header.Uid,
+		Gid:        header.Gid,
+		Uname:      header.Uname,
+		Gname:      header.Gname,
+		ModTime:    header.ModTime,
+		AccessTime: header.AccessTime,
+		ChangeTime: header.ChangeTime,
+		Devmajor:   header.Devmajor,
+		Devminor:   header.Devminor,
+	}
+	_, entry.Whiteout = backuptar.IsWhiteout(header)
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			if entry.Xattrs == nil {
+				entry.Xattrs = make(map[string][]byte)
+			}
+			entry.Xattrs[name] = []byte(value)
+		}
+	}
+	return entry
+}
+
+// header returns the tar header of the entry, as the backuptar package
+// extracts it.
+func (e treeEntry) header() *tar.Header {
+	header := &tar.Header{
+		Typeflag:   e.Type,
+		Name:       e.Name,
+		Linkname:   e.Linkname,
+		Size:       e.Size,
+		Mode:       e.Mode,
+		Uid:        e.Uid,
+		Gid:        e.Gid,
+		Uname:      e.Uname,
+		Gname:      e.Gname,
+		ModTime:    e.ModTime,
+		AccessTime: e.AccessTime,
+		ChangeTime: e.ChangeTime,
+		Devmajor:   e.Devmajor,
+		Devminor:   e.Devminor,
+		Format:     tar.FormatGNU,
+	}
+	if len(e.Xattrs) > 0 {
+		header.PAXRecords = make(map[string]string, len(e.Xattrs))
+		for name, value := range e.Xattrs {
+			header.PAXRecords[paxXattrPrefix+name] = string(value)
+		}
+		header.Format = tar.FormatPAX
+	}
+	if e.Whiteout {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string, 1)
+		}
+		header.PAXRecords[paxWhiteout] = "1"
+		header.Format = tar.FormatPAX
+	}
+	return header
+}
+
+// Exists reports whether the repository has a snapshot of the given name.
+func (r *Repository) Exists(name string) (bool, error) {
+	_, err := os.Stat(r.snapshotPath(name))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// loadSnapshot returns the tree of the snapshot of the given name.
+// backuptar.ErrFileNotFound is returned if there is no such snapshot.
+func (r *Repository) loadSnapshot(name string) (*snapshot, error) {
+	data, err := os.ReadFile(r.snapshotPath(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: snapshot %s", backuptar.ErrFileNotFound, name)
+		}
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", name, err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported version %d of snapshot %s", s.Version, name)
+	}
+	return &s, nil
+}
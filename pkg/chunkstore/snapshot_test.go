@@ -0,0 +1,186 @@
+package chunkstore
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "dir"), 0o750))
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dir", "data.bin"), data, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "empty"), nil, 0o644))
+	require.NoError(t, os.Link(filepath.Join(srcDir, "dir", "data.bin"), filepath.Join(srcDir, "link.bin")))
+	require.NoError(t, os.Symlink("dir/data.bin", filepath.Join(srcDir, "symlink")))
+	mtime := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(srcDir, "dir", "data.bin"), mtime, mtime))
+	srcFile := filepath.Join(tmpDir, "volume.txt")
+	require.NoError(t, os.WriteFile(srcFile, []byte("file data"), 0o644))
+
+	repoPath := filepath.Join(tmpDir, "repo")
+	repo, err := Open(repoPath)
+	require.NoError(t, err)
+	repo.sizes = testSizes
+	w, err := repo.NewSnapshotWriter("prefix/1")
+	require.NoError(t, err)
+	require.NoError(t, w.AddDir(srcDir, "prefix/1/volume1"))
+	require.NoError(t, w.AddFile(srcFile, "prefix/1/volume2"))
+	require.NoError(t, w.Close())
+	first := w.Stats()
+	assert.Equal(t, first.Chunks, first.NewChunks)
+	assert.Equal(t, int64(len(data))+int64(len("file data")), first.Bytes)
+	assert.Len(t, w.Checksums(), 3)
+
+	// A second snapshot of the same content stores no new chunk
+	w, err = repo.NewSnapshotWriter("prefix/2")
+	require.NoError(t, err)
+	require.NoError(t, w.AddDir(srcDir, "prefix/2/volume1"))
+	require.NoError(t, w.Close())
+	assert.Zero(t, w.Stats().NewChunks)
+
+	got, err := repo.ReadFile("prefix/1", "prefix/1/volume2")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("file data"), got)
+	_, err = repo.ReadFile("prefix/1", "prefix/1/volume3")
+	assert.ErrorIs(t, err, backuptar.ErrFileNotFound)
+	_, err = repo.ReadFile("prefix/3", "prefix/3/volume2")
+	assert.ErrorIs(t, err, backuptar.ErrFileNotFound)
+
+	// The repository is reopened with the chunker parameters it was
+	// created with
+	repo, err = Open(repoPath)
+	require.NoError(t, err)
+	checksums, err := repo.ReadChecksums("prefix/1")
+	require.NoError(t, err)
+	assert.Equal(t, w.Checksums()[0].SHA256, checksums[0].SHA256)
+
+	outDir := filepath.Join(tmpDir, "out")
+	err = repo.ExtractAll("prefix/1", map[string]string{
+		"prefix/1/volume1": filepath.Join(outDir, "volume1"),
+		"prefix/1/volume2": filepath.Join(outDir, "volume2.txt"),
+	}, backuptar.WithNoSameOwner())
+	require.NoError(t, err)
+	got, err = os.ReadFile(filepath.Join(outDir, "volume1", "dir", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	fi, err := os.Stat(filepath.Join(outDir, "volume1", "dir", "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	assert.True(t, mtime.Equal(fi.ModTime()))
+	linkInfo, err := os.Stat(filepath.Join(outDir, "volume1", "link.bin"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(fi, linkInfo), "hard link was not restored")
+	target, err := os.Readlink(filepath.Join(outDir, "volume1", "symlink"))
+	require.NoError(t, err)
+	assert.Equal(t, "dir/data.bin", target)
+	fi, err = os.Stat(filepath.Join(outDir, "volume1", "dir"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o750), fi.Mode().Perm())
+	got, err = os.ReadFile(filepath.Join(outDir, "volume2.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("file data"), got)
+}
+
+func TestSnapshot_CorruptChunk(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "volume.txt")
+	require.NoError(t, os.WriteFile(srcFile, []byte("file data"), 0o644))
+	repo, err := Open(filepath.Join(tmpDir, "repo"))
+	require.NoError(t, err)
+	w, err := repo.NewSnapshotWriter("prefix")
+	require.NoError(t, err)
+	require.NoError(t, w.AddFile(srcFile, "prefix/volume"))
+	require.NoError(t, w.Close())
+
+	s, err := repo.loadSnapshot("prefix")
+	require.NoError(t, err)
+	require.Len(t, s.Entries, 1)
+	require.Len(t, s.Entries[0].Chunks, 1)
+	require.NoError(t, os.WriteFile(repo.chunkPath(s.Entries[0].Chunks[0]), []byte("file DATA"), 0o644))
+
+	_, err = repo.ReadFile("prefix", "prefix/volume")
+	assert.ErrorIs(t, err, ErrCorruptChunk)
+	_, err = repo.ReadChecksums("prefix")
+	assert.ErrorIs(t, err, ErrCorruptChunk)
+}
+
+func TestSnapshot_Replace(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "volume.txt")
+	repo, err := Open(filepath.Join(tmpDir, "repo"))
+	require.NoError(t, err)
+	for _, data := range []string{"first", "second"} {
+		require.NoError(t, os.WriteFile(srcFile, []byte(data), 0o644))
+		w, err := repo.NewSnapshotWriter("prefix")
+		require.NoError(t, err)
+		require.NoError(t, w.AddFile(srcFile, "prefix/volume"))
+		require.NoError(t, w.Close())
+	}
+	// A writer which is not closed keeps the snapshot
+	require.NoError(t, os.WriteFile(srcFile, []byte("third"), 0o644))
+	w, err := repo.NewSnapshotWriter("prefix")
+	require.NoError(t, err)
+	require.NoError(t, w.AddFile(srcFile, "prefix/volume"))
+
+	got, err := repo.ReadFile("prefix", "prefix/volume")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), got)
+}
+
+func TestOpen_NotRepository(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0o644))
+	_, err := Open(dir)
+	assert.Error(t, err)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "volume.txt")
+	repo, err := Open(filepath.Join(tmpDir, "repo"))
+	require.NoError(t, err)
+	// chunks writes a snapshot of the file with the given content, and
+	// returns its chunks
+	chunks := func(name, data string) []string {
+		require.NoError(t, os.WriteFile(srcFile, []byte(data), 0o644))
+		w, err := repo.NewSnapshotWriter(name)
+		require.NoError(t, err)
+		require.NoError(t, w.AddFile(srcFile, name+"/volume"))
+		require.NoError(t, w.Close())
+		s, err := repo.loadSnapshot(name)
+		require.NoError(t, err)
+		return s.Entries[0].Chunks
+	}
+	replaced := chunks("prefix/1", "first")
+	kept := chunks("prefix/1", "second")
+	removed := chunks("prefix/2", "other")
+	shared := chunks("prefix/3", "second")
+	assert.Equal(t, kept, shared)
+	require.NoError(t, repo.RemoveSnapshot("prefix/2"))
+	assert.ErrorIs(t, repo.RemoveSnapshot("prefix/2"), backuptar.ErrFileNotFound)
+
+	stats, err := repo.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, GCStats{Chunks: 2, Bytes: int64(len("first") + len("other"))}, stats)
+	for _, id := range append(replaced, removed...) {
+		assert.NoFileExists(t, repo.chunkPath(id))
+	}
+	for _, name := range []string{"prefix/1", "prefix/3"} {
+		got, err := repo.ReadFile(name, name+"/volume")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("second"), got)
+	}
+	stats, err = repo.CollectGarbage()
+	require.NoError(t, err)
+	assert.Zero(t, stats)
+}
@@ -0,0 +1,158 @@
+package chunkstore
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/NethermindEth/docker-volumes-snapshotter/pkg/backuptar"
+)
+
+// Stats counts the chunks of the files written by a SnapshotWriter, and the
+// ones which were not already stored in the repository.
+type Stats struct {
+	Chunks    int
+	Bytes     int64
+	NewChunks int
+	NewBytes  int64
+}
+
+// SnapshotWriter writes a new snapshot to a repository. The chunks of the
+// files are stored as they are added, the snapshot itself is only visible
+// once the writer is closed.
+type SnapshotWriter struct {
+	repo    *Repository
+	name    string
+	entries []treeEntry
+	// checksums of the regular files written by the writer
+	checksums []backuptar.FileChecksum
+	stats     Stats
+}
+
+// NewSnapshotWriter creates a writer of the snapshot of the given name. An
+// existing snapshot of that name is replaced once the writer is closed, and
+// is kept if the writer fails.
+func (r *Repository) NewSnapshotWriter(name string) (*SnapshotWriter, error) {
+	return &SnapshotWriter{repo: r, name: name}, nil
+}
+
+// AddDir adds the content of the directory src to the snapshot under dest,
+// with the same entries as backuptar.BackupWriter.AddDir.
+func (w *SnapshotWriter) AddDir(src, dest string, opts ...backuptar.AddOption) error {
+	return backuptar.FileHeaders(src, dest, w.addEntry, opts...)
+}
+
+// AddFile adds the file src to the snapshot as dest.
+func (w *SnapshotWriter) AddFile(src, dest string, opts ...backuptar.AddOption) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.New("source path is a directory")
+	}
+	return backuptar.FileHeaders(src, dest, w.addEntry, opts...)
+}
+
+// AddWhiteout adds a whiteout entry recording that the file or directory at
+// name was deleted, like backuptar.BackupWriter.AddWhiteout.
+func (w *SnapshotWriter) AddWhiteout(name string) error {
+	w.entries = append(w.entries, newTreeEntry(backuptar.WhiteoutHeader(name)))
+	return nil
+}
+
+// Checksums returns the checksums of the regular files written so far by the
+// writer, in the order they were written.
+func (w *SnapshotWriter) Checksums() []backuptar.FileChecksum {
+	return append([]backuptar.FileChecksum(nil), w.checksums...)
+}
+
+// Stats returns the chunks of the files written so far by the writer.
+func (w *SnapshotWriter) Stats() Stats {
+	return w.stats
+}
+
+// addEntry adds the entry described by header for the file at file, storing
+// the chunks of the content of regular files.
+func (w *SnapshotWriter) addEntry(header *tar.Header, file string, fi os.FileInfo) error {
+	entry := newTreeEntry(header)
+	if header.Typeflag == tar.TypeReg {
+		chunks, sum, err := w.writeContent(file, header.Size)
+		if err != nil {
+			return err
+		}
+		entry.Chunks = chunks
+		w.checksums = append(w.checksums, backuptar.FileChecksum{
+			Name:    header.Name,
+			Size:    header.Size,
+			ModTime: header.ModTime,
+			SHA256:  sum,
+		})
+	}
+	w.entries = append(w.entries, entry)
+	return nil
+}
+
+// writeContent stores the chunks of the file at file, of the given size, and
+// returns their ids and the SHA-256 checksum of the content.
+func (w *SnapshotWriter) writeContent(file string, size int64) ([]string, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	c := newChunker(io.TeeReader(f, h), w.repo.sizes)
+	var (
+		chunks []string
+		n      int64
+	)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		id, isNew, err := w.repo.putChunk(chunk)
+		if err != nil {
+			return nil, "", err
+		}
+		chunks = append(chunks, id)
+		n += int64(len(chunk))
+		w.stats.Chunks++
+		w.stats.Bytes += int64(len(chunk))
+		if isNew {
+			w.stats.NewChunks++
+			w.stats.NewBytes += int64(len(chunk))
+		}
+	}
+	if n != size {
+		return nil, "", fmt.Errorf("file %s changed while it was read: read %d bytes instead of %d", file, n, size)
+	}
+	return chunks, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Close writes the tree of the snapshot, which makes it visible. The tree is
+// renamed over the previous snapshot of the same name, so readers see either
+// of them. A writer which is not closed, after an error, leaves only
+// unreferenced chunks in the repository.
+func (w *SnapshotWriter) Close() error {
+	data, err := json.Marshal(snapshot{
+		Version: snapshotVersion,
+		Time:    time.Now().UTC(),
+		Entries: w.entries,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(w.repo.snapshotPath(w.name), data)
+}
@@ -2,26 +2,226 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 const ConfigFileName = "config.yml"
 
-var ConfigFilePath = "/" + ConfigFileName
+// ConfigFilePath is the default path of the configuration file, the target of
+// its volume mount inside the container.
+const ConfigFilePath = "/" + ConfigFileName
 
 // Config is the configuration for the backup/restore process.
 type Config struct {
-	Prefix  string   `yaml:"prefix"`
-	Volumes []string `yaml:"volumes"`
+	Prefix      string       `yaml:"prefix"`
+	Volumes     []Volume     `yaml:"volumes"`
+	Compression *Compression `yaml:"compression,omitempty"`
+	Encryption  *Encryption  `yaml:"encryption,omitempty"`
+	ChunkStore  *ChunkStore  `yaml:"chunkStore,omitempty"`
+	Storage     *Storage     `yaml:"storage,omitempty"`
+	Hooks       *Hooks       `yaml:"hooks,omitempty"`
+	// Snapshot is the strategy of the snapshots the volumes are backed up
+	// from, the volumes are backed up from their live files if it is empty.
+	Snapshot string `yaml:"snapshot,omitempty"`
+	// SnapshotDir is the staging directory of the snapshots, which must be
+	// on the filesystem of the volumes. The snapshots are made inside the
+	// directory volumes, and next to the file volumes, if it is empty.
+	SnapshotDir string `yaml:"snapshotDir,omitempty"`
 }
 
-// LoadConfig loads the configuration from the ConfigFilePath file.
-func LoadConfig() (*Config, error) {
-	configFile, err := os.Open(ConfigFilePath)
+// Snapshot strategies. A volume is backed up from its live files, with a
+// warning, if the strategy is not available for it.
+const (
+	// SnapshotAuto uses the first available of SnapshotBtrfs and
+	// SnapshotReflink.
+	SnapshotAuto = "auto"
+	// SnapshotBtrfs snapshots the directory volumes which are btrfs
+	// subvolumes.
+	SnapshotBtrfs = "btrfs"
+	// SnapshotReflink clones the files of the volumes on filesystems
+	// supporting reflinks, such as btrfs and XFS.
+	SnapshotReflink = "reflink"
+)
+
+// Hooks are commands run around the backup and the restore of the
+// configuration, or of one of its volumes.
+type Hooks struct {
+	// Pre and Post run before and after the backup.
+	Pre  []Hook `yaml:"pre,omitempty"`
+	Post []Hook `yaml:"post,omitempty"`
+	// PreRestore and PostRestore run before and after the restore.
+	PreRestore  []Hook `yaml:"preRestore,omitempty"`
+	PostRestore []Hook `yaml:"postRestore,omitempty"`
+}
+
+// Failure policies of the hooks.
+const (
+	// HookAbort fails the backup or the restore when the hook fails.
+	HookAbort = "abort"
+	// HookContinue logs the failure of the hook and goes on.
+	HookContinue = "continue"
+)
+
+// Hook is a command run before or after a backup or a restore.
+type Hook struct {
+	// Command is the program to run and its arguments. It is not run by a
+	// shell, use [sh, -c, script] for shell features.
+	Command []string `yaml:"command"`
+	// Timeout is the time after which the command is killed and fails, such
+	// as 30s. The command can run as long as it needs if it is not set.
+	Timeout Duration `yaml:"timeout,omitempty"`
+	// OnFailure is the failure policy of the hook, HookAbort by default.
+	OnFailure string `yaml:"onFailure,omitempty"`
+	// Always runs a post hook after a failed backup or restore, or a failed
+	// hook, as well, such as a hook resuming a process stopped by a pre hook.
+	// Post hooks otherwise only run after a success.
+	Always bool `yaml:"always,omitempty"`
+}
+
+// Duration is a time.Duration written as a string in the configuration file,
+// such as 1m30s.
+type Duration time.Duration
+
+// UnmarshalYAML decodes the duration from a string.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalYAML encodes the duration as a string.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Compression configures the compression of the backup archive.
+type Compression struct {
+	// Algorithm is the compression algorithm: none, gzip or zstd.
+	Algorithm string `yaml:"algorithm"`
+	// Level is the compression level of the algorithm, 0 selects its default
+	// level.
+	Level int `yaml:"level,omitempty"`
+}
+
+// Encryption configures the encryption of the backed up files with age. The
+// key material is read from files, or from the SNAPSHOTTER_AGE_RECIPIENTS,
+// SNAPSHOTTER_AGE_IDENTITY and SNAPSHOTTER_PASSPHRASE environment variables.
+type Encryption struct {
+	// Recipients are the age public keys the backup is encrypted to.
+	Recipients []string `yaml:"recipients,omitempty"`
+	// RecipientsFile is the path to a file with one age public key per line.
+	RecipientsFile string `yaml:"recipientsFile,omitempty"`
+	// IdentityFile is the path to the age identity file used to restore.
+	IdentityFile string `yaml:"identityFile,omitempty"`
+	// PassphraseFile is the path to a file holding the passphrase used to
+	// encrypt and decrypt the backup, instead of age keys.
+	PassphraseFile string `yaml:"passphraseFile,omitempty"`
+}
+
+// ChunkStore stores the backups in a deduplicated chunk store repository
+// instead of the tar archive: files are split into content-defined chunks,
+// and each unique chunk is stored once across all the backups.
+type ChunkStore struct {
+	// Path is the absolute path to the repository directory, it is created
+	// by the first backup.
+	Path string `yaml:"path"`
+}
+
+// Storage stores every backup as an object of its own in a storage backend,
+// instead of appending it to the tar archive.
+type Storage struct {
+	// Type is the storage backend: local or s3.
+	Type  string        `yaml:"type"`
+	Local *LocalStorage `yaml:"local,omitempty"`
+	S3    *S3Storage    `yaml:"s3,omitempty"`
+}
+
+// LocalStorage configures the storage of the backups in a local directory.
+type LocalStorage struct {
+	// Path is the absolute path to the directory holding the backups.
+	Path string `yaml:"path"`
+}
+
+// S3Storage configures the storage of the backups in an S3-compatible object
+// store. The credentials are read from the configuration, or from the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+type S3Storage struct {
+	// Endpoint is the URL of the object store, such as
+	// https://s3.us-east-1.amazonaws.com. Buckets are addressed by path.
+	Endpoint string `yaml:"endpoint"`
+	// Region is the region of the bucket, us-east-1 by default.
+	Region string `yaml:"region,omitempty"`
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to the keys of the backups in the bucket.
+	Prefix string `yaml:"prefix,omitempty"`
+	// AccessKeyID is the access key used to sign the requests.
+	AccessKeyID string `yaml:"accessKeyId,omitempty"`
+	// SecretAccessKeyFile is the path to a file holding the secret key of
+	// the access key.
+	SecretAccessKeyFile string `yaml:"secretAccessKeyFile,omitempty"`
+	// PartSizeMiB is the size of the parts of the multipart uploads, in MiB.
+	// It bounds the size of a backup to 10000 parts, 64 MiB by default.
+	PartSizeMiB int64 `yaml:"partSizeMiB,omitempty"`
+}
+
+// Volume is a volume to backup. In the configuration file it is either the
+// path of the volume or an object with the path and the volume options.
+type Volume struct {
+	// Path is the absolute path to the volume target, a directory or a file.
+	Path string `yaml:"path"`
+	// Xattrs enables the backup of extended attributes and POSIX ACLs.
+	Xattrs bool `yaml:"xattrs,omitempty"`
+	// Include only backs up the files of a directory volume matching one of
+	// these gitignore-style patterns, relative to the volume path.
+	Include []string `yaml:"include,omitempty"`
+	// Exclude skips the files of a directory volume matching one of these
+	// gitignore-style patterns, relative to the volume path.
+	Exclude []string `yaml:"exclude,omitempty"`
+	// Hooks run around the backup and the restore of the volume.
+	Hooks *Hooks `yaml:"hooks,omitempty"`
+}
+
+// UnmarshalYAML decodes a volume from a plain path or from an object.
+func (v *Volume) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		*v = Volume{Path: path}
+		return nil
+	}
+	type plain Volume
+	return unmarshal((*plain)(v))
+}
+
+// MarshalYAML encodes a volume without options as a plain path.
+func (v Volume) MarshalYAML() (interface{}, error) {
+	if !v.Xattrs && len(v.Include) == 0 && len(v.Exclude) == 0 && v.Hooks == nil {
+		return v.Path, nil
+	}
+	type plain Volume
+	return plain(v), nil
+}
+
+// LoadConfig loads the configuration from the file at path. The overrides
+// set keys of the configuration over the ones of the file, as key=value pairs
+// where key is the dotted path of the key, such as prefix=node-1 or
+// compression.algorithm=zstd, and value is a YAML value, such as
+// volumes=[/data,/config.toml].
+func LoadConfig(path string, overrides ...string) (*Config, error) {
+	configFile, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -36,17 +236,157 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, override := range overrides {
+		if err := config.set(override); err != nil {
+			return nil, err
+		}
+	}
 	for _, v := range config.Volumes {
-		if !filepath.IsAbs(v) {
+		if !filepath.IsAbs(v.Path) {
 			return nil, errors.New("volume path must be absolute")
 		}
-		if _, err := os.Stat(v); err != nil {
+		if _, err := os.Stat(v.Path); err != nil {
 			return nil, err
 		}
+		if err := v.Hooks.validate(); err != nil {
+			return nil, fmt.Errorf("volume %s: %w", v.Path, err)
+		}
+	}
+	if err := config.Hooks.validate(); err != nil {
+		return nil, err
+	}
+	switch config.Snapshot {
+	case "", SnapshotAuto, SnapshotBtrfs, SnapshotReflink:
+	default:
+		return nil, fmt.Errorf("unknown snapshot strategy %q, expected %s, %s or %s", config.Snapshot, SnapshotAuto, SnapshotBtrfs, SnapshotReflink)
+	}
+	if dir := config.SnapshotDir; dir != "" {
+		if config.Snapshot == "" {
+			return nil, errors.New("snapshot directory requires a snapshot strategy")
+		}
+		if !filepath.IsAbs(dir) {
+			return nil, errors.New("snapshot directory path must be absolute")
+		}
+		// The snapshots would be made inside the volumes they copy, or
+		// over their files
+		for _, v := range config.Volumes {
+			if isWithin(dir, v.Path) || isWithin(v.Path, dir) {
+				return nil, fmt.Errorf("snapshot directory %s can't overlap volume %s", dir, v.Path)
+			}
+		}
+	}
+	if c := config.Compression; c != nil {
+		switch c.Algorithm {
+		case "none", "gzip", "zstd":
+		default:
+			return nil, fmt.Errorf("unknown compression algorithm %q", c.Algorithm)
+		}
+	}
+	if e := config.Encryption; e != nil {
+		for _, path := range []string{e.RecipientsFile, e.IdentityFile, e.PassphraseFile} {
+			if path != "" && !filepath.IsAbs(path) {
+				return nil, errors.New("encryption key file path must be absolute")
+			}
+		}
+	}
+	if cs := config.ChunkStore; cs != nil {
+		if !filepath.IsAbs(cs.Path) {
+			return nil, errors.New("chunk store path must be absolute")
+		}
+		if c := config.Compression; c != nil && c.Algorithm != "none" {
+			return nil, errors.New("compression is not supported with the chunk store")
+		}
+		if config.Encryption != nil {
+			return nil, errors.New("encryption is not supported with the chunk store")
+		}
+	}
+	if s := config.Storage; s != nil {
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+		if config.ChunkStore != nil {
+			return nil, errors.New("storage can't be combined with the chunk store")
+		}
 	}
 	return &config, nil
 }
 
+// isWithin reports whether path is dir or under it.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// set applies the key=value override to the configuration, merging it like a
+// document holding only the value at the key.
+func (c *Config) set(override string) error {
+	key, value, ok := strings.Cut(override, "=")
+	if !ok || key == "" || strings.ContainsAny(value, "\n\r") {
+		return fmt.Errorf("invalid configuration override %q, expected key=value", override)
+	}
+	var doc strings.Builder
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		if part == "" || strings.ContainsAny(part, ":#{}[],&*!|>'\"%@` ") {
+			return fmt.Errorf("invalid configuration key %q", key)
+		}
+		doc.WriteString(strings.Repeat("  ", i) + part + ":")
+		if i < len(parts)-1 {
+			doc.WriteString("\n")
+		}
+	}
+	doc.WriteString(" " + value + "\n")
+	// Unknown keys and values of the wrong type are errors
+	if err := yaml.UnmarshalStrict([]byte(doc.String()), &Config{}); err != nil {
+		return fmt.Errorf("invalid configuration override %q: %w", override, err)
+	}
+	return yaml.Unmarshal([]byte(doc.String()), c)
+}
+
+func (h *Hooks) validate() error {
+	if h == nil {
+		return nil
+	}
+	for _, hooks := range [][]Hook{h.Pre, h.Post, h.PreRestore, h.PostRestore} {
+		for _, hook := range hooks {
+			if len(hook.Command) == 0 {
+				return errors.New("hook command can't be empty")
+			}
+			if hook.Timeout < 0 {
+				return errors.New("hook timeout can't be negative")
+			}
+			switch hook.OnFailure {
+			case "", HookAbort, HookContinue:
+			default:
+				return fmt.Errorf("unknown hook failure policy %q, expected %s or %s", hook.OnFailure, HookAbort, HookContinue)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Storage) validate() error {
+	switch s.Type {
+	case "local":
+		if s.Local == nil || !filepath.IsAbs(s.Local.Path) {
+			return errors.New("local storage path must be absolute")
+		}
+	case "s3":
+		if s.S3 == nil || s.S3.Endpoint == "" || s.S3.Bucket == "" {
+			return errors.New("s3 storage requires an endpoint and a bucket")
+		}
+		if path := s.S3.SecretAccessKeyFile; path != "" && !filepath.IsAbs(path) {
+			return errors.New("s3 secret access key file path must be absolute")
+		}
+		if size := s.S3.PartSizeMiB; size != 0 && (size < 5 || size > 5<<10) {
+			return errors.New("s3 part size must be between 5 MiB and 5 GiB")
+		}
+	default:
+		return fmt.Errorf("unknown storage type %q", s.Type)
+	}
+	return nil
+}
+
 // Save saves the configuration to the given path in YAML format.
 func (c *Config) Save(path string) error {
 	configFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -16,8 +17,6 @@ func TestLoadConfig(t *testing.T) {
 	configFile, err := os.CreateTemp(tempDir, ConfigFileName)
 	require.NoError(t, err)
 
-	ConfigFilePath = configFile.Name()
-
 	tc := []struct {
 		name  string
 		setup func(t *testing.T) ([]byte, *Config)
@@ -37,7 +36,7 @@ volumes:
 `, volume1, volume2.Name()))
 				config := &Config{
 					Prefix:  "prefix/path",
-					Volumes: []string{volume1, volume2.Name()},
+					Volumes: []Volume{{Path: volume1}, {Path: volume2.Name()}},
 				}
 				return configData, config
 			},
@@ -57,7 +56,7 @@ volumes:
 `, volume1, volume2.Name()))
 				config := &Config{
 					Prefix:  "prefix/path",
-					Volumes: []string{volume1, filepath.Dir(volume2.Name())},
+					Volumes: []Volume{{Path: volume1}, {Path: filepath.Dir(volume2.Name())}},
 				}
 				return configData, config
 			},
@@ -77,7 +76,7 @@ volumes:
 `, volume1, volume2.Name()))
 				config := &Config{
 					Prefix:  "prefix/path",
-					Volumes: []string{volume1 + "-suffix", volume2.Name()},
+					Volumes: []Volume{{Path: volume1 + "-suffix"}, {Path: volume2.Name()}},
 				}
 				return configData, config
 			},
@@ -93,7 +92,7 @@ volumes:
 			_, err = configFile.Write(configData)
 			require.NoError(t, err)
 
-			config, err := LoadConfig()
+			config, err := LoadConfig(configFile.Name())
 			if tt.err != nil {
 				assert.Error(t, err)
 			} else {
@@ -104,6 +103,490 @@ volumes:
 	}
 }
 
+// TestLoadConfig_Options covers the options of the configuration, every case
+// being written to a configuration file of its own.
+func TestLoadConfig_Options(t *testing.T) {
+	tempDir := t.TempDir()
+
+	tc := []struct {
+		name  string
+		setup func(t *testing.T) ([]byte, *Config)
+		err   error
+	}{
+		{
+			name: "valid config, volume with options",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				volume2, err := os.CreateTemp(tempDir, "volume2-*.txt")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- path: %s
+  xattrs: true
+- %s
+`, volume1, volume2.Name()))
+				config := &Config{
+					Prefix:  "prefix/path",
+					Volumes: []Volume{{Path: volume1, Xattrs: true}, {Path: volume2.Name()}},
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "valid config, volume with patterns",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- path: %s
+  include:
+  - chaindata/**
+  exclude:
+  - LOCK
+  - "*.log"
+`, volume1))
+				config := &Config{
+					Prefix:  "prefix/path",
+					Volumes: []Volume{{Path: volume1, Include: []string{"chaindata/**"}, Exclude: []string{"LOCK", "*.log"}}},
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "valid config, hooks",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- path: %s
+  hooks:
+    pre:
+    - command: [docker, stop, geth]
+      timeout: 1m
+    post:
+    - command: [docker, start, geth]
+      always: true
+hooks:
+  postRestore:
+  - command: [curl, -fsS, http://localhost/restored]
+    onFailure: continue
+`, volume1))
+				config := &Config{
+					Prefix: "prefix/path",
+					Volumes: []Volume{{Path: volume1, Hooks: &Hooks{
+						Pre:  []Hook{{Command: []string{"docker", "stop", "geth"}, Timeout: Duration(time.Minute)}},
+						Post: []Hook{{Command: []string{"docker", "start", "geth"}, Always: true}},
+					}}},
+					Hooks: &Hooks{
+						PostRestore: []Hook{{Command: []string{"curl", "-fsS", "http://localhost/restored"}, OnFailure: HookContinue}},
+					},
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "invalid config, unknown hook failure policy",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+hooks:
+  pre:
+  - command: [sync]
+    onFailure: retry
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New("unknown hook failure policy"),
+		},
+		{
+			name: "invalid config, hook without command",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- path: %s
+  hooks:
+    pre:
+    - timeout: 10s
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New("hook command can't be empty"),
+		},
+		{
+			name: "valid config, snapshot",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+snapshot: auto
+`, volume1))
+				config := &Config{
+					Prefix:   "prefix/path",
+					Volumes:  []Volume{{Path: volume1}},
+					Snapshot: SnapshotAuto,
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "invalid config, unknown snapshot strategy",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+snapshot: lvm
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New("unknown snapshot strategy"),
+		},
+		{
+			name: "valid config, snapshot directory",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				snapshotDir := filepath.Join(tempDir, "snapshots")
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+snapshot: reflink
+snapshotDir: %s
+`, volume1, snapshotDir))
+				config := &Config{
+					Prefix:      "prefix/path",
+					Volumes:     []Volume{{Path: volume1}},
+					Snapshot:    SnapshotReflink,
+					SnapshotDir: snapshotDir,
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "invalid config, snapshot directory without snapshots",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+snapshotDir: /snapshots
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New("snapshot directory requires a snapshot strategy"),
+		},
+		{
+			name: "invalid config, snapshot directory in a volume",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+snapshot: auto
+snapshotDir: %s/snapshots
+`, volume1, volume1))
+				return configData, nil
+			},
+			err: errors.New("can't overlap volume"),
+		},
+		{
+			name: "valid config, compression",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+compression:
+  algorithm: zstd
+  level: 19
+`, volume1))
+				config := &Config{
+					Prefix:      "prefix/path",
+					Volumes:     []Volume{{Path: volume1}},
+					Compression: &Compression{Algorithm: "zstd", Level: 19},
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "invalid config, unknown compression",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+compression:
+  algorithm: lz4
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New(`unknown compression algorithm "lz4"`),
+		},
+		{
+			name: "valid config, encryption",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+encryption:
+  recipients:
+  - age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+  identityFile: /keys/backup.txt
+`, volume1))
+				config := &Config{
+					Prefix:  "prefix/path",
+					Volumes: []Volume{{Path: volume1}},
+					Encryption: &Encryption{
+						Recipients:   []string{"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"},
+						IdentityFile: "/keys/backup.txt",
+					},
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "invalid config, relative key file",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+encryption:
+  passphraseFile: keys/passphrase
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New("encryption key file path must be absolute"),
+		},
+		{
+			name: "valid config, chunk store",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+chunkStore:
+  path: /repository
+`, volume1))
+				config := &Config{
+					Prefix:     "prefix/path",
+					Volumes:    []Volume{{Path: volume1}},
+					ChunkStore: &ChunkStore{Path: "/repository"},
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "invalid config, chunk store with encryption",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+chunkStore:
+  path: /repository
+encryption:
+  passphraseFile: /keys/passphrase
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New("encryption is not supported with the chunk store"),
+		},
+		{
+			name: "valid config, s3 storage",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+storage:
+  type: s3
+  s3:
+    endpoint: http://minio:9000
+    bucket: backups
+    secretAccessKeyFile: /keys/s3
+`, volume1))
+				config := &Config{
+					Prefix:  "prefix/path",
+					Volumes: []Volume{{Path: volume1}},
+					Storage: &Storage{
+						Type: "s3",
+						S3: &S3Storage{
+							Endpoint:            "http://minio:9000",
+							Bucket:              "backups",
+							SecretAccessKeyFile: "/keys/s3",
+						},
+					},
+				}
+				return configData, config
+			},
+			err: nil,
+		},
+		{
+			name: "invalid config, unknown storage type",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+storage:
+  type: ftp
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New(`unknown storage type "ftp"`),
+		},
+		{
+			name: "invalid config, local storage without path",
+			setup: func(t *testing.T) ([]byte, *Config) {
+				volume1, err := os.MkdirTemp(tempDir, "volume1")
+				require.NoError(t, err)
+				configData := []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+storage:
+  type: local
+`, volume1))
+				return configData, nil
+			},
+			err: errors.New("local storage path must be absolute"),
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			configData, wantConfig := tt.setup(t)
+			configPath := filepath.Join(t.TempDir(), ConfigFileName)
+			require.NoError(t, os.WriteFile(configPath, configData, 0o644))
+
+			config, err := LoadConfig(configPath)
+			if tt.err != nil {
+				assert.ErrorContains(t, err, tt.err.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, wantConfig, config)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Overrides(t *testing.T) {
+	tempDir := t.TempDir()
+	volume1 := filepath.Join(tempDir, "volume1")
+	require.NoError(t, os.Mkdir(volume1, 0o755))
+	volume2 := filepath.Join(tempDir, "volume2")
+	require.NoError(t, os.Mkdir(volume2, 0o755))
+	configPath := filepath.Join(tempDir, ConfigFileName)
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`prefix: prefix/path
+volumes:
+- %s
+compression:
+  algorithm: gzip
+  level: 9
+`, volume1)), 0o644))
+
+	tc := []struct {
+		name      string
+		overrides []string
+		want      *Config
+		err       string
+	}{
+		{
+			name: "no overrides",
+			want: &Config{
+				Prefix:      "prefix/path",
+				Volumes:     []Volume{{Path: volume1}},
+				Compression: &Compression{Algorithm: "gzip", Level: 9},
+			},
+		},
+		{
+			name:      "keys",
+			overrides: []string{"prefix=001", "compression.algorithm=zstd", "volumes=[" + volume2 + "]"},
+			want: &Config{
+				Prefix:      "001",
+				Volumes:     []Volume{{Path: volume2}},
+				Compression: &Compression{Algorithm: "zstd", Level: 9},
+			},
+		},
+		{
+			name:      "new section",
+			overrides: []string{"chunkStore.path=/chunks", "compression.algorithm=none"},
+			want: &Config{
+				Prefix:      "prefix/path",
+				Volumes:     []Volume{{Path: volume1}},
+				Compression: &Compression{Algorithm: "none", Level: 9},
+				ChunkStore:  &ChunkStore{Path: "/chunks"},
+			},
+		},
+		{
+			name:      "unknown key",
+			overrides: []string{"compression.speed=1"},
+			err:       "field speed not found",
+		},
+		{
+			name:      "wrong type",
+			overrides: []string{"compression.level=fast"},
+			err:       "cannot unmarshal",
+		},
+		{
+			name:      "missing value",
+			overrides: []string{"prefix"},
+			err:       "expected key=value",
+		},
+		{
+			name:      "invalid key",
+			overrides: []string{"compression..level=1"},
+			err:       "invalid configuration key",
+		},
+		{
+			name:      "validated",
+			overrides: []string{"compression.algorithm=lz4"},
+			err:       "unknown compression algorithm",
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfig(configPath, tt.overrides...)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, config)
+		})
+	}
+}
+
 func TestSaveConfig(t *testing.T) {
 	tmpDir := t.TempDir()
 	configFilePath := filepath.Join(tmpDir, ConfigFileName)
@@ -111,7 +594,7 @@ func TestSaveConfig(t *testing.T) {
 	// Create a config to save
 	config := &Config{
 		Prefix:  "prefix/path",
-		Volumes: []string{"/path/to/volume1", "/path/to/volume2"},
+		Volumes: []Volume{{Path: "/path/to/volume1"}, {Path: "/path/to/volume2"}},
 	}
 
 	// Test saving a valid config
@@ -127,3 +610,29 @@ volumes:
 - /path/to/volume2
 `), savedConfigData)
 }
+
+func TestSaveConfig_Options(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFilePath := filepath.Join(tmpDir, ConfigFileName)
+
+	// Volumes with options are saved as mappings, the others as plain paths
+	config := &Config{
+		Prefix:  "prefix/path",
+		Volumes: []Volume{{Path: "/path/to/volume1"}, {Path: "/path/to/volume2", Xattrs: true}, {Path: "/path/to/volume3", Exclude: []string{"*.log"}}},
+	}
+
+	err := config.Save(configFilePath)
+	assert.NoError(t, err)
+
+	savedConfigData, err := os.ReadFile(configFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`prefix: prefix/path
+volumes:
+- /path/to/volume1
+- path: /path/to/volume2
+  xattrs: true
+- path: /path/to/volume3
+  exclude:
+  - '*.log'
+`), savedConfigData)
+}